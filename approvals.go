@@ -0,0 +1,491 @@
+package main
+
+import (
+    "database/sql"
+    "errors"
+    "fmt"
+    "log"
+    "net/http"
+    "strconv"
+    "strings"
+    "time"
+
+    "github.com/gin-gonic/gin"
+)
+
+// ApproverManager is the approver of rules decided by the submitter's line manager, as
+// resolved by resolveApprover. Other approvers name a group whose members decide the step.
+const ApproverManager = "manager"
+
+// Statuses of an approval step.
+const (
+    StepPending  = "pending"
+    StepApproved = "approved"
+    StepRejected = "rejected"
+)
+
+// ApprovalRule is a step of the approval chain. A rule with a threshold only applies to
+// reports whose total (tax included) exceeds it.
+type ApprovalRule struct {
+    Name         string
+    Above        float64
+    HasThreshold bool
+    Approver     string
+}
+
+// appliesTo reports whether the step is required for a report total.
+func (r ApprovalRule) appliesTo(total float64) bool {
+    return !r.HasThreshold || total > r.Above
+}
+
+// defaultApprovalSteps requires the line manager's approval for every report, then the
+// Finance group above 1,000 EUR and the Direction group above 10,000 EUR.
+const defaultApprovalSteps = "manager=manager;finance>1000=Finance;director>10000=Direction"
+
+// approvalRules is the ordered approval chain read from APPROVAL_STEPS.
+var approvalRules = parseApprovalRules(envOrDefault("APPROVAL_STEPS", defaultApprovalSteps))
+
+// parseApprovalRules parses semicolon separated steps of the form name[>amount]=approver,
+// where approver is "manager" or a group name. Invalid entries are skipped.
+func parseApprovalRules(s string) []ApprovalRule {
+    var rules []ApprovalRule
+    for _, entry := range strings.Split(s, ";") {
+        entry = strings.TrimSpace(entry)
+        if entry == "" {
+            continue
+        }
+        i := strings.LastIndex(entry, "=")
+        if i <= 0 || i == len(entry)-1 {
+            log.Printf("[WARN] ignoring approval step %q: expected name[>amount]=approver", entry)
+            continue
+        }
+        rule := ApprovalRule{Name: strings.TrimSpace(entry[:i]), Approver: strings.TrimSpace(entry[i+1:])}
+        if j := strings.Index(rule.Name, ">"); j >= 0 {
+            above, err := strconv.ParseFloat(strings.TrimSpace(rule.Name[j+1:]), 64)
+            if err != nil {
+                log.Printf("[WARN] ignoring approval step %q: invalid amount", entry)
+                continue
+            }
+            rule.Name, rule.Above, rule.HasThreshold = strings.TrimSpace(rule.Name[:j]), above, true
+        }
+        rules = append(rules, rule)
+    }
+    return rules
+}
+
+// ApprovalStep is a step of the approval chain of a submitted report. Manager steps are
+// decided by ApproverID, group steps by the members of ApproverGroupID. A step whose
+// approver could not be resolved is left to the validators of the owner's groups
+// (manager steps) or to global reviewers (group steps). A step escalated past the approval
+// SLA can also be decided by the members of EscalatedGroupID. OnBehalfOf is the validator
+// a delegate decided the step for.
+type ApprovalStep struct {
+    ID               int64      `json:"id"`
+    Position         int        `json:"position"`
+    Name             string     `json:"name"`
+    Approver         string     `json:"approver"`
+    ApproverID       *int64     `json:"approver_id,omitempty"`
+    ApproverGroupID  *int64     `json:"approver_group_id,omitempty"`
+    Status           string     `json:"status"`
+    DecidedBy        *int64     `json:"decided_by,omitempty"`
+    DecidedAt        *time.Time `json:"decided_at,omitempty"`
+    OnBehalfOf       *int64     `json:"on_behalf_of,omitempty"`
+    Comment          *string    `json:"comment,omitempty"`
+    EscalatedGroupID *int64     `json:"escalated_group_id,omitempty"`
+    EscalatedAt      *time.Time `json:"escalated_at,omitempty"`
+}
+
+// queryRower is implemented by *sql.DB and *sql.Tx.
+type queryRower interface {
+    QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// execer is implemented by *sql.DB and *sql.Tx.
+type execer interface {
+    Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// queryer is implemented by *sql.DB and *sql.Tx.
+type queryer interface {
+    Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// reportTotal returns the total of a report, tax included.
+func reportTotal(q queryRower, reportID int64) (float64, error) {
+    var total float64
+    if err := q.QueryRow("SELECT COALESCE(SUM(amount_ttc), 0) FROM expense_items WHERE report_id = ?", reportID).Scan(&total); err != nil {
+        return 0, fmt.Errorf("compute report total: %w", err)
+    }
+    return total, nil
+}
+
+// planApprovalSteps returns the steps required for a report of ownerID with the given
+// total, with their approvers resolved.
+func planApprovalSteps(db *sql.DB, ownerID int64, total float64) ([]ApprovalStep, error) {
+    var steps []ApprovalStep
+    for _, rule := range approvalRules {
+        if !rule.appliesTo(total) {
+            continue
+        }
+        step := ApprovalStep{Position: len(steps) + 1, Name: rule.Name, Approver: rule.Approver, Status: StepPending}
+        if rule.Approver == ApproverManager {
+            approverID, err := resolveApprover(db, ownerID)
+            if err != nil {
+                return nil, err
+            }
+            if approverID.Valid {
+                step.ApproverID = &approverID.Int64
+            }
+        } else {
+            var groupID int64
+            err := db.QueryRow("SELECT id FROM groups WHERE name = ?", rule.Approver).Scan(&groupID)
+            if errors.Is(err, sql.ErrNoRows) {
+                log.Printf("[WARN] approval step %s references unknown group %q", rule.Name, rule.Approver)
+            } else if err != nil {
+                return nil, fmt.Errorf("select group %s: %w", rule.Approver, err)
+            } else {
+                step.ApproverGroupID = &groupID
+            }
+        }
+        steps = append(steps, step)
+    }
+    return steps, nil
+}
+
+// legacyManagerStep returns the single manager step of a report submitted before approval
+// chains, which only recorded its expected approver.
+func legacyManagerStep(approverID sql.NullInt64) *ApprovalStep {
+    step := &ApprovalStep{Name: ApproverManager, Approver: ApproverManager, Status: StepPending}
+    if approverID.Valid {
+        step.ApproverID = &approverID.Int64
+    }
+    return step
+}
+
+// replaceApprovalSteps stores the approval chain of a report, dropping the steps of an
+// earlier submission.
+func replaceApprovalSteps(tx *sql.Tx, reportID int64, steps []ApprovalStep) error {
+    if _, err := tx.Exec("DELETE FROM report_approval_steps WHERE report_id = ?", reportID); err != nil {
+        return fmt.Errorf("delete approval steps: %w", err)
+    }
+    for _, s := range steps {
+        _, err := tx.Exec(`INSERT INTO report_approval_steps (report_id, position, name, approver, approver_id, approver_group_id, status)
+            VALUES (?, ?, ?, ?, ?, ?, ?)`, reportID, s.Position, s.Name, s.Approver, s.ApproverID, s.ApproverGroupID, s.Status)
+        if err != nil {
+            return fmt.Errorf("insert approval step: %w", err)
+        }
+    }
+    return nil
+}
+
+const approvalStepColumns = "id, position, name, approver, approver_id, approver_group_id, status, decided_by, decided_at, on_behalf_of, comment, escalated_group_id, escalated_at"
+
+func scanApprovalStep(row interface{ Scan(...interface{}) error }) (ApprovalStep, error) {
+    var s ApprovalStep
+    err := row.Scan(&s.ID, &s.Position, &s.Name, &s.Approver, &s.ApproverID, &s.ApproverGroupID, &s.Status, &s.DecidedBy, &s.DecidedAt, &s.OnBehalfOf, &s.Comment, &s.EscalatedGroupID, &s.EscalatedAt)
+    return s, err
+}
+
+// currentApprovalStep returns the first pending step of a report, or nil when every step
+// was decided.
+func currentApprovalStep(q queryRower, reportID int64) (*ApprovalStep, error) {
+    s, err := scanApprovalStep(q.QueryRow("SELECT "+approvalStepColumns+` FROM report_approval_steps
+        WHERE report_id = ? AND status = ? ORDER BY position LIMIT 1`, reportID, StepPending))
+    if errors.Is(err, sql.ErrNoRows) {
+        return nil, nil
+    } else if err != nil {
+        return nil, fmt.Errorf("select current approval step: %w", err)
+    }
+    return &s, nil
+}
+
+// Errors of decideStep that leave the report untouched.
+var (
+    errReportNotFound = errors.New("report not found")
+    errNotSubmitted   = errors.New("report not in submitted state")
+    errStepDecided    = errors.New("step was decided concurrently")
+)
+
+// stepDecision is the outcome of a decision on the current step of a report. Refusal holds
+// the audit code of a refused decision, which leaves the report untouched. OnBehalfOf is
+// the validator a delegate decided for.
+type stepDecision struct {
+    Step       string
+    Status     ReportStatus
+    NextStep   string
+    Refusal    string
+    OnBehalfOf *int64
+}
+
+// decideStep records the decision of the reviewer on the current step of a submitted
+// report, with an optional comment. A rejection rejects the report and posts the comment,
+// its reason, to the report's thread; an approval moves the report to the next step, or
+// approves it when no step is left. A delegate decides steps outside their own scope or
+// approval limit with the rights of a validator they stand in for, on whose behalf the
+// decision is recorded.
+// Refused attempts are only recorded in the audit trail.
+func decideStep(tx *sql.Tx, scope reviewScope, reportID int64, approve bool, comment string) (*stepDecision, error) {
+    userID := scope.reviewerID
+    var ownerID int64
+    var preparedBy *int64
+    var status ReportStatus
+    var approverID sql.NullInt64
+    err := tx.QueryRow("SELECT user_id, prepared_by, status, approver_id FROM expense_reports WHERE id = ?", reportID).Scan(&ownerID, &preparedBy, &status, &approverID)
+    if errors.Is(err, sql.ErrNoRows) {
+        return nil, errReportNotFound
+    } else if err != nil {
+        return nil, fmt.Errorf("select report: %w", err)
+    }
+    if status != StatusSubmitted {
+        return nil, errNotSubmitted
+    }
+    step, err := currentApprovalStep(tx, reportID)
+    if err != nil {
+        return nil, err
+    }
+    if step == nil {
+        step = legacyManagerStep(approverID)
+    }
+    d := &stepDecision{Step: step.Name, Status: status}
+    refusal, err := refuseDecision(tx, scope, reportID, ownerID, preparedBy, step, approve)
+    if err != nil {
+        return nil, err
+    }
+    for i := 0; delegable(refusal) && i < len(scope.delegated); i++ {
+        delegator := scope.delegated[i]
+        r, err := refuseDecision(tx, delegator, reportID, ownerID, preparedBy, step, approve)
+        if err != nil {
+            return nil, err
+        }
+        if r == "" && approve && distinctApprovers {
+            // The delegate approves a single step too
+            approved, err := approvedAnotherStep(tx, reportID, userID)
+            if err != nil {
+                return nil, err
+            }
+            if approved {
+                r = AuditRepeatedApprover
+            }
+        }
+        if r == "" {
+            d.OnBehalfOf = &delegator.reviewerID
+        }
+        if r != AuditOutOfScope {
+            refusal = r
+        }
+    }
+    if refusal != "" {
+        d.Refusal = refusal
+        return d, recordApprovalAudit(tx, reportID, step.Name, userID, nil, approve, refusal)
+    }
+    decision := StepRejected
+    if approve {
+        decision = StepApproved
+    }
+    if err := recordApprovalAudit(tx, reportID, step.Name, userID, d.OnBehalfOf, approve, decision); err != nil {
+        return nil, err
+    }
+    var stepComment *string
+    if comment != "" {
+        stepComment = &comment
+    }
+    if step.ID != 0 {
+        res, err := tx.Exec("UPDATE report_approval_steps SET status = ?, decided_by = ?, decided_at = ?, on_behalf_of = ?, comment = ? WHERE id = ? AND status = ?",
+            decision, userID, time.Now().UTC(), d.OnBehalfOf, stepComment, step.ID, StepPending)
+        if err != nil {
+            return nil, fmt.Errorf("record decision: %w", err)
+        }
+        if n, _ := res.RowsAffected(); n == 0 {
+            return nil, errStepDecided
+        }
+    }
+    next, err := currentApprovalStep(tx, reportID)
+    if err != nil {
+        return nil, err
+    }
+    if approve && next != nil {
+        // The report stays submitted and waits for the next approver
+        if _, err := tx.Exec("UPDATE expense_reports SET approver_id = ? WHERE id = ?", next.ApproverID, reportID); err != nil {
+            return nil, fmt.Errorf("update approver: %w", err)
+        }
+        d.NextStep = next.Name
+    } else {
+        to := StatusApproved
+        if !approve {
+            to = StatusRejected
+        }
+        if err := transitionReport(tx, reportID, status, to, userID, comment); err != nil {
+            return nil, err
+        }
+        d.Status = to
+    }
+    if !approve {
+        if _, err := insertReportComment(tx, reportID, userID, comment); err != nil {
+            return nil, err
+        }
+    }
+    return d, nil
+}
+
+// delegable reports whether a delegate overcomes a refusal with the rights of a validator
+// they stand in for: a step outside their scope, or an amount above their approval limit.
+func delegable(refusal string) bool {
+    return refusal == AuditOutOfScope || refusal == AuditApprovalLimit
+}
+
+// decideReport records the decision of the authenticated user on the current step of the
+// submitted report in the URL, as described by decideStep.
+func (h *Handlers) decideReport(c *gin.Context, approve bool, comment string) {
+    reportID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+    if err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "invalid report id"})
+        return
+    }
+    scope, err := reviewScopeFor(c, h.db)
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "permission check failed"})
+        return
+    }
+    tx, err := h.db.Begin()
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
+        return
+    }
+    defer tx.Rollback()
+    d, err := decideStep(tx, scope, reportID, approve, comment)
+    switch {
+    case errors.Is(err, errReportNotFound):
+        c.JSON(http.StatusNotFound, gin.H{"error": "report not found"})
+        return
+    case errors.Is(err, errNotSubmitted):
+        c.JSON(http.StatusBadRequest, gin.H{"error": "report not found or not in submitted state"})
+        return
+    case errors.Is(err, errStepDecided):
+        c.JSON(http.StatusConflict, gin.H{"error": "step was decided concurrently"})
+        return
+    case errors.Is(err, ErrInvalidTransition), errors.Is(err, ErrStatusChanged):
+        abortTransition(c, err)
+        return
+    case err != nil:
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
+        return
+    }
+    // Refused attempts are kept in the audit trail, hence the commit
+    if err := tx.Commit(); err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
+        return
+    }
+    if d.Refusal != "" {
+        c.JSON(http.StatusForbidden, gin.H{"error": refusalMessages[d.Refusal], "code": d.Refusal})
+        return
+    }
+    resp := gin.H{"id": reportID, "step": d.Step, "status": d.Status}
+    if d.NextStep != "" {
+        resp["next_step"] = d.NextStep
+    }
+    if d.OnBehalfOf != nil {
+        resp["on_behalf_of"] = *d.OnBehalfOf
+    }
+    if !approve {
+        resp["reason"] = comment
+    }
+    c.JSON(http.StatusOK, resp)
+}
+
+// refusalMessages are the error messages of refused decisions, by audit code.
+var refusalMessages = map[string]string{
+    AuditOutOfScope:        "report is outside your validation scope",
+    AuditSelfApproval:      "you cannot approve your own report",
+    AuditSelfRejection:     "you cannot reject your own report",
+    AuditPreparerApproval:  "you cannot approve a report you prepared",
+    AuditPreparerRejection: "you cannot reject a report you prepared",
+    AuditRepeatedApprover:  "you already approved another step of this report",
+    AuditApprovalLimit:     "approving this amount requires reports:approve:high",
+}
+
+// refuseDecision returns the audit code refusing a decision of the reviewer on a step, or
+// an empty string when the decision is allowed. Nobody decides their own report or a
+// report they prepared as a proxy, even with reports:read:all, and with distinctApprovers
+// an approver approves a single step. Approving a report above the high value threshold
+// requires reports:approve:high.
+func refuseDecision(tx *sql.Tx, scope reviewScope, reportID, ownerID int64, preparedBy *int64, step *ApprovalStep, approve bool) (string, error) {
+    if ownerID == scope.reviewerID {
+        if approve {
+            return AuditSelfApproval, nil
+        }
+        return AuditSelfRejection, nil
+    }
+    if preparedBy != nil && *preparedBy == scope.reviewerID {
+        if approve {
+            return AuditPreparerApproval, nil
+        }
+        return AuditPreparerRejection, nil
+    }
+    allowed, err := scope.canDecide(tx, ownerID, step)
+    if err != nil {
+        return "", err
+    }
+    if !allowed {
+        return AuditOutOfScope, nil
+    }
+    if approve && highValueAbove > 0 && !scope.approveHigh {
+        total, err := reportTotal(tx, reportID)
+        if err != nil {
+            return "", err
+        }
+        if requiresHighApproval(total) {
+            return AuditApprovalLimit, nil
+        }
+    }
+    if approve && distinctApprovers {
+        approved, err := approvedAnotherStep(tx, reportID, scope.reviewerID)
+        if err != nil {
+            return "", err
+        }
+        if approved {
+            return AuditRepeatedApprover, nil
+        }
+    }
+    return "", nil
+}
+
+// approvedAnotherStep reports whether a user approved a step of a report, themselves or
+// through a delegate.
+func approvedAnotherStep(q queryRower, reportID, userID int64) (bool, error) {
+    var approved bool
+    err := q.QueryRow("SELECT EXISTS (SELECT 1 FROM report_approval_steps WHERE report_id = ? AND ? IN (decided_by, on_behalf_of) AND status = ?)",
+        reportID, userID, StepApproved).Scan(&approved)
+    if err != nil {
+        return false, fmt.Errorf("check previous approvals: %w", err)
+    }
+    return approved, nil
+}
+
+// ListApprovalSteps returns the approval chain of a report with the decision of each
+// step. It is visible to the owner and to the reviewers who can see the report.
+func (h *Handlers) ListApprovalSteps(c *gin.Context) {
+    reportID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+    if err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "invalid report id"})
+        return
+    }
+    if !h.authorizeReportRead(c, reportID) {
+        return
+    }
+    rows, err := h.db.Query("SELECT "+approvalStepColumns+" FROM report_approval_steps WHERE report_id = ? ORDER BY position", reportID)
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
+        return
+    }
+    defer rows.Close()
+    steps := []ApprovalStep{}
+    for rows.Next() {
+        s, err := scanApprovalStep(rows)
+        if err != nil {
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
+            return
+        }
+        steps = append(steps, s)
+    }
+    c.JSON(http.StatusOK, steps)
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseApprovalRules(t *testing.T) {
+	rules := parseApprovalRules(" manager=manager ; finance>1000=Finance;broken;big>x=Direction;director > 10000 = Direction")
+	assert.Equal(t, []ApprovalRule{
+		{Name: "manager", Approver: ApproverManager},
+		{Name: "finance", Above: 1000, HasThreshold: true, Approver: "Finance"},
+		{Name: "director", Above: 10000, HasThreshold: true, Approver: "Direction"},
+	}, rules)
+	assert.True(t, rules[0].appliesTo(0))
+	assert.False(t, rules[1].appliesTo(1000))
+	assert.True(t, rules[1].appliesTo(1000.01))
+}
+
+// approvalChain holds the API keys of an employee whose manager is a validator, and of one
+// member of each of the Finance and Direction groups.
+type approvalChain struct {
+	employee, manager, finance, director string
+	managerID, financeID, directorID     int64
+}
+
+func newApprovalChain(t *testing.T, h *Handlers) approvalChain {
+	employee := createTestUser(t, h, "emp@example.com")
+	manager := createValidator(t, h, "manager@example.com")
+	finance := createTestUser(t, h, "finance@example.com")
+	director := createTestUser(t, h, "director@example.com")
+	_, err := h.db.Exec(`INSERT INTO user_groups (user_id, group_id)
+		SELECT ?, id FROM groups WHERE name = 'Finance' UNION ALL SELECT ?, id FROM groups WHERE name = 'Direction'`, finance, director)
+	require.NoError(t, err)
+	_, err = h.db.Exec("UPDATE users SET manager_id = ? WHERE id = ?", manager, employee)
+	require.NoError(t, err)
+	return approvalChain{
+		employee:   issueAPIToken(t, h.db, fmt.Sprint(employee)),
+		manager:    issueAPIToken(t, h.db, fmt.Sprint(manager)),
+		finance:    issueAPIToken(t, h.db, fmt.Sprint(finance)),
+		director:   issueAPIToken(t, h.db, fmt.Sprint(director)),
+		managerID:  manager,
+		financeID:  finance,
+		directorID: director,
+	}
+}
+
+// decide approves or rejects a report; rejections give a reason.
+func decide(r *gin.Engine, key string, reportID int64, action string) (int, map[string]interface{}) {
+	body := ""
+	if action == "reject" {
+		body = `{"reason":"Missing receipt"}`
+	}
+	w := doAs(r, http.MethodPost, fmt.Sprintf("/api/admin/reports/%d/%s", reportID, action), body, key)
+	var out map[string]interface{}
+	_ = json.Unmarshal(w.Body.Bytes(), &out)
+	return w.Code, out
+}
+
+func approvalSteps(t *testing.T, r *gin.Engine, key string, reportID int64) []ApprovalStep {
+	w := doAs(r, http.MethodGet, fmt.Sprintf("/api/reports/%d/steps", reportID), "", key)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var steps []ApprovalStep
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &steps))
+	return steps
+}
+
+func TestApprovalChainFollowsAmountRules(t *testing.T) {
+	r, h := newReportRouter(t)
+	chain := newApprovalChain(t, h)
+
+	small := createDraftReport(t, r, chain.employee, 100)
+	assert.Equal(t, []interface{}{"manager"}, submitReport(t, r, chain.employee, small)["steps"])
+	medium := createDraftReport(t, r, chain.employee, 1000)
+	assert.Equal(t, []interface{}{"manager", "finance"}, submitReport(t, r, chain.employee, medium)["steps"])
+	large := createDraftReport(t, r, chain.employee, 10000)
+	assert.Equal(t, []interface{}{"manager", "finance", "director"}, submitReport(t, r, chain.employee, large)["steps"])
+
+	code, out := decide(r, chain.manager, small, "approve")
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "approved", out["status"])
+
+	// Steps are decided in order, each by its own approvers
+	code, _ = decide(r, chain.finance, medium, "approve")
+	assert.Equal(t, http.StatusForbidden, code)
+	code, out = decide(r, chain.manager, medium, "approve")
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "submitted", out["status"])
+	assert.Equal(t, "finance", out["next_step"])
+	code, _ = decide(r, chain.director, medium, "approve")
+	assert.Equal(t, http.StatusForbidden, code)
+	w := doAs(r, http.MethodGet, "/api/approvals", "", chain.finance)
+	assert.Contains(t, w.Body.String(), `"step":"finance"`)
+	code, out = decide(r, chain.finance, medium, "approve")
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "approved", out["status"])
+	steps := approvalSteps(t, r, chain.employee, medium)
+	require.Len(t, steps, 2)
+	for _, s := range steps {
+		assert.Equal(t, StepApproved, s.Status)
+	}
+	assert.Equal(t, chain.financeID, *steps[1].DecidedBy)
+
+	// A rejection at any step rejects the report
+	code, _ = decide(r, chain.manager, large, "approve")
+	require.Equal(t, http.StatusOK, code)
+	code, out = decide(r, chain.finance, large, "reject")
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "rejected", out["status"])
+	steps = approvalSteps(t, r, chain.finance, large)
+	assert.Equal(t, []string{StepApproved, StepRejected, StepPending}, []string{steps[0].Status, steps[1].Status, steps[2].Status})
+	code, _ = decide(r, chain.director, large, "approve")
+	assert.Equal(t, http.StatusBadRequest, code)
+}
+
+func TestSegregationOfDuties(t *testing.T) {
+	r, h := newReportRouter(t)
+	chain := newApprovalChain(t, h)
+	adminKey := issueAPIToken(t, h.db, "1")
+
+	// Global reviewers cannot decide their own reports either
+	own := createDraftReport(t, r, adminKey, 50)
+	submitReport(t, r, adminKey, own)
+	code, out := decide(r, adminKey, own, "approve")
+	assert.Equal(t, http.StatusForbidden, code)
+	assert.Equal(t, AuditSelfApproval, out["code"])
+	code, out = decide(r, adminKey, own, "reject")
+	assert.Equal(t, http.StatusForbidden, code)
+	assert.Equal(t, AuditSelfRejection, out["code"])
+
+	// The manager also belongs to Finance but cannot approve both steps
+	_, err := h.db.Exec("INSERT INTO user_groups (user_id, group_id) SELECT ?, id FROM groups WHERE name = 'Finance'", chain.managerID)
+	require.NoError(t, err)
+	medium := createDraftReport(t, r, chain.employee, 1000)
+	submitReport(t, r, chain.employee, medium)
+	code, _ = decide(r, chain.manager, medium, "approve")
+	require.Equal(t, http.StatusOK, code)
+	code, out = decide(r, chain.manager, medium, "approve")
+	assert.Equal(t, http.StatusForbidden, code)
+	assert.Equal(t, AuditRepeatedApprover, out["code"])
+	code, out = decide(r, chain.finance, medium, "approve")
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "approved", out["status"])
+
+	w := doAs(r, http.MethodGet, fmt.Sprintf("/api/admin/audit/approvals?report_id=%d", medium), "", adminKey)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var entries []ApprovalAuditEntry
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &entries))
+	outcomes := []string{}
+	for _, e := range entries {
+		outcomes = append(outcomes, e.Step+":"+e.Outcome)
+	}
+	assert.Equal(t, []string{"finance:approved", "finance:" + AuditRepeatedApprover, "manager:approved"}, outcomes)
+	assert.Equal(t, http.StatusForbidden, doAs(r, http.MethodGet, "/api/admin/audit/approvals", "", chain.manager).Code)
+}
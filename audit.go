@@ -0,0 +1,86 @@
+package main
+
+import (
+    "fmt"
+    "net/http"
+    "os"
+    "strconv"
+    "time"
+
+    "github.com/gin-gonic/gin"
+)
+
+// Error codes of refused approval decisions, returned to the client and recorded in the
+// approval audit trail. Accepted decisions are recorded with the step status they set.
+const (
+    AuditOutOfScope        = "out_of_scope"
+    AuditSelfApproval      = "self_approval"
+    AuditSelfRejection     = "self_rejection"
+    AuditPreparerApproval  = "preparer_approval"
+    AuditPreparerRejection = "preparer_rejection"
+    AuditRepeatedApprover  = "repeated_approver"
+    AuditApprovalLimit     = "approval_limit"
+)
+
+// distinctApprovers requires a different approver for each step of a report's approval
+// chain. APPROVAL_DISTINCT_APPROVERS=false lets one person approve several steps.
+var distinctApprovers = os.Getenv("APPROVAL_DISTINCT_APPROVERS") != "false"
+
+// recordApprovalAudit appends a decision attempt on a report step to the audit trail,
+// with the validator a delegate acted on behalf of, if any.
+func recordApprovalAudit(q execer, reportID int64, step string, actorID int64, onBehalfOf *int64, approve bool, outcome string) error {
+    action := "reject"
+    if approve {
+        action = "approve"
+    }
+    _, err := q.Exec("INSERT INTO approval_audit (report_id, step, actor_id, on_behalf_of, action, outcome, created_at) VALUES (?, ?, ?, ?, ?, ?, ?)",
+        reportID, step, actorID, onBehalfOf, action, outcome, time.Now().UTC())
+    if err != nil {
+        return fmt.Errorf("record approval audit: %w", err)
+    }
+    return nil
+}
+
+// ApprovalAuditEntry is a decision attempt recorded in the approval audit trail.
+type ApprovalAuditEntry struct {
+    ID         int64     `json:"id"`
+    ReportID   int64     `json:"report_id"`
+    Step       string    `json:"step"`
+    ActorID    *int64    `json:"actor_id"`
+    OnBehalfOf *int64    `json:"on_behalf_of,omitempty"`
+    Action     string    `json:"action"`
+    Outcome    string    `json:"outcome"`
+    CreatedAt  time.Time `json:"created_at"`
+}
+
+// ListApprovalAudit returns the approval audit trail, newest first, optionally restricted
+// to one report with ?report_id=.
+func (h *Handlers) ListApprovalAudit(c *gin.Context) {
+    query := "SELECT id, report_id, step, actor_id, on_behalf_of, action, outcome, created_at FROM approval_audit"
+    var args []interface{}
+    if v := c.Query("report_id"); v != "" {
+        reportID, err := strconv.ParseInt(v, 10, 64)
+        if err != nil {
+            c.JSON(http.StatusBadRequest, gin.H{"error": "invalid report id"})
+            return
+        }
+        query += " WHERE report_id = ?"
+        args = append(args, reportID)
+    }
+    rows, err := h.db.Query(query+" ORDER BY id DESC", args...)
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
+        return
+    }
+    defer rows.Close()
+    entries := []ApprovalAuditEntry{}
+    for rows.Next() {
+        var e ApprovalAuditEntry
+        if err := rows.Scan(&e.ID, &e.ReportID, &e.Step, &e.ActorID, &e.OnBehalfOf, &e.Action, &e.Outcome, &e.CreatedAt); err != nil {
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
+            return
+        }
+        entries = append(entries, e)
+    }
+    c.JSON(http.StatusOK, entries)
+}
@@ -1,22 +1,18 @@
 package main
 
 import (
+    "crypto/rand"
+    "crypto/sha256"
+    "encoding/hex"
+    "log"
     "os"
+    "strconv"
     "time"
 
     "github.com/golang-jwt/jwt/v5"
     "golang.org/x/crypto/bcrypt"
 )
 
-// jwtSecret is the secret key used to sign JWTs. It is initialized from the JWT_SECRET
-// environment variable or defaults to "secret" when unset.
-var jwtSecret = func() string {
-    if v := os.Getenv("JWT_SECRET"); v != "" {
-        return v
-    }
-    return "secret"
-}()
-
 // hashPassword returns a bcrypt hashed representation of the plain password.
 func hashPassword(password string) (string, error) {
     b, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
@@ -26,18 +22,95 @@ func hashPassword(password string) (string, error) {
     return string(b), nil
 }
 
+// dummyPasswordHash is compared against when a login does not match a local account, so
+// that unknown emails take as long to reject as wrong passwords.
+var dummyPasswordHash, _ = hashPassword("timing-equalisation-only")
+
 // checkPassword compares a bcrypt hashed password with its possible plaintext equivalent.
 // Returns nil if they match or an error otherwise.
 func checkPassword(hash string, password string) error {
     return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
 }
 
-// generateJWT creates a signed JSON Web Token for a given user ID with a standard expiry of 24 hours.
-func generateJWT(userID int64) (string, error) {
+// accessTokenTTL is the lifetime of JWT access tokens. It is read from ACCESS_TOKEN_TTL
+// (a Go duration such as "15m") and defaults to 15 minutes.
+var accessTokenTTL = durationFromEnv("ACCESS_TOKEN_TTL", 15*time.Minute)
+
+// refreshTokenTTL is the lifetime of a session and its refresh tokens. It is read from
+// REFRESH_TOKEN_TTL and defaults to 30 days.
+var refreshTokenTTL = durationFromEnv("REFRESH_TOKEN_TTL", 30*24*time.Hour)
+
+// durationFromEnv parses a duration from an environment variable, falling back to def
+// when the variable is unset or invalid.
+func durationFromEnv(name string, def time.Duration) time.Duration {
+    v := os.Getenv(name)
+    if v == "" {
+        return def
+    }
+    d, err := time.ParseDuration(v)
+    if err != nil || d <= 0 {
+        log.Printf("[WARN] invalid %s %q, using %s", name, v, def)
+        return def
+    }
+    return d
+}
+
+// intFromEnv reads a positive integer from an environment variable, falling back to def
+// when it is unset or invalid.
+func intFromEnv(name string, def int) int {
+    v := os.Getenv(name)
+    if v == "" {
+        return def
+    }
+    n, err := strconv.Atoi(v)
+    if err != nil || n <= 0 {
+        log.Printf("[WARN] invalid %s %q, using %d", name, v, def)
+        return def
+    }
+    return n
+}
+
+// randomToken returns 32 random bytes encoded in hex. It is used for API and refresh tokens.
+func randomToken() (string, error) {
+    b := make([]byte, 32)
+    if _, err := rand.Read(b); err != nil {
+        return "", err
+    }
+    return hex.EncodeToString(b), nil
+}
+
+// generateJWT creates an access token for a user session, signed with the current key of
+// the key ring. The token carries the session ID in the "sid" claim so that it stops being
+// accepted once the session is revoked.
+func generateJWT(userID, sessionID int64) (string, error) {
+    jti, err := randomToken()
+    if err != nil {
+        return "", err
+    }
+    now := time.Now()
     claims := jwt.MapClaims{
         "sub": userID,
-        "exp": time.Now().Add(24 * time.Hour).Unix(),
+        "sid": sessionID,
+        "jti": jti,
+        "iat": now.Unix(),
+        "exp": now.Add(accessTokenTTL).Unix(),
+    }
+    return jwtKeys.Sign(claims)
+}
+
+// hashAPIToken returns the SHA-256 hex digest of a static API token. Tokens are random
+// 256-bit values, so a fast hash is sufficient and allows direct lookup by digest. The
+// same digest is used for refresh tokens.
+func hashAPIToken(token string) string {
+    sum := sha256.Sum256([]byte(token))
+    return hex.EncodeToString(sum[:])
+}
+
+// apiTokenPrefix returns the leading characters of an API token kept in clear so that
+// a token can be identified in listings without revealing it.
+func apiTokenPrefix(token string) string {
+    if len(token) <= 8 {
+        return token
     }
-    token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-    return token.SignedString([]byte(jwtSecret))
+    return token[:8]
 }
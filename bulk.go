@@ -0,0 +1,130 @@
+package main
+
+import (
+    "errors"
+    "net/http"
+    "strings"
+
+    "github.com/gin-gonic/gin"
+)
+
+// maxBulkDecisions caps the number of reports decided by a bulk request.
+const maxBulkDecisions = 500
+
+// Results of a report in a bulk decision.
+const (
+    BulkApproved  = "approved"
+    BulkRejected  = "rejected"
+    BulkSkipped   = "skipped"
+    BulkForbidden = "forbidden"
+)
+
+// BulkDecisionRequest is the payload to approve or reject several reports with a shared
+// comment, required to reject.
+type BulkDecisionRequest struct {
+    ReportIDs []int64 `json:"report_ids"`
+    Comment   string  `json:"comment"`
+}
+
+// BulkDecisionResult is the outcome of a bulk decision for one report. Skipped reports
+// were not submitted or changed meanwhile; forbidden ones were refused, with the code of
+// the refusal.
+type BulkDecisionResult struct {
+    ID         int64        `json:"id"`
+    Result     string       `json:"result"`
+    Step       string       `json:"step,omitempty"`
+    Status     ReportStatus `json:"status,omitempty"`
+    NextStep   string       `json:"next_step,omitempty"`
+    OnBehalfOf *int64       `json:"on_behalf_of,omitempty"`
+    Error      string       `json:"error,omitempty"`
+    Code       string       `json:"code,omitempty"`
+}
+
+// BulkApproveReports approves the current step of several reports, as ApproveReport does
+// for one.
+func (h *Handlers) BulkApproveReports(c *gin.Context) {
+    h.decideReports(c, true)
+}
+
+// BulkRejectReports rejects several reports with a shared reason, as RejectReport does for
+// one.
+func (h *Handlers) BulkRejectReports(c *gin.Context) {
+    h.decideReports(c, false)
+}
+
+// decideReports decides the reports of a BulkDecisionRequest in a single transaction and
+// returns a result per report. A report that cannot be decided is skipped or forbidden
+// without affecting the others; each decision is isolated in a savepoint.
+func (h *Handlers) decideReports(c *gin.Context, approve bool) {
+    var req BulkDecisionRequest
+    if err := c.ShouldBindJSON(&req); err != nil || len(req.ReportIDs) == 0 {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "report_ids is required"})
+        return
+    }
+    if len(req.ReportIDs) > maxBulkDecisions {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "too many reports", "max": maxBulkDecisions})
+        return
+    }
+    comment := strings.TrimSpace(req.Comment)
+    if !approve && comment == "" {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "a rejection reason is required", "code": "reason_required"})
+        return
+    }
+    scope, err := reviewScopeFor(c, h.db)
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "permission check failed"})
+        return
+    }
+    tx, err := h.db.Begin()
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
+        return
+    }
+    defer tx.Rollback()
+    results := []BulkDecisionResult{}
+    seen := map[int64]bool{}
+    for _, id := range req.ReportIDs {
+        if seen[id] {
+            continue
+        }
+        seen[id] = true
+        if _, err := tx.Exec("SAVEPOINT bulk_decision"); err != nil {
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
+            return
+        }
+        result := BulkDecisionResult{ID: id}
+        d, err := decideStep(tx, scope, id, approve, comment)
+        switch {
+        case err == nil && d.Refusal != "":
+            result.Result, result.Step = BulkForbidden, d.Step
+            result.Error, result.Code = refusalMessages[d.Refusal], d.Refusal
+        case err == nil:
+            result.Result, result.Step, result.Status, result.NextStep = BulkApproved, d.Step, d.Status, d.NextStep
+            result.OnBehalfOf = d.OnBehalfOf
+            if !approve {
+                result.Result = BulkRejected
+            }
+        case errors.Is(err, errReportNotFound), errors.Is(err, errNotSubmitted), errors.Is(err, errStepDecided),
+            errors.Is(err, ErrInvalidTransition), errors.Is(err, ErrStatusChanged):
+            // Undo the partial decision, the other reports are still decided
+            if _, err := tx.Exec("ROLLBACK TO bulk_decision"); err != nil {
+                c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
+                return
+            }
+            result.Result, result.Error = BulkSkipped, err.Error()
+        default:
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
+            return
+        }
+        if _, err := tx.Exec("RELEASE bulk_decision"); err != nil {
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
+            return
+        }
+        results = append(results, result)
+    }
+    if err := tx.Commit(); err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
+        return
+    }
+    c.JSON(http.StatusOK, gin.H{"results": results})
+}
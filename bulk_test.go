@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBulkDecisions(t *testing.T) {
+	r, h := newReportRouter(t)
+	chain := newApprovalChain(t, h)
+	first, _ := submitNewReport(t, r, chain.employee)
+	second, _ := submitNewReport(t, r, chain.employee)
+	draft := createDraftReport(t, r, chain.employee, 100)
+	own, _ := submitNewReport(t, r, chain.manager)
+
+	bulk := func(action, body string) (int, []BulkDecisionResult) {
+		w := doAs(r, http.MethodPost, "/api/admin/reports/bulk-"+action, body, chain.manager)
+		var out struct {
+			Results []BulkDecisionResult `json:"results"`
+		}
+		_ = json.Unmarshal(w.Body.Bytes(), &out)
+		return w.Code, out.Results
+	}
+
+	code, results := bulk("approve", fmt.Sprintf(`{"report_ids":[%d,%d,%d,9999,%d],"comment":"Month end"}`, first, draft, own, first))
+	require.Equal(t, http.StatusOK, code)
+	require.Len(t, results, 4)
+	assert.Equal(t, BulkApproved, results[0].Result)
+	assert.Equal(t, StatusApproved, results[0].Status)
+	assert.Equal(t, BulkSkipped, results[1].Result)
+	assert.Equal(t, BulkForbidden, results[2].Result)
+	assert.Equal(t, AuditSelfApproval, results[2].Code)
+	assert.Equal(t, BulkSkipped, results[3].Result)
+	steps := approvalSteps(t, r, chain.employee, first)
+	require.NotNil(t, steps[0].Comment)
+	assert.Equal(t, "Month end", *steps[0].Comment)
+
+	code, _ = bulk("reject", fmt.Sprintf(`{"report_ids":[%d]}`, second))
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, results = bulk("reject", fmt.Sprintf(`{"report_ids":[%d,%d],"comment":"Duplicate"}`, second, first))
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, BulkRejected, results[0].Result)
+	assert.Equal(t, StatusRejected, results[0].Status)
+	assert.Equal(t, BulkSkipped, results[1].Result)
+
+	w := doAs(r, http.MethodGet, fmt.Sprintf("/api/reports/%d/comments", second), "", chain.employee)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Contains(t, w.Body.String(), "Duplicate")
+	var outcome string
+	require.NoError(t, h.db.QueryRow("SELECT outcome FROM approval_audit WHERE report_id = ?", own).Scan(&outcome))
+	assert.Equal(t, AuditSelfApproval, outcome)
+}
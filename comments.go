@@ -0,0 +1,100 @@
+package main
+
+import (
+    "fmt"
+    "net/http"
+    "strconv"
+    "strings"
+    "time"
+
+    "github.com/gin-gonic/gin"
+)
+
+// ReportComment is a message of the thread of a report between its submitter and the
+// reviewers.
+type ReportComment struct {
+    ID          int64     `json:"id"`
+    ReportID    int64     `json:"report_id"`
+    AuthorID    *int64    `json:"author_id"`
+    AuthorEmail *string   `json:"author_email,omitempty"`
+    Body        string    `json:"body"`
+    CreatedAt   time.Time `json:"created_at"`
+}
+
+// insertReportComment appends a comment to the thread of a report and returns its ID.
+func insertReportComment(q execer, reportID, authorID int64, body string) (int64, error) {
+    res, err := q.Exec("INSERT INTO report_comments (report_id, author_id, body, created_at) VALUES (?, ?, ?, ?)",
+        reportID, authorID, body, time.Now().UTC())
+    if err != nil {
+        return 0, fmt.Errorf("insert report comment: %w", err)
+    }
+    return res.LastInsertId()
+}
+
+// ListReportComments returns the comment thread of a report, oldest first. It is visible to
+// the owner and to the reviewers who can see the report.
+func (h *Handlers) ListReportComments(c *gin.Context) {
+    reportID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+    if err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "invalid report id"})
+        return
+    }
+    if !h.authorizeReportRead(c, reportID) {
+        return
+    }
+    rows, err := h.db.Query(`SELECT rc.id, rc.report_id, rc.author_id, u.email, rc.body, rc.created_at
+        FROM report_comments rc
+        LEFT JOIN users u ON u.id = rc.author_id
+        WHERE rc.report_id = ? ORDER BY rc.id`, reportID)
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
+        return
+    }
+    defer rows.Close()
+    comments := []ReportComment{}
+    for rows.Next() {
+        var rc ReportComment
+        if err := rows.Scan(&rc.ID, &rc.ReportID, &rc.AuthorID, &rc.AuthorEmail, &rc.Body, &rc.CreatedAt); err != nil {
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
+            return
+        }
+        comments = append(comments, rc)
+    }
+    c.JSON(http.StatusOK, comments)
+}
+
+// AddReportCommentRequest is the payload to comment on a report.
+type AddReportCommentRequest struct {
+    Body string `json:"body"`
+}
+
+// AddReportComment posts a comment to the thread of a report. The owner and the reviewers
+// who can see the report may comment, whatever its status.
+func (h *Handlers) AddReportComment(c *gin.Context) {
+    reportID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+    if err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "invalid report id"})
+        return
+    }
+    var req AddReportCommentRequest
+    if err := c.ShouldBindJSON(&req); err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "invalid JSON"})
+        return
+    }
+    body := strings.TrimSpace(req.Body)
+    if body == "" {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "body is required"})
+        return
+    }
+    if !h.authorizeReportRead(c, reportID) {
+        return
+    }
+    userIDIfc, _ := c.Get(ContextUserIDKey)
+    userID := userIDIfc.(int64)
+    id, err := insertReportComment(h.db, reportID, userID, body)
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to add comment"})
+        return
+    }
+    c.JSON(http.StatusCreated, ReportComment{ID: id, ReportID: reportID, AuthorID: &userID, Body: body, CreatedAt: time.Now().UTC()})
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRejectionReasonThreadAndReopen(t *testing.T) {
+	r, h := newReportRouter(t)
+	chain := newApprovalChain(t, h)
+	reportID := createDraftReport(t, r, chain.employee, 100)
+	submitReport(t, r, chain.employee, reportID)
+	rejectURL := fmt.Sprintf("/api/admin/reports/%d/reject", reportID)
+	commentsURL := fmt.Sprintf("/api/reports/%d/comments", reportID)
+
+	w := doAs(r, http.MethodPost, rejectURL, `{"reason":"  "}`, chain.manager)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "reason_required")
+	w = doAs(r, http.MethodPost, rejectURL, `{"reason":"Hotel invoice missing"}`, chain.manager)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	steps := approvalSteps(t, r, chain.employee, reportID)
+	require.NotNil(t, steps[0].Comment)
+	assert.Equal(t, "Hotel invoice missing", *steps[0].Comment)
+
+	// The reason opens the thread, which the submitter and the manager share
+	w = doAs(r, http.MethodPost, commentsURL, `{"body":"Added it, sorry"}`, chain.employee)
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	w = doAs(r, http.MethodGet, commentsURL, "", chain.manager)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var comments []ReportComment
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &comments))
+	require.Len(t, comments, 2)
+	assert.Equal(t, "Hotel invoice missing", comments[0].Body)
+	assert.Equal(t, chain.managerID, *comments[0].AuthorID)
+	assert.Equal(t, "emp@example.com", *comments[1].AuthorEmail)
+	assert.Equal(t, http.StatusForbidden, doAs(r, http.MethodGet, commentsURL, "", chain.finance).Code)
+
+	// Only the owner reopens, and only rejected reports
+	reopenURL := fmt.Sprintf("/api/reports/%d/reopen", reportID)
+	assert.Equal(t, http.StatusForbidden, doAs(r, http.MethodPost, reopenURL, "", chain.manager).Code)
+	w = doAs(r, http.MethodPost, reopenURL, "", chain.employee)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Contains(t, w.Body.String(), `"status":"draft"`)
+	assert.Equal(t, http.StatusBadRequest, doAs(r, http.MethodPost, reopenURL, "", chain.employee).Code)
+	assert.Equal(t, []interface{}{"manager"}, submitReport(t, r, chain.employee, reportID)["steps"])
+	steps = approvalSteps(t, r, chain.employee, reportID)
+	assert.Equal(t, StepPending, steps[0].Status)
+	code, out := decide(r, chain.manager, reportID, "approve")
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "approved", out["status"])
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+    "database/sql"
+    "errors"
+    "fmt"
+    "net/http"
+    "strconv"
+    "time"
+
+    "github.com/gin-gonic/gin"
+)
+
+// ApprovalDelegation hands the approval rights of a validator over to a delegate from
+// StartsOn to EndsOn included (YYYY-MM-DD, UTC), typically to cover a holiday. It expires
+// on its own after EndsOn.
+type ApprovalDelegation struct {
+    ID             int64     `json:"id"`
+    DelegatorID    int64     `json:"delegator_id"`
+    DelegatorEmail string    `json:"delegator_email"`
+    DelegateID     int64     `json:"delegate_id"`
+    DelegateEmail  string    `json:"delegate_email"`
+    StartsOn       string    `json:"starts_on"`
+    EndsOn         string    `json:"ends_on"`
+    Active         bool      `json:"active"`
+    CreatedAt      time.Time `json:"created_at"`
+}
+
+// activeDelegation restricts the approval delegations d to those in force today.
+const activeDelegation = "date('now') BETWEEN d.starts_on AND d.ends_on"
+
+// actingAs selects the users a reviewer decides for: themselves and the validators whose
+// approval rights are delegated to them today. It takes the reviewer ID twice.
+const actingAs = "SELECT ? UNION SELECT d.delegator_id FROM approval_delegations d WHERE d.delegate_id = ? AND " + activeDelegation
+
+// delegatedScopes returns the review scopes of the validators whose approval rights are
+// delegated to userID today. Delegators who lost reports:approve delegate nothing.
+func delegatedScopes(db *sql.DB, userID int64) ([]reviewScope, error) {
+    rows, err := db.Query("SELECT d.delegator_id FROM approval_delegations d WHERE d.delegate_id = ? AND "+activeDelegation+" ORDER BY d.id", userID)
+    if err != nil {
+        return nil, fmt.Errorf("select delegations: %w", err)
+    }
+    var delegators []int64
+    for rows.Next() {
+        var id int64
+        if err := rows.Scan(&id); err != nil {
+            rows.Close()
+            return nil, fmt.Errorf("select delegations: %w", err)
+        }
+        delegators = append(delegators, id)
+    }
+    rows.Close()
+    if err := rows.Err(); err != nil {
+        return nil, fmt.Errorf("select delegations: %w", err)
+    }
+    var scopes []reviewScope
+    for _, id := range delegators {
+        perms, err := cachedUserPermissions(db, id)
+        if err != nil {
+            return nil, err
+        }
+        if !perms[PermReportsApprove] {
+            continue
+        }
+        scopes = append(scopes, reviewScope{
+            all:         perms[PermReportsReadAll],
+            scoped:      !perms[PermReportsReadAll] && perms[PermReportsReadScoped],
+            approveHigh: perms[PermReportsApproveHigh],
+            reviewerID:  id,
+        })
+    }
+    return scopes, nil
+}
+
+// ListDelegations returns the approval delegations the current user gave or received,
+// newest first.
+func (h *Handlers) ListDelegations(c *gin.Context) {
+    userIDIfc, _ := c.Get(ContextUserIDKey)
+    userID := userIDIfc.(int64)
+    rows, err := h.db.Query(`SELECT d.id, d.delegator_id, dr.email, d.delegate_id, de.email, d.starts_on, d.ends_on, `+activeDelegation+`, d.created_at
+        FROM approval_delegations d
+        JOIN users dr ON dr.id = d.delegator_id
+        JOIN users de ON de.id = d.delegate_id
+        WHERE d.delegator_id = ? OR d.delegate_id = ?
+        ORDER BY d.id DESC`, userID, userID)
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
+        return
+    }
+    defer rows.Close()
+    delegations := []ApprovalDelegation{}
+    for rows.Next() {
+        var d ApprovalDelegation
+        if err := rows.Scan(&d.ID, &d.DelegatorID, &d.DelegatorEmail, &d.DelegateID, &d.DelegateEmail, &d.StartsOn, &d.EndsOn, &d.Active, &d.CreatedAt); err != nil {
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
+            return
+        }
+        delegations = append(delegations, d)
+    }
+    c.JSON(http.StatusOK, delegations)
+}
+
+// CreateDelegationRequest is the payload to delegate the current user's approval rights.
+type CreateDelegationRequest struct {
+    DelegateID int64  `json:"delegate_id"`
+    StartsOn   string `json:"starts_on"`
+    EndsOn     string `json:"ends_on"`
+}
+
+// CreateDelegation delegates the approval rights of the current user to another active
+// user holding reports:approve, for a date range that has not ended yet.
+func (h *Handlers) CreateDelegation(c *gin.Context) {
+    var req CreateDelegationRequest
+    if err := c.ShouldBindJSON(&req); err != nil || req.DelegateID == 0 {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "delegate_id is required"})
+        return
+    }
+    startsOn, err := time.Parse("2006-01-02", req.StartsOn)
+    if err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "starts_on must be a YYYY-MM-DD date"})
+        return
+    }
+    endsOn, err := time.Parse("2006-01-02", req.EndsOn)
+    if err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "ends_on must be a YYYY-MM-DD date"})
+        return
+    }
+    if endsOn.Before(startsOn) {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "ends_on must not be before starts_on"})
+        return
+    }
+    if req.EndsOn < time.Now().UTC().Format("2006-01-02") {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "ends_on is in the past"})
+        return
+    }
+    userIDIfc, _ := c.Get(ContextUserIDKey)
+    userID := userIDIfc.(int64)
+    if req.DelegateID == userID {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "you cannot delegate to yourself"})
+        return
+    }
+    var disabledAt *time.Time
+    err = h.db.QueryRow("SELECT disabled_at FROM users WHERE id = ?", req.DelegateID).Scan(&disabledAt)
+    if errors.Is(err, sql.ErrNoRows) {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "delegate not found"})
+        return
+    } else if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
+        return
+    }
+    if disabledAt != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "delegate account is deactivated"})
+        return
+    }
+    canApprove, err := UserHasPermission(h.db, req.DelegateID, PermReportsApprove)
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "permission check failed"})
+        return
+    }
+    if !canApprove {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "delegate cannot approve reports"})
+        return
+    }
+    res, err := h.db.Exec("INSERT INTO approval_delegations (delegator_id, delegate_id, starts_on, ends_on, created_at) VALUES (?, ?, ?, ?, ?)",
+        userID, req.DelegateID, req.StartsOn, req.EndsOn, time.Now().UTC())
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create delegation"})
+        return
+    }
+    id, _ := res.LastInsertId()
+    c.JSON(http.StatusCreated, gin.H{"id": id, "delegate_id": req.DelegateID, "starts_on": req.StartsOn, "ends_on": req.EndsOn})
+}
+
+// DeleteDelegation ends an approval delegation given by the current user.
+func (h *Handlers) DeleteDelegation(c *gin.Context) {
+    id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+    if err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "invalid delegation id"})
+        return
+    }
+    userIDIfc, _ := c.Get(ContextUserIDKey)
+    userID := userIDIfc.(int64)
+    res, err := h.db.Exec("DELETE FROM approval_delegations WHERE id = ? AND delegator_id = ?", id, userID)
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
+        return
+    }
+    if n, _ := res.RowsAffected(); n == 0 {
+        c.JSON(http.StatusNotFound, gin.H{"error": "delegation not found"})
+        return
+    }
+    c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestApprovalDelegation(t *testing.T) {
+	r, h := newReportRouter(t)
+	chain := newApprovalChain(t, h)
+	deputyID := createValidator(t, h, "deputy@example.com")
+	deputy := issueAPIToken(t, h.db, fmt.Sprint(deputyID))
+	covered, _ := submitNewReport(t, r, chain.employee)
+	code, out := decide(r, deputy, covered, "approve")
+	require.Equal(t, http.StatusForbidden, code)
+	assert.Equal(t, AuditOutOfScope, out["code"])
+
+	today := time.Now().UTC()
+	delegate := func(delegateID int64, from, to time.Time) int {
+		body := fmt.Sprintf(`{"delegate_id":%d,"starts_on":%q,"ends_on":%q}`, delegateID, from.Format("2006-01-02"), to.Format("2006-01-02"))
+		return doAs(r, http.MethodPost, "/api/delegations", body, chain.manager).Code
+	}
+	assert.Equal(t, http.StatusBadRequest, delegate(deputyID, today.AddDate(0, 0, -7), today.AddDate(0, 0, -1)))
+	assert.Equal(t, http.StatusBadRequest, delegate(createTestUser(t, h, "plain@example.com"), today, today.AddDate(0, 0, 7)))
+	require.Equal(t, http.StatusCreated, delegate(deputyID, today.AddDate(0, 0, -1), today.AddDate(0, 0, 7)))
+
+	w := doAs(r, http.MethodGet, "/api/approvals", "", deputy)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Contains(t, w.Body.String(), fmt.Sprintf(`"id":%d`, covered))
+	code, out = decide(r, deputy, covered, "approve")
+	require.Equal(t, http.StatusOK, code, out)
+	assert.Equal(t, float64(chain.managerID), out["on_behalf_of"])
+	steps := approvalSteps(t, r, chain.employee, covered)
+	require.NotNil(t, steps[0].DecidedBy)
+	require.NotNil(t, steps[0].OnBehalfOf)
+	assert.Equal(t, deputyID, *steps[0].DecidedBy)
+	assert.Equal(t, chain.managerID, *steps[0].OnBehalfOf)
+	var onBehalfOf int64
+	require.NoError(t, h.db.QueryRow("SELECT on_behalf_of FROM approval_audit WHERE report_id = ? AND outcome = ?", covered, StepApproved).Scan(&onBehalfOf))
+	assert.Equal(t, chain.managerID, onBehalfOf)
+
+	// Delegations expire on their own
+	_, err := h.db.Exec("UPDATE approval_delegations SET ends_on = date('now', '-1 day')")
+	require.NoError(t, err)
+	expired, _ := submitNewReport(t, r, chain.employee)
+	code, _ = decide(r, deputy, expired, "approve")
+	assert.Equal(t, http.StatusForbidden, code)
+	w = doAs(r, http.MethodGet, "/api/delegations", "", deputy)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var delegations []ApprovalDelegation
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &delegations))
+	require.Len(t, delegations, 1)
+	assert.Equal(t, chain.managerID, delegations[0].DelegatorID)
+	assert.False(t, delegations[0].Active)
+}
+
+func TestDelegatedHighValueApproval(t *testing.T) {
+	r, h := newReportRouter(t)
+	chain := newApprovalChain(t, h)
+	// The delegator approves high value reports, the deputy of the same Finance group does not
+	deputyID := createTestUser(t, h, "deputy@example.com")
+	deputy := issueAPIToken(t, h.db, fmt.Sprint(deputyID))
+	_, err := h.db.Exec("INSERT INTO user_groups (user_id, group_id) SELECT ?, id FROM groups WHERE name = 'Finance'", deputyID)
+	require.NoError(t, err)
+	res, err := h.db.Exec("INSERT INTO groups (name) VALUES ('Finance leads')")
+	require.NoError(t, err)
+	leadsID, _ := res.LastInsertId()
+	_, err = h.db.Exec("INSERT INTO group_permissions (group_id, permission_id) SELECT ?, id FROM permissions WHERE action = ?", leadsID, PermReportsApproveHigh)
+	require.NoError(t, err)
+	_, err = h.db.Exec("INSERT INTO user_groups (user_id, group_id) VALUES (?, ?)", chain.financeID, leadsID)
+	require.NoError(t, err)
+	invalidateAllPermissions(h.db)
+
+	large := createDraftReport(t, r, chain.employee, 1000)
+	submitReport(t, r, chain.employee, large)
+	code, out := decide(r, chain.manager, large, "approve")
+	require.Equal(t, http.StatusOK, code, out)
+	require.Equal(t, "finance", out["next_step"])
+	saved := highValueAbove
+	highValueAbove = 1000
+	t.Cleanup(func() { highValueAbove = saved })
+	code, out = decide(r, deputy, large, "approve")
+	require.Equal(t, http.StatusForbidden, code)
+	assert.Equal(t, AuditApprovalLimit, out["code"])
+
+	today := time.Now().UTC().Format("2006-01-02")
+	body := fmt.Sprintf(`{"delegate_id":%d,"starts_on":%q,"ends_on":%q}`, deputyID, today, today)
+	w := doAs(r, http.MethodPost, "/api/delegations", body, chain.finance)
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	code, out = decide(r, deputy, large, "approve")
+	require.Equal(t, http.StatusOK, code, out)
+	assert.Equal(t, "approved", out["status"])
+	assert.Equal(t, float64(chain.financeID), out["on_behalf_of"])
+}
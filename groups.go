@@ -0,0 +1,249 @@
+package main
+
+import (
+    "database/sql"
+    "errors"
+    "fmt"
+    "net/http"
+    "strconv"
+    "strings"
+
+    "github.com/gin-gonic/gin"
+)
+
+// ErrLastPermissionsAdmin is returned when a change would leave no active user holding
+// permissions:assign, after which nobody could administer permissions anymore.
+var ErrLastPermissionsAdmin = errors.New("change would leave no active user with permissions:assign")
+
+// checkPermissionsAdminRemains fails with ErrLastPermissionsAdmin when no active user
+// holds permissions:assign. It is called inside the transaction of a change, after the
+// change, so that the transaction can be rolled back.
+func checkPermissionsAdminRemains(tx *sql.Tx) error {
+    var holders int
+    err := tx.QueryRow(`SELECT COUNT(DISTINCT u.id) FROM users u
+        JOIN user_groups ug ON ug.user_id = u.id
+        JOIN group_permissions gp ON gp.group_id = ug.group_id
+        JOIN permissions p ON p.id = gp.permission_id
+        WHERE p.action = ? AND u.disabled_at IS NULL`, PermPermissionsAssign).Scan(&holders)
+    if err != nil {
+        return fmt.Errorf("count permission administrators: %w", err)
+    }
+    if holders == 0 {
+        return ErrLastPermissionsAdmin
+    }
+    return nil
+}
+
+// abortLastPermissionsAdmin writes the response for a failed checkPermissionsAdminRemains.
+func abortLastPermissionsAdmin(c *gin.Context, err error) {
+    if errors.Is(err, ErrLastPermissionsAdmin) {
+        c.JSON(http.StatusConflict, gin.H{"error": err.Error(), "code": "last_permissions_admin"})
+        return
+    }
+    c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
+}
+
+// groupIDParam parses the :id parameter of group routes and checks that the group exists.
+// It writes the error response and returns false otherwise.
+func (h *Handlers) groupIDParam(c *gin.Context) (int64, bool) {
+    groupID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+    if err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "invalid group id"})
+        return 0, false
+    }
+    var exists bool
+    if err := h.db.QueryRow("SELECT EXISTS (SELECT 1 FROM groups WHERE id = ?)", groupID).Scan(&exists); err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
+        return 0, false
+    }
+    if !exists {
+        c.JSON(http.StatusNotFound, gin.H{"error": "group not found"})
+        return 0, false
+    }
+    return groupID, true
+}
+
+// ListPermissions returns the permission catalogue with the IDs used by the group
+// permission endpoints.
+func (h *Handlers) ListPermissions(c *gin.Context) {
+    rows, err := h.db.Query("SELECT id, action FROM permissions ORDER BY action")
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
+        return
+    }
+    defer rows.Close()
+    perms := []Permission{}
+    for rows.Next() {
+        var p Permission
+        if err := rows.Scan(&p.ID, &p.Action); err != nil {
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
+            return
+        }
+        perms = append(perms, p)
+    }
+    c.JSON(http.StatusOK, perms)
+}
+
+// ListGroupPermissions returns the permissions of a group.
+func (h *Handlers) ListGroupPermissions(c *gin.Context) {
+    groupID, ok := h.groupIDParam(c)
+    if !ok {
+        return
+    }
+    rows, err := h.db.Query(`SELECT p.id, p.action FROM permissions p
+        JOIN group_permissions gp ON gp.permission_id = p.id
+        WHERE gp.group_id = ? ORDER BY p.action`, groupID)
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
+        return
+    }
+    defer rows.Close()
+    perms := []Permission{}
+    for rows.Next() {
+        var p Permission
+        if err := rows.Scan(&p.ID, &p.Action); err != nil {
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
+            return
+        }
+        perms = append(perms, p)
+    }
+    c.JSON(http.StatusOK, perms)
+}
+
+// RenameGroup changes the name of a group. Group mappings of OIDC_GROUP_MAPPING and
+// LDAP_GROUP_MAPPING refer to groups by name and must be updated accordingly.
+func (h *Handlers) RenameGroup(c *gin.Context) {
+    groupID, ok := h.groupIDParam(c)
+    if !ok {
+        return
+    }
+    var req CreateGroupRequest
+    if err := c.ShouldBindJSON(&req); err != nil || strings.TrimSpace(req.Name) == "" {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "name is required"})
+        return
+    }
+    if _, err := h.db.Exec("UPDATE groups SET name = ? WHERE id = ?", req.Name, groupID); err != nil {
+        if strings.Contains(err.Error(), "UNIQUE") {
+            c.JSON(http.StatusConflict, gin.H{"error": "group name already exists"})
+        } else {
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to rename group"})
+        }
+        return
+    }
+    c.JSON(http.StatusOK, gin.H{"id": groupID, "name": req.Name})
+}
+
+// DeleteGroup deletes a group along with its memberships and permission assignments.
+func (h *Handlers) DeleteGroup(c *gin.Context) {
+    groupID, ok := h.groupIDParam(c)
+    if !ok {
+        return
+    }
+    tx, err := h.db.Begin()
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to begin transaction"})
+        return
+    }
+    defer tx.Rollback()
+    if _, err := tx.Exec("DELETE FROM groups WHERE id = ?", groupID); err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to delete group"})
+        return
+    }
+    if err := checkPermissionsAdminRemains(tx); err != nil {
+        abortLastPermissionsAdmin(c, err)
+        return
+    }
+    if err := tx.Commit(); err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to commit transaction"})
+        return
+    }
+    invalidateAllPermissions(h.db)
+    c.Status(http.StatusNoContent)
+}
+
+// RevokePermission removes a permission from a group.
+func (h *Handlers) RevokePermission(c *gin.Context) {
+    groupID, ok := h.groupIDParam(c)
+    if !ok {
+        return
+    }
+    permissionID, err := strconv.ParseInt(c.Param("permission_id"), 10, 64)
+    if err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "invalid permission id"})
+        return
+    }
+    tx, err := h.db.Begin()
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to begin transaction"})
+        return
+    }
+    defer tx.Rollback()
+    res, err := tx.Exec("DELETE FROM group_permissions WHERE group_id = ? AND permission_id = ?", groupID, permissionID)
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to revoke permission"})
+        return
+    }
+    if n, _ := res.RowsAffected(); n == 0 {
+        c.JSON(http.StatusNotFound, gin.H{"error": "permission is not assigned to this group"})
+        return
+    }
+    if err := checkPermissionsAdminRemains(tx); err != nil {
+        abortLastPermissionsAdmin(c, err)
+        return
+    }
+    if err := tx.Commit(); err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to commit transaction"})
+        return
+    }
+    invalidateAllPermissions(h.db)
+    c.Status(http.StatusNoContent)
+}
+
+// ReplacePermissions sets the full permission set of a group: permissions missing from
+// the request are revoked. Unknown permission IDs are rejected.
+func (h *Handlers) ReplacePermissions(c *gin.Context) {
+    groupID, ok := h.groupIDParam(c)
+    if !ok {
+        return
+    }
+    var req AssignPermissionsRequest
+    if err := c.ShouldBindJSON(&req); err != nil || req.PermissionIDs == nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "permission_ids is required"})
+        return
+    }
+    tx, err := h.db.Begin()
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to begin transaction"})
+        return
+    }
+    defer tx.Rollback()
+    if _, err := tx.Exec("DELETE FROM group_permissions WHERE group_id = ?", groupID); err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to replace permissions"})
+        return
+    }
+    for _, pid := range req.PermissionIDs {
+        var exists bool
+        if err := tx.QueryRow("SELECT EXISTS (SELECT 1 FROM permissions WHERE id = ?)", pid).Scan(&exists); err != nil {
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
+            return
+        }
+        if !exists {
+            c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("unknown permission id %d", pid)})
+            return
+        }
+        if _, err := tx.Exec("INSERT OR IGNORE INTO group_permissions (group_id, permission_id) VALUES (?, ?)", groupID, pid); err != nil {
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to replace permissions"})
+            return
+        }
+    }
+    if err := checkPermissionsAdminRemains(tx); err != nil {
+        abortLastPermissionsAdmin(c, err)
+        return
+    }
+    if err := tx.Commit(); err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to commit transaction"})
+        return
+    }
+    invalidateAllPermissions(h.db)
+    c.JSON(http.StatusOK, gin.H{"group_id": groupID, "permission_ids": req.PermissionIDs})
+}
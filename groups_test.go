@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newGroupAdminRouter(t *testing.T) (*gin.Engine, *Handlers) {
+	r, h := newUserAdminRouter(t)
+	admin := r.Group("/api/admin")
+	admin.GET("/permissions", h.ListPermissions)
+	admin.PUT("/groups/:id", h.RenameGroup)
+	admin.DELETE("/groups/:id", h.DeleteGroup)
+	admin.GET("/groups/:id/permissions", h.ListGroupPermissions)
+	admin.PUT("/groups/:id/permissions", h.ReplacePermissions)
+	admin.DELETE("/groups/:id/permissions/:permission_id", h.RevokePermission)
+	return r, h
+}
+
+func permissionID(t *testing.T, h *Handlers, action string) int64 {
+	var id int64
+	require.NoError(t, h.db.QueryRow("SELECT id FROM permissions WHERE action = ?", action).Scan(&id))
+	return id
+}
+
+func groupActions(t *testing.T, r *gin.Engine, groupID int64) []string {
+	w := doRequest(r, http.MethodGet, fmt.Sprintf("/api/admin/groups/%d/permissions", groupID))
+	require.Equal(t, http.StatusOK, w.Code)
+	var perms []Permission
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &perms))
+	actions := []string{}
+	for _, p := range perms {
+		actions = append(actions, p.Action)
+	}
+	return actions
+}
+
+func TestListPermissionsCatalogue(t *testing.T) {
+	r, _ := newGroupAdminRouter(t)
+	w := doRequest(r, http.MethodGet, "/api/admin/permissions")
+	require.Equal(t, http.StatusOK, w.Code)
+	var perms []Permission
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &perms))
+	actions := map[string]bool{}
+	for _, p := range perms {
+		assert.NotZero(t, p.ID)
+		actions[p.Action] = true
+	}
+	assert.True(t, actions[PermPermissionsAssign])
+	assert.True(t, actions[PermGroupsDelete])
+}
+
+func TestRenameReplaceRevokeAndDeleteGroup(t *testing.T) {
+	r, h := newGroupAdminRouter(t)
+
+	assert.Equal(t, http.StatusConflict, putJSON(r, "/api/admin/groups/2", `{"name":"Utilisateurs"}`).Code)
+	w := putJSON(r, "/api/admin/groups/2", `{"name":"Approbateurs"}`)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, http.StatusNotFound, putJSON(r, "/api/admin/groups/99", `{"name":"Other"}`).Code)
+
+	readAll := permissionID(t, h, PermReportsReadAll)
+	approve := permissionID(t, h, PermReportsApprove)
+	w = putJSON(r, "/api/admin/groups/2/permissions", fmt.Sprintf(`{"permission_ids":[%d,%d]}`, readAll, approve))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, []string{PermReportsApprove, PermReportsReadAll}, groupActions(t, r, 2))
+	assert.Equal(t, http.StatusBadRequest, putJSON(r, "/api/admin/groups/2/permissions", `{"permission_ids":[9999]}`).Code)
+	assert.Equal(t, []string{PermReportsApprove, PermReportsReadAll}, groupActions(t, r, 2))
+
+	assert.Equal(t, http.StatusNoContent, doRequest(r, http.MethodDelete, fmt.Sprintf("/api/admin/groups/2/permissions/%d", approve)).Code)
+	assert.Equal(t, http.StatusNotFound, doRequest(r, http.MethodDelete, fmt.Sprintf("/api/admin/groups/2/permissions/%d", approve)).Code)
+	assert.Equal(t, []string{PermReportsReadAll}, groupActions(t, r, 2))
+
+	userID := createTestUser(t, h, "jane@example.com")
+	require.Equal(t, http.StatusOK, postJSON(r, fmt.Sprintf("/api/admin/users/%d/groups", userID), `{"group_id":2}`, "").Code)
+	assert.Equal(t, http.StatusNoContent, doRequest(r, http.MethodDelete, "/api/admin/groups/2").Code)
+	assert.Equal(t, []string{"Utilisateurs"}, userGroupNames(t, h.db, "jane@example.com"))
+	assert.Equal(t, http.StatusNotFound, doRequest(r, http.MethodDelete, "/api/admin/groups/2").Code)
+}
+
+func TestLastPermissionsAdminIsProtected(t *testing.T) {
+	r, h := newGroupAdminRouter(t)
+	assign := permissionID(t, h, PermPermissionsAssign)
+
+	assertLocked := func(w interface{ Result() *http.Response }) {
+		t.Helper()
+		res := w.Result()
+		defer res.Body.Close()
+		var body map[string]string
+		require.NoError(t, json.NewDecoder(res.Body).Decode(&body))
+		assert.Equal(t, http.StatusConflict, res.StatusCode)
+		assert.Equal(t, "last_permissions_admin", body["code"])
+	}
+	assertLocked(doRequest(r, http.MethodDelete, fmt.Sprintf("/api/admin/groups/1/permissions/%d", assign)))
+	assertLocked(putJSON(r, "/api/admin/groups/1/permissions", `{"permission_ids":[]}`))
+	assertLocked(doRequest(r, http.MethodDelete, "/api/admin/groups/1"))
+	assertLocked(doRequest(r, http.MethodDelete, "/api/admin/users/1/groups/1"))
+	assertLocked(doRequest(r, http.MethodPost, "/api/admin/users/1/deactivate"))
+	assert.Contains(t, groupActions(t, r, 1), PermPermissionsAssign)
+
+	// Another administrator lifts the protection
+	userID := createTestUser(t, h, "jane@example.com")
+	require.Equal(t, http.StatusOK, postJSON(r, fmt.Sprintf("/api/admin/users/%d/groups", userID), `{"group_id":1}`, "").Code)
+	assert.Equal(t, http.StatusNoContent, doRequest(r, http.MethodDelete, "/api/admin/users/1/groups/1").Code)
+	assertLocked(doRequest(r, http.MethodDelete, fmt.Sprintf("/api/admin/users/%d", userID)))
+}
+
+func TestRevokedAdministratorPermissionSurvivesRestart(t *testing.T) {
+	r, h := newGroupAdminRouter(t)
+	exportAll := permissionID(t, h, PermReportsExportAll)
+	require.Equal(t, http.StatusNoContent, doRequest(r, http.MethodDelete, fmt.Sprintf("/api/admin/groups/1/permissions/%d", exportAll)).Code)
+
+	// InitDB runs at every startup
+	require.NoError(t, InitDB(h.db))
+	assert.NotContains(t, groupActions(t, r, 1), PermReportsExportAll)
+}
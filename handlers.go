@@ -1,11 +1,12 @@
 package main
 
 import (
-    "crypto/rand"
     "database/sql"
     "encoding/csv"
     "errors"
     "fmt"
+    "io"
+    "log"
     "net/http"
     "os"
     "path/filepath"
@@ -21,6 +22,8 @@ import (
 type Handlers struct {
     db      *sql.DB
     datadir string
+    oidc    *OIDCProvider
+    ldap    *LDAPDirectory
 }
 
 // NewHandlers constructs a Handlers instance.
@@ -34,41 +37,119 @@ type LoginRequest struct {
     Password string `json:"password"`
 }
 
-// Login handles user authentication and returns a signed JWT.
+// ErrInvalidCredentials is returned when a login does not match a known account. It does
+// not tell unknown emails from wrong passwords.
+var ErrInvalidCredentials = errors.New("invalid credentials")
+
+// authenticate checks a password login. Local accounts are verified against their bcrypt
+// hash and directory accounts against the LDAP server. When a directory is configured,
+// unknown emails are looked up there and provisioned on first login. Accounts managed by
+// an OpenID Connect provider have no password and are refused.
+func (h *Handlers) authenticate(email, password string) (*User, error) {
+    var user User
+    err := h.db.QueryRow("SELECT id, email, password_hash, auth_source, must_change_password, created_at FROM users WHERE email = ?", email).Scan(&user.ID, &user.Email, &user.PasswordHash, &user.AuthSource, &user.MustChangePassword, &user.CreatedAt)
+    if errors.Is(err, sql.ErrNoRows) {
+        if h.ldap != nil {
+            return h.loginLDAP(email, password)
+        }
+    } else if err != nil {
+        return nil, err
+    }
+    switch {
+    case err == nil && user.AuthSource == AuthSourceLocal:
+        if err := checkPassword(user.PasswordHash, password); err != nil {
+            return nil, ErrInvalidCredentials
+        }
+        return &user, nil
+    case err == nil && user.AuthSource == AuthSourceLDAP && h.ldap != nil:
+        return h.loginLDAP(email, password)
+    }
+    // Spend the time of a bcrypt compare so that timing does not reveal which emails exist
+    checkPassword(dummyPasswordHash, password)
+    return nil, ErrInvalidCredentials
+}
+
+// Login handles user authentication. It opens a session and returns a short-lived
+// access token along with a refresh token. When the account has MFA enabled, it returns
+// an MFA challenge instead and the session is opened by VerifyMFA.
 func (h *Handlers) Login(c *gin.Context) {
     var req LoginRequest
     if err := c.ShouldBindJSON(&req); err != nil {
         c.JSON(http.StatusBadRequest, gin.H{"error": "invalid JSON"})
         return
     }
-    var user User
-    err := h.db.QueryRow("SELECT id, email, password_hash, created_at FROM users WHERE email = ?", req.Email).Scan(&user.ID, &user.Email, &user.PasswordHash, &user.CreatedAt)
-    if errors.Is(err, sql.ErrNoRows) {
+    // Repeated failures on the account or from the client address block logins for a while
+    ip := c.ClientIP()
+    if !h.allowLoginAttempt(c, req.Email) {
+        return
+    }
+    user, err := h.authenticate(req.Email, req.Password)
+    if errors.Is(err, ErrInvalidCredentials) || errors.Is(err, ErrExternalAccountConflict) {
+        if err := recordLoginFailure(h.db, req.Email, ip, time.Now()); err != nil {
+            log.Printf("[ERROR] %v", err)
+        }
         // Avoid leaking whether the email exists
         c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid credentials"})
         return
     } else if err != nil {
+        log.Printf("[ERROR] login failed: %v", err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "authentication failed"})
+        return
+    }
+    // Only told once the password is verified, so it does not reveal which accounts exist
+    disabled, err := accountDisabled(h.db, user.ID)
+    if err != nil {
         c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
         return
     }
-    if err := checkPassword(user.PasswordHash, req.Password); err != nil {
-        c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid credentials"})
+    if disabled {
+        c.JSON(http.StatusForbidden, gin.H{"error": ErrAccountDisabled.Error(), "code": "account_disabled"})
         return
     }
-    token, err := generateJWT(user.ID)
+    // Accounts with a second factor get a challenge to complete with VerifyMFA
+    enabled, err := mfaEnabled(h.db, user.ID)
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
+        return
+    }
+    if enabled {
+        // Failed second factors are recorded against the account email, which may differ
+        // from the login name of a directory account
+        if !h.allowLoginAttempt(c, user.Email) {
+            return
+        }
+        mfaToken, err := createMFAChallenge(h.db, user.ID)
+        if err != nil {
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to start MFA challenge"})
+            return
+        }
+        c.JSON(http.StatusOK, gin.H{"mfa_required": true, "mfa_token": mfaToken, "expires_in": int64(mfaChallengeTTL / time.Second)})
+        return
+    }
+    tokens, err := h.startSession(user.ID)
     if err != nil {
         c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to generate token"})
         return
     }
-    c.JSON(http.StatusOK, gin.H{"token": token, "user": gin.H{"id": user.ID, "email": user.Email}})
+    // Failures are only forgiven once every factor has been verified
+    if err := clearAccountThrottle(h.db, req.Email); err != nil {
+        log.Printf("[ERROR] %v", err)
+    }
+    tokens["user"] = gin.H{"id": user.ID, "email": user.Email}
+    // Protected routes stay closed until the password is changed with ChangePassword
+    tokens["password_change_required"] = user.MustChangePassword
+    c.JSON(http.StatusOK, tokens)
 }
 
-// CreateReportRequest defines payload for creating an expense report.
+// CreateReportRequest defines payload for creating an expense report. OwnerID names the
+// beneficiary of a report prepared by one of their proxies.
 type CreateReportRequest struct {
-    Title string `json:"title"`
+    Title   string `json:"title"`
+    OwnerID int64  `json:"owner_id"`
 }
 
-// CreateReport creates a new expense report with status "draft".
+// CreateReport creates a new expense report with status "draft", owned by the caller or,
+// for a proxy, by the user they prepare it for. The proxy is recorded as prepared_by.
 func (h *Handlers) CreateReport(c *gin.Context) {
     var req CreateReportRequest
     if err := c.ShouldBindJSON(&req); err != nil || strings.TrimSpace(req.Title) == "" {
@@ -78,16 +159,54 @@ func (h *Handlers) CreateReport(c *gin.Context) {
     // Get user ID from context
     userIDIfc, _ := c.Get(ContextUserIDKey)
     userID := userIDIfc.(int64)
-    res, err := h.db.Exec("INSERT INTO expense_reports (user_id, title, status, created_at) VALUES (?, ?, ?, ?)", userID, req.Title, "draft", time.Now().UTC())
+    ownerID := userID
+    var preparedBy *int64
+    if req.OwnerID != 0 && req.OwnerID != userID {
+        proxy, err := isProxy(h.db, req.OwnerID, userID)
+        if err != nil {
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "permission check failed"})
+            return
+        }
+        if !proxy {
+            c.JSON(http.StatusForbidden, gin.H{"error": "you do not prepare reports for this user"})
+            return
+        }
+        ownerID, preparedBy = req.OwnerID, &userID
+    }
+    tx, err := h.db.Begin()
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
+        return
+    }
+    defer tx.Rollback()
+    res, err := tx.Exec("INSERT INTO expense_reports (user_id, title, status, prepared_by, created_at) VALUES (?, ?, ?, ?, ?)",
+        ownerID, req.Title, StatusDraft, preparedBy, time.Now().UTC())
     if err != nil {
         c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create report"})
         return
     }
     reportID, _ := res.LastInsertId()
-    c.JSON(http.StatusCreated, gin.H{"id": reportID, "title": req.Title, "status": "draft"})
+    if err := recordStatusChange(tx, reportID, nil, StatusDraft, userID, ""); err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create report"})
+        return
+    }
+    if err := tx.Commit(); err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
+        return
+    }
+    resp := gin.H{"id": reportID, "user_id": ownerID, "title": req.Title, "status": StatusDraft}
+    if preparedBy != nil {
+        resp["prepared_by"] = *preparedBy
+    }
+    c.JSON(http.StatusCreated, resp)
 }
 
-// SubmitReport sets the status of a report to "submitted". Only the report owner can submit.
+// SubmitReport sets the status of a report to "submitted" and plans its approval chain
+// from the approval rules. Manager steps are routed to the owner's line manager, or the
+// first manager up the chain who can approve; without such a manager they are left to the
+// validators of the owner's groups. The report's expected approver is the approver of the
+// first step. Reports the auto-approval policy covers are approved at once. Only the
+// report owner can submit, not the proxy who prepared it.
 func (h *Handlers) SubmitReport(c *gin.Context) {
     reportID, err := strconv.ParseInt(c.Param("id"), 10, 64)
     if err != nil {
@@ -97,7 +216,7 @@ func (h *Handlers) SubmitReport(c *gin.Context) {
     userIDIfc, _ := c.Get(ContextUserIDKey)
     userID := userIDIfc.(int64)
     // Ensure the report belongs to the user and is in draft
-    var status string
+    var status ReportStatus
     var ownerID int64
     err = h.db.QueryRow("SELECT id, user_id, status FROM expense_reports WHERE id = ?", reportID).Scan(&reportID, &ownerID, &status)
     if err != nil {
@@ -112,18 +231,211 @@ func (h *Handlers) SubmitReport(c *gin.Context) {
         c.JSON(http.StatusForbidden, gin.H{"error": "forbidden"})
         return
     }
-    if status != "draft" {
+    if !status.canTransitionTo(StatusSubmitted) {
         c.JSON(http.StatusBadRequest, gin.H{"error": "only draft reports can be submitted"})
         return
     }
-    if _, err := h.db.Exec("UPDATE expense_reports SET status = ? WHERE id = ?", "submitted", reportID); err != nil {
+    total, err := reportTotal(h.db, reportID)
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
+        return
+    }
+    autoApprove, err := autoApproves(h.db, reportID, total)
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
+        return
+    }
+    var steps []ApprovalStep
+    if !autoApprove {
+        steps, err = planApprovalSteps(h.db, userID, total)
+        if err != nil {
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to route report"})
+            return
+        }
+    }
+    var approverID *int64
+    stepNames := []string{}
+    for _, s := range steps {
+        stepNames = append(stepNames, s.Name)
+    }
+    if len(steps) > 0 {
+        approverID = steps[0].ApproverID
+    }
+    tx, err := h.db.Begin()
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
+        return
+    }
+    defer tx.Rollback()
+    if err := transitionReport(tx, reportID, status, StatusSubmitted, userID, ""); err != nil {
+        abortTransition(c, err)
+        return
+    }
+    if _, err := tx.Exec("UPDATE expense_reports SET approver_id = ?, submitted_at = ? WHERE id = ?", approverID, time.Now().UTC(), reportID); err != nil {
         c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to submit report"})
         return
     }
-    c.JSON(http.StatusOK, gin.H{"id": reportID, "status": "submitted"})
+    if err := replaceApprovalSteps(tx, reportID, steps); err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to submit report"})
+        return
+    }
+    if autoApprove {
+        comment := fmt.Sprintf("auto-approved: total below %g with all receipts", autoApproveBelow)
+        if err := transitionReport(tx, reportID, StatusSubmitted, StatusApproved, systemActor, comment); err != nil {
+            abortTransition(c, err)
+            return
+        }
+    }
+    if err := tx.Commit(); err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
+        return
+    }
+    if autoApprove {
+        c.JSON(http.StatusOK, gin.H{"id": reportID, "status": StatusApproved, "steps": stepNames, "auto_approved": true})
+        return
+    }
+    resp := gin.H{"id": reportID, "status": StatusSubmitted, "steps": stepNames}
+    if approverID != nil {
+        resp["approver_id"] = *approverID
+    }
+    c.JSON(http.StatusOK, resp)
+}
+
+// ReopenReport returns a rejected report to draft so that its owner can correct and
+// resubmit it. The approval chain is planned again on the next submission.
+func (h *Handlers) ReopenReport(c *gin.Context) {
+    reportID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+    if err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "invalid report id"})
+        return
+    }
+    userIDIfc, _ := c.Get(ContextUserIDKey)
+    userID := userIDIfc.(int64)
+    var ownerID int64
+    var status ReportStatus
+    err = h.db.QueryRow("SELECT user_id, status FROM expense_reports WHERE id = ?", reportID).Scan(&ownerID, &status)
+    if err != nil {
+        if errors.Is(err, sql.ErrNoRows) {
+            c.JSON(http.StatusNotFound, gin.H{"error": "report not found"})
+        } else {
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
+        }
+        return
+    }
+    if ownerID != userID {
+        c.JSON(http.StatusForbidden, gin.H{"error": "forbidden"})
+        return
+    }
+    if !actionReopen.allows(status) {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "only rejected reports can be reopened"})
+        return
+    }
+    tx, err := h.db.Begin()
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
+        return
+    }
+    defer tx.Rollback()
+    if err := transitionReport(tx, reportID, actionReopen.from, actionReopen.to, userID, ""); err != nil {
+        abortTransition(c, err)
+        return
+    }
+    if _, err := tx.Exec("UPDATE expense_reports SET approver_id = NULL WHERE id = ?", reportID); err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to reopen report"})
+        return
+    }
+    if err := tx.Commit(); err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
+        return
+    }
+    c.JSON(http.StatusOK, gin.H{"id": reportID, "status": StatusDraft})
+}
+
+// WithdrawReport returns a submitted report to draft at its owner's request, as long as
+// no approval step was decided. The approval chain is dropped and the approvers the
+// current step waits for are notified.
+func (h *Handlers) WithdrawReport(c *gin.Context) {
+    reportID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+    if err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "invalid report id"})
+        return
+    }
+    userIDIfc, _ := c.Get(ContextUserIDKey)
+    userID := userIDIfc.(int64)
+    tx, err := h.db.Begin()
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
+        return
+    }
+    defer tx.Rollback()
+    var ownerID int64
+    var status ReportStatus
+    var title string
+    var approverID sql.NullInt64
+    err = tx.QueryRow("SELECT user_id, status, title, approver_id FROM expense_reports WHERE id = ?", reportID).Scan(&ownerID, &status, &title, &approverID)
+    if err != nil {
+        if errors.Is(err, sql.ErrNoRows) {
+            c.JSON(http.StatusNotFound, gin.H{"error": "report not found"})
+        } else {
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
+        }
+        return
+    }
+    if ownerID != userID {
+        c.JSON(http.StatusForbidden, gin.H{"error": "forbidden"})
+        return
+    }
+    if !actionWithdraw.allows(status) {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "only submitted reports can be withdrawn"})
+        return
+    }
+    var decided bool
+    if err := tx.QueryRow("SELECT EXISTS (SELECT 1 FROM report_approval_steps WHERE report_id = ? AND status != ?)", reportID, StepPending).Scan(&decided); err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
+        return
+    }
+    if decided {
+        c.JSON(http.StatusConflict, gin.H{"error": "an approval step was already decided", "code": "already_decided"})
+        return
+    }
+    step, err := currentApprovalStep(tx, reportID)
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
+        return
+    }
+    if step == nil {
+        step = legacyManagerStep(approverID)
+    }
+    approvers, err := stepApprovers(tx, ownerID, step)
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
+        return
+    }
+    if err := transitionReport(tx, reportID, actionWithdraw.from, actionWithdraw.to, userID, "withdrawn by the owner"); err != nil {
+        abortTransition(c, err)
+        return
+    }
+    if _, err := tx.Exec("UPDATE expense_reports SET approver_id = NULL WHERE id = ?", reportID); err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to withdraw report"})
+        return
+    }
+    if _, err := tx.Exec("DELETE FROM report_approval_steps WHERE report_id = ?", reportID); err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to withdraw report"})
+        return
+    }
+    if err := notifyUsers(tx, approvers, reportID, NotifyReportWithdrawn, fmt.Sprintf("Report %q was withdrawn by its owner", title)); err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to withdraw report"})
+        return
+    }
+    if err := tx.Commit(); err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
+        return
+    }
+    c.JSON(http.StatusOK, gin.H{"id": reportID, "status": StatusDraft, "notified": len(approvers)})
 }
 
-// DeleteReport deletes a report if it belongs to the user and is still in draft.
+// DeleteReport deletes a report if it belongs to the user, or to a user they prepare
+// reports for, and is still in draft.
 func (h *Handlers) DeleteReport(c *gin.Context) {
     reportID, err := strconv.ParseInt(c.Param("id"), 10, 64)
     if err != nil {
@@ -134,7 +446,7 @@ func (h *Handlers) DeleteReport(c *gin.Context) {
     userID := userIDIfc.(int64)
     // Verify conditions
     var ownerID int64
-    var status string
+    var status ReportStatus
     err = h.db.QueryRow("SELECT user_id, status FROM expense_reports WHERE id = ?", reportID).Scan(&ownerID, &status)
     if err != nil {
         if errors.Is(err, sql.ErrNoRows) {
@@ -144,11 +456,16 @@ func (h *Handlers) DeleteReport(c *gin.Context) {
         }
         return
     }
-    if ownerID != userID {
+    allowed, err := canPrepare(h.db, ownerID, userID)
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "permission check failed"})
+        return
+    }
+    if !allowed {
         c.JSON(http.StatusForbidden, gin.H{"error": "forbidden"})
         return
     }
-    if status != "draft" {
+    if !status.editable() {
         c.JSON(http.StatusBadRequest, gin.H{"error": "only draft reports can be deleted"})
         return
     }
@@ -159,16 +476,35 @@ func (h *Handlers) DeleteReport(c *gin.Context) {
     c.Status(http.StatusNoContent)
 }
 
-// ListOwnReports returns the current user's reports.
+// ListOwnReports returns the current user's reports. A proxy lists the reports of a user
+// they prepare reports for with ?owner_id=.
 func (h *Handlers) ListOwnReports(c *gin.Context) {
     userIDIfc, _ := c.Get(ContextUserIDKey)
     userID := userIDIfc.(int64)
+    if v := c.Query("owner_id"); v != "" {
+        ownerID, err := strconv.ParseInt(v, 10, 64)
+        if err != nil {
+            c.JSON(http.StatusBadRequest, gin.H{"error": "invalid owner id"})
+            return
+        }
+        allowed, err := canPrepare(h.db, ownerID, userID)
+        if err != nil {
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "permission check failed"})
+            return
+        }
+        if !allowed {
+            c.JSON(http.StatusForbidden, gin.H{"error": "forbidden"})
+            return
+        }
+        userID = ownerID
+    }
     // Query reports and items joined so we can group them
-    rows, err := h.db.Query(`SELECT er.id, er.title, er.status, er.created_at, ei.id, ei.description, ei.expense_date, ei.amount_ht, ei.amount_ttc, ei.vat_rate, ei.receipt_path
+    rows, err := h.db.Query(`SELECT er.id, er.title, er.status, er.prepared_by, er.created_at, pb.id, pb.reference, pb.paid_at, ei.id, ei.description, ei.expense_date, ei.amount_ht, ei.amount_ttc, ei.vat_rate, ei.receipt_path
         FROM expense_reports er
+        LEFT JOIN payment_batches pb ON pb.id = er.payment_batch_id AND pb.status = ?
         LEFT JOIN expense_items ei ON ei.report_id = er.id
         WHERE er.user_id = ?
-        ORDER BY er.id ASC`, userID)
+        ORDER BY er.id ASC`, BatchPaid, userID)
     if err != nil {
         c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
         return
@@ -184,31 +520,39 @@ func (h *Handlers) ListOwnReports(c *gin.Context) {
         ReceiptPath *string `json:"receipt_path,omitempty"`
     }
     type reportOut struct {
-        ID        int64     `json:"id"`
-        UserID    int64     `json:"user_id"`
-        Title     string    `json:"title"`
-        Status    string    `json:"status"`
-        CreatedAt time.Time `json:"created_at"`
-        Items     []itemOut `json:"items"`
+        ID            int64          `json:"id"`
+        UserID        int64          `json:"user_id"`
+        Title         string         `json:"title"`
+        Status        string         `json:"status"`
+        PreparedBy    *int64         `json:"prepared_by,omitempty"`
+        CreatedAt     time.Time      `json:"created_at"`
+        Reimbursement *Reimbursement `json:"reimbursement,omitempty"`
+        Items         []itemOut      `json:"items"`
     }
     reportMap := make(map[int64]*reportOut)
     for rows.Next() {
         var reportID int64
         var title string
         var status string
+        var preparedBy *int64
         var createdAt time.Time
+        var batchID sql.NullInt64
+        var paymentRef, paidAt sql.NullString
         var itemID sql.NullInt64
         var desc sql.NullString
         var expenseDate sql.NullString
         var amtHT, amtTTC, vatRate sql.NullFloat64
         var receiptPath sql.NullString
-        if err := rows.Scan(&reportID, &title, &status, &createdAt, &itemID, &desc, &expenseDate, &amtHT, &amtTTC, &vatRate, &receiptPath); err != nil {
+        if err := rows.Scan(&reportID, &title, &status, &preparedBy, &createdAt, &batchID, &paymentRef, &paidAt, &itemID, &desc, &expenseDate, &amtHT, &amtTTC, &vatRate, &receiptPath); err != nil {
             c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
             return
         }
         rep, ok := reportMap[reportID]
         if !ok {
-            rep = &reportOut{ID: reportID, UserID: userID, Title: title, Status: status, CreatedAt: createdAt}
+            rep = &reportOut{ID: reportID, UserID: userID, Title: title, Status: status, PreparedBy: preparedBy, CreatedAt: createdAt}
+            if batchID.Valid {
+                rep.Reimbursement = &Reimbursement{BatchID: batchID.Int64, Reference: paymentRef.String, PaidAt: paidAt.String}
+            }
             reportMap[reportID] = rep
         }
         if itemID.Valid {
@@ -243,18 +587,19 @@ type AddItemRequest struct {
     VATRate     float64 `json:"vat_rate"`
 }
 
-// AddItem adds an expense item to a report.
+// AddItem adds an expense item to a draft report of the user or of a user they prepare
+// reports for.
 func (h *Handlers) AddItem(c *gin.Context) {
     reportID, err := strconv.ParseInt(c.Param("id"), 10, 64)
     if err != nil {
         c.JSON(http.StatusBadRequest, gin.H{"error": "invalid report id"})
         return
     }
-    // Verify report belongs to user
+    // Verify the user prepares the report
     userIDIfc, _ := c.Get(ContextUserIDKey)
     userID := userIDIfc.(int64)
     var ownerID int64
-    var status string
+    var status ReportStatus
     if err := h.db.QueryRow("SELECT user_id, status FROM expense_reports WHERE id = ?", reportID).Scan(&ownerID, &status); err != nil {
         if errors.Is(err, sql.ErrNoRows) {
             c.JSON(http.StatusNotFound, gin.H{"error": "report not found"})
@@ -263,11 +608,16 @@ func (h *Handlers) AddItem(c *gin.Context) {
         }
         return
     }
-    if ownerID != userID {
+    allowed, err := canPrepare(h.db, ownerID, userID)
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "permission check failed"})
+        return
+    }
+    if !allowed {
         c.JSON(http.StatusForbidden, gin.H{"error": "forbidden"})
         return
     }
-    if status != "draft" {
+    if !status.editable() {
         c.JSON(http.StatusBadRequest, gin.H{"error": "items can only be added to draft reports"})
         return
     }
@@ -299,7 +649,8 @@ func (h *Handlers) AddItem(c *gin.Context) {
     c.JSON(http.StatusCreated, gin.H{"id": itemID, "report_id": reportID, "description": req.Description, "expense_date": req.ExpenseDate, "amount_ht": req.AmountHT, "amount_ttc": amountTTC, "vat_rate": req.VATRate})
 }
 
-// UpdateItem updates an existing expense item. Only owner can update items in draft reports.
+// UpdateItem updates an existing expense item. Only the owner and their proxies can update
+// items in draft reports.
 func (h *Handlers) UpdateItem(c *gin.Context) {
     itemID, err := strconv.ParseInt(c.Param("id"), 10, 64)
     if err != nil {
@@ -309,7 +660,7 @@ func (h *Handlers) UpdateItem(c *gin.Context) {
     // Get item and its report owner and status
     var reportID int64
     var ownerID int64
-    var reportStatus string
+    var reportStatus ReportStatus
     row := h.db.QueryRow(`SELECT ei.report_id, er.user_id, er.status
         FROM expense_items ei
         JOIN expense_reports er ON er.id = ei.report_id
@@ -324,11 +675,16 @@ func (h *Handlers) UpdateItem(c *gin.Context) {
     }
     userIDIfc, _ := c.Get(ContextUserIDKey)
     userID := userIDIfc.(int64)
-    if ownerID != userID {
+    allowed, err := canPrepare(h.db, ownerID, userID)
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "permission check failed"})
+        return
+    }
+    if !allowed {
         c.JSON(http.StatusForbidden, gin.H{"error": "forbidden"})
         return
     }
-    if reportStatus != "draft" {
+    if !reportStatus.editable() {
         c.JSON(http.StatusBadRequest, gin.H{"error": "items can only be updated in draft reports"})
         return
     }
@@ -352,7 +708,8 @@ func (h *Handlers) UpdateItem(c *gin.Context) {
     c.JSON(http.StatusOK, gin.H{"id": itemID, "report_id": reportID, "description": req.Description, "expense_date": req.ExpenseDate, "amount_ht": req.AmountHT, "amount_ttc": amountTTC, "vat_rate": req.VATRate})
 }
 
-// UploadReceipt uploads or replaces the receipt attachment for an expense item.
+// UploadReceipt uploads or replaces the receipt attachment for an expense item of a draft
+// report, stored with the receipts of the report owner.
 func (h *Handlers) UploadReceipt(c *gin.Context) {
     itemID, err := strconv.ParseInt(c.Param("id"), 10, 64)
     if err != nil {
@@ -367,7 +724,7 @@ func (h *Handlers) UploadReceipt(c *gin.Context) {
     }
     // Check ownership and report status
     var ownerID int64
-    var reportStatus string
+    var reportStatus ReportStatus
     row := h.db.QueryRow(`SELECT er.user_id, er.status
         FROM expense_items ei
         JOIN expense_reports er ON er.id = ei.report_id
@@ -382,16 +739,21 @@ func (h *Handlers) UploadReceipt(c *gin.Context) {
     }
     userIDIfc, _ := c.Get(ContextUserIDKey)
     userID := userIDIfc.(int64)
-    if ownerID != userID {
+    allowed, err := canPrepare(h.db, ownerID, userID)
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "permission check failed"})
+        return
+    }
+    if !allowed {
         c.JSON(http.StatusForbidden, gin.H{"error": "forbidden"})
         return
     }
-    if reportStatus != "draft" {
+    if !reportStatus.editable() {
         c.JSON(http.StatusBadRequest, gin.H{"error": "receipts can only be uploaded for draft reports"})
         return
     }
-    // Determine user-specific directory
-    userDir := filepath.Join(h.datadir, fmt.Sprintf("%d", userID), "receipts")
+    // Receipts live in the owner's directory, whoever uploads them
+    userDir := filepath.Join(h.datadir, fmt.Sprintf("%d", ownerID), "receipts")
     if err := os.MkdirAll(userDir, 0o755); err != nil {
         c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create receipts directory"})
         return
@@ -422,13 +784,13 @@ func (h *Handlers) GetReceipt(c *gin.Context) {
         return
     }
     // Retrieve item info
-    var ownerID int64
+    var reportID, ownerID int64
     var receiptName sql.NullString
-    row := h.db.QueryRow(`SELECT er.user_id, ei.receipt_path
+    row := h.db.QueryRow(`SELECT er.id, er.user_id, ei.receipt_path
         FROM expense_items ei
         JOIN expense_reports er ON er.id = ei.report_id
         WHERE ei.id = ?`, itemID)
-    if err := row.Scan(&ownerID, &receiptName); err != nil {
+    if err := row.Scan(&reportID, &ownerID, &receiptName); err != nil {
         if errors.Is(err, sql.ErrNoRows) {
             c.JSON(http.StatusNotFound, gin.H{"error": "item not found"})
         } else {
@@ -442,14 +804,25 @@ func (h *Handlers) GetReceipt(c *gin.Context) {
     }
     userIDIfc, _ := c.Get(ContextUserIDKey)
     userID := userIDIfc.(int64)
-    // Check permission: user can always read own receipts; else must have reports:read:all
-    if ownerID != userID {
-        hasAll, err := UserHasPermission(h.db, userID, PermReportsReadAll)
+    // Check permission: user can always read own receipts, and proxies those of the users
+    // they prepare reports for; else the report must be within their review scope
+    allowed, err := canPrepare(h.db, ownerID, userID)
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "permission check failed"})
+        return
+    }
+    if !allowed {
+        scope, err := reviewScopeFor(c, h.db)
+        if err != nil {
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "permission check failed"})
+            return
+        }
+        in, err := scope.canSee(h.db, reportID)
         if err != nil {
             c.JSON(http.StatusInternalServerError, gin.H{"error": "permission check failed"})
             return
         }
-        if !hasAll {
+        if !in {
             c.JSON(http.StatusForbidden, gin.H{"error": "forbidden"})
             return
         }
@@ -459,29 +832,37 @@ func (h *Handlers) GetReceipt(c *gin.Context) {
     c.FileAttachment(filePath, receiptName.String)
 }
 
-// AdminListReports lists all submitted reports with user info.
+// AdminListReports lists the submitted reports within the reviewer's scope with user info.
 func (h *Handlers) AdminListReports(c *gin.Context) {
-    rows, err := h.db.Query(`SELECT er.id, er.user_id, er.title, er.status, er.created_at, u.email
+    scope, err := reviewScopeFor(c, h.db)
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "permission check failed"})
+        return
+    }
+    inScope, args := scope.filter()
+    rows, err := h.db.Query(`SELECT er.id, er.user_id, er.title, er.status, er.approver_id, er.created_at, er.submitted_at, u.email
         FROM expense_reports er
         JOIN users u ON u.id = er.user_id
-        WHERE er.status != 'draft'`)
+        WHERE er.status != ? AND `+inScope, append([]interface{}{StatusDraft}, args...)...)
     if err != nil {
         c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
         return
     }
     defer rows.Close()
     type reportOut struct {
-        ID        int64     `json:"id"`
-        UserID    int64     `json:"user_id"`
-        Email     string    `json:"email"`
-        Title     string    `json:"title"`
-        Status    string    `json:"status"`
-        CreatedAt time.Time `json:"created_at"`
+        ID          int64      `json:"id"`
+        UserID      int64      `json:"user_id"`
+        Email       string     `json:"email"`
+        Title       string     `json:"title"`
+        Status      string     `json:"status"`
+        ApproverID  *int64     `json:"approver_id,omitempty"`
+        CreatedAt   time.Time  `json:"created_at"`
+        SubmittedAt *time.Time `json:"submitted_at,omitempty"`
     }
     reports := []reportOut{}
     for rows.Next() {
         var r reportOut
-        if err := rows.Scan(&r.ID, &r.UserID, &r.Title, &r.Status, &r.CreatedAt, &r.Email); err != nil {
+        if err := rows.Scan(&r.ID, &r.UserID, &r.Title, &r.Status, &r.ApproverID, &r.CreatedAt, &r.SubmittedAt, &r.Email); err != nil {
             c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
             return
         }
@@ -490,50 +871,37 @@ func (h *Handlers) AdminListReports(c *gin.Context) {
     c.JSON(http.StatusOK, reports)
 }
 
-// ApproveReport approves a submitted report.
+// ApproveReport approves the current approval step of a submitted report within the
+// reviewer's scope. The report is approved once every step passed.
 func (h *Handlers) ApproveReport(c *gin.Context) {
-    reportID, err := strconv.ParseInt(c.Param("id"), 10, 64)
-    if err != nil {
-        c.JSON(http.StatusBadRequest, gin.H{"error": "invalid report id"})
-        return
-    }
-    // Update status if submitted
-    res, err := h.db.Exec(`UPDATE expense_reports SET status = 'approved' WHERE id = ? AND status = 'submitted'`, reportID)
-    if err != nil {
-        c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
-        return
-    }
-    count, _ := res.RowsAffected()
-    if count == 0 {
-        c.JSON(http.StatusBadRequest, gin.H{"error": "report not found or not in submitted state"})
-        return
-    }
-    c.JSON(http.StatusOK, gin.H{"id": reportID, "status": "approved"})
+    h.decideReport(c, true, "")
 }
 
-// RejectReport rejects a submitted report.
+// RejectReportRequest is the payload to reject a report.
+type RejectReportRequest struct {
+    Reason string `json:"reason"`
+}
+
+// RejectReport rejects a submitted report within the reviewer's scope at its current
+// approval step. A reason is required; it is recorded on the step and posted to the
+// report's comment thread.
 func (h *Handlers) RejectReport(c *gin.Context) {
-    reportID, err := strconv.ParseInt(c.Param("id"), 10, 64)
-    if err != nil {
-        c.JSON(http.StatusBadRequest, gin.H{"error": "invalid report id"})
-        return
-    }
-    res, err := h.db.Exec(`UPDATE expense_reports SET status = 'rejected' WHERE id = ? AND status = 'submitted'`, reportID)
-    if err != nil {
-        c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
+    var req RejectReportRequest
+    if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "invalid JSON"})
         return
     }
-    count, _ := res.RowsAffected()
-    if count == 0 {
-        c.JSON(http.StatusBadRequest, gin.H{"error": "report not found or not in submitted state"})
+    reason := strings.TrimSpace(req.Reason)
+    if reason == "" {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "a rejection reason is required", "code": "reason_required"})
         return
     }
-    c.JSON(http.StatusOK, gin.H{"id": reportID, "status": "rejected"})
+    h.decideReport(c, false, reason)
 }
 
 // ListUsers returns all users (id and email).
 func (h *Handlers) ListUsers(c *gin.Context) {
-    rows, err := h.db.Query("SELECT id, email, created_at FROM users")
+    rows, err := h.db.Query("SELECT id, email, auth_source, external_id, must_change_password, disabled_at, manager_id, created_at FROM users")
     if err != nil {
         c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
         return
@@ -542,7 +910,7 @@ func (h *Handlers) ListUsers(c *gin.Context) {
     var users []User
     for rows.Next() {
         var u User
-        if err := rows.Scan(&u.ID, &u.Email, &u.CreatedAt); err != nil {
+        if err := rows.Scan(&u.ID, &u.Email, &u.AuthSource, &u.ExternalID, &u.MustChangePassword, &u.DisabledAt, &u.ManagerID, &u.CreatedAt); err != nil {
             c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
             return
         }
@@ -551,11 +919,13 @@ func (h *Handlers) ListUsers(c *gin.Context) {
     c.JSON(http.StatusOK, users)
 }
 
-// CreateUserRequest defines payload to create a new user.
+// CreateUserRequest defines payload to create a new user. MustChangePassword defaults to
+// true: the user has to replace the password chosen by the administrator on first login.
 type CreateUserRequest struct {
-    Email    string  `json:"email"`
-    Password string  `json:"password"`
-    Groups   []int64 `json:"groups"` // list of group IDs
+    Email              string  `json:"email"`
+    Password           string  `json:"password"`
+    Groups             []int64 `json:"groups"` // list of group IDs
+    MustChangePassword *bool   `json:"must_change_password"`
 }
 
 // CreateUser creates a new user and assigns groups.
@@ -569,6 +939,11 @@ func (h *Handlers) CreateUser(c *gin.Context) {
         c.JSON(http.StatusBadRequest, gin.H{"error": "email and password are required"})
         return
     }
+    if err := passwordPolicy.Validate(req.Password, req.Email); err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": err.Error(), "code": "weak_password"})
+        return
+    }
+    mustChange := req.MustChangePassword == nil || *req.MustChangePassword
     // Hash password
     hashed, err := hashPassword(req.Password)
     if err != nil {
@@ -581,7 +956,7 @@ func (h *Handlers) CreateUser(c *gin.Context) {
         return
     }
     defer tx.Rollback()
-    res, err := tx.Exec("INSERT INTO users (email, password_hash, created_at) VALUES (?, ?, ?)", req.Email, hashed, time.Now().UTC())
+    res, err := tx.Exec("INSERT INTO users (email, password_hash, must_change_password, created_at) VALUES (?, ?, ?, ?)", req.Email, hashed, mustChange, time.Now().UTC())
     if err != nil {
         if strings.Contains(err.Error(), "UNIQUE") {
             c.JSON(http.StatusConflict, gin.H{"error": "email already exists"})
@@ -603,7 +978,7 @@ func (h *Handlers) CreateUser(c *gin.Context) {
         c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to commit transaction"})
         return
     }
-    c.JSON(http.StatusCreated, gin.H{"id": userID, "email": req.Email})
+    c.JSON(http.StatusCreated, gin.H{"id": userID, "email": req.Email, "must_change_password": mustChange})
 }
 
 // ListGroups returns all groups.
@@ -686,41 +1061,84 @@ func (h *Handlers) AssignPermissions(c *gin.Context) {
         c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to commit transaction"})
         return
     }
+    invalidateAllPermissions(h.db)
     c.JSON(http.StatusOK, gin.H{"group_id": groupID, "permission_ids": req.PermissionIDs})
 }
 
+// GenerateAPITokenRequest defines the optional payload for generating an API token.
+// Permissions restricts the token to a subset of actions; when empty the token carries
+// all permissions of its owner.
+type GenerateAPITokenRequest struct {
+    Name        string     `json:"name"`
+    ExpiresAt   *time.Time `json:"expires_at"`
+    Permissions []string   `json:"permissions"`
+}
+
 // GenerateAPIToken generates a static API token for a user.
-// It stores the token in the api_tokens table creating it if necessary.
+// Only the token digest is stored; the plaintext token is returned once.
 func (h *Handlers) GenerateAPIToken(c *gin.Context) {
     userID, err := strconv.ParseInt(c.Param("id"), 10, 64)
     if err != nil {
         c.JSON(http.StatusBadRequest, gin.H{"error": "invalid user id"})
         return
     }
-    // Create table if not exists
-    _, err = h.db.Exec(`CREATE TABLE IF NOT EXISTS api_tokens (
-        user_id INTEGER NOT NULL,
-        token TEXT NOT NULL,
-        created_at DATETIME NOT NULL,
-        PRIMARY KEY(user_id, token),
-        FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
-    )`)
-    if err != nil {
-        c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create table"})
+    var req GenerateAPITokenRequest
+    if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "invalid JSON"})
+        return
+    }
+    if req.ExpiresAt != nil && !req.ExpiresAt.After(time.Now()) {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "expires_at must be in the future"})
+        return
+    }
+    var exists int
+    if err := h.db.QueryRow("SELECT 1 FROM users WHERE id = ?", userID).Scan(&exists); err != nil {
+        if errors.Is(err, sql.ErrNoRows) {
+            c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+        } else {
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
+        }
         return
     }
     // Generate random 32-byte token encoded in hex
-    b := make([]byte, 32)
-    if _, err := rand.Read(b); err != nil {
+    token, err := randomToken()
+    if err != nil {
         c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to generate token"})
         return
     }
-    token := fmt.Sprintf("%x", b)
-    if _, err := h.db.Exec("INSERT INTO api_tokens (user_id, token, created_at) VALUES (?, ?, ?)", userID, token, time.Now().UTC()); err != nil {
+    var expiresAt interface{}
+    if req.ExpiresAt != nil {
+        expiresAt = req.ExpiresAt.UTC()
+    }
+    tx, err := h.db.Begin()
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to begin transaction"})
+        return
+    }
+    defer tx.Rollback()
+    permIDs, err := resolvePermissionIDs(tx, req.Permissions)
+    if err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+        return
+    }
+    res, err := tx.Exec("INSERT INTO api_tokens (user_id, name, prefix, token_hash, restricted, created_at, expires_at) VALUES (?, ?, ?, ?, ?, ?, ?)",
+        userID, strings.TrimSpace(req.Name), apiTokenPrefix(token), hashAPIToken(token), len(permIDs) > 0, time.Now().UTC(), expiresAt)
+    if err != nil {
         c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to store token"})
         return
     }
-    c.JSON(http.StatusOK, gin.H{"user_id": userID, "token": token})
+    tokenID, _ := res.LastInsertId()
+    for _, pid := range permIDs {
+        if _, err := tx.Exec("INSERT OR IGNORE INTO api_token_permissions (token_id, permission_id) VALUES (?, ?)", tokenID, pid); err != nil {
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to store token permissions"})
+            return
+        }
+    }
+    if err := tx.Commit(); err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to commit transaction"})
+        return
+    }
+    c.JSON(http.StatusOK, gin.H{"id": tokenID, "user_id": userID, "name": strings.TrimSpace(req.Name), "token": token, "expires_at": expiresAt, "permissions": req.Permissions})
 }
 
 // ExportCSV exports all expenses to CSV.
@@ -0,0 +1,148 @@
+package main
+
+import (
+    "database/sql"
+    "errors"
+    "fmt"
+    "net/http"
+    "time"
+
+    "github.com/gin-gonic/gin"
+)
+
+// eligibleApprover reports whether a user can act as approver: the account is active and
+// holds reports:approve.
+func eligibleApprover(db *sql.DB, userID int64) (bool, error) {
+    disabled, err := accountDisabled(db, userID)
+    if err != nil {
+        return false, err
+    }
+    if disabled {
+        return false, nil
+    }
+    perms, err := cachedUserPermissions(db, userID)
+    if err != nil {
+        return false, err
+    }
+    return perms[PermReportsApprove], nil
+}
+
+// resolveApprover returns the expected approver of the reports of a user: their line
+// manager, or the first manager up the chain when the manager is deactivated or cannot
+// approve. It returns an invalid NullInt64 when nobody in the chain can approve.
+func resolveApprover(db *sql.DB, userID int64) (sql.NullInt64, error) {
+    seen := map[int64]bool{userID: true}
+    current := userID
+    for {
+        var managerID sql.NullInt64
+        if err := db.QueryRow("SELECT manager_id FROM users WHERE id = ?", current).Scan(&managerID); err != nil {
+            return sql.NullInt64{}, fmt.Errorf("select manager: %w", err)
+        }
+        // SetManager refuses cycles; the check only guards against edited databases
+        if !managerID.Valid || seen[managerID.Int64] {
+            return sql.NullInt64{}, nil
+        }
+        seen[managerID.Int64] = true
+        eligible, err := eligibleApprover(db, managerID.Int64)
+        if err != nil {
+            return sql.NullInt64{}, err
+        }
+        if eligible {
+            return managerID, nil
+        }
+        current = managerID.Int64
+    }
+}
+
+// SetManagerRequest is the payload to set the line manager of a user. A null manager_id
+// removes the manager.
+type SetManagerRequest struct {
+    ManagerID *int64 `json:"manager_id"`
+}
+
+// SetManager sets the line manager of a user. A manager cannot be the user themselves or
+// one of their reports, directly or not.
+func (h *Handlers) SetManager(c *gin.Context) {
+    userID, ok := h.targetUserID(c)
+    if !ok {
+        return
+    }
+    var req SetManagerRequest
+    if err := c.ShouldBindJSON(&req); err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "invalid JSON"})
+        return
+    }
+    if req.ManagerID != nil {
+        // Walk up from the new manager; meeting the user would close a cycle
+        current := sql.NullInt64{Int64: *req.ManagerID, Valid: true}
+        for current.Valid {
+            if current.Int64 == userID {
+                c.JSON(http.StatusBadRequest, gin.H{"error": "manager hierarchy cannot contain a cycle"})
+                return
+            }
+            err := h.db.QueryRow("SELECT manager_id FROM users WHERE id = ?", current.Int64).Scan(&current)
+            if errors.Is(err, sql.ErrNoRows) {
+                c.JSON(http.StatusBadRequest, gin.H{"error": "manager not found"})
+                return
+            } else if err != nil {
+                c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
+                return
+            }
+        }
+    }
+    if _, err := h.db.Exec("UPDATE users SET manager_id = ? WHERE id = ?", req.ManagerID, userID); err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to set manager"})
+        return
+    }
+    c.JSON(http.StatusOK, gin.H{"user_id": userID, "manager_id": req.ManagerID})
+}
+
+// ListAwaitingApproval returns the submitted reports whose current approval step waits
+// for the current user or a validator they stand in for, directly or through one of their
+// groups, with the time the step has been waiting since and whether it is past the
+// approval SLA.
+func (h *Handlers) ListAwaitingApproval(c *gin.Context) {
+    userIDIfc, _ := c.Get(ContextUserIDKey)
+    userID := userIDIfc.(int64)
+    // Reports submitted before approval chains have no steps and wait for er.approver_id
+    rows, err := h.db.Query(`SELECT er.id, er.user_id, u.email, er.title, COALESCE(s.name, ?), er.created_at, `+stepWaitingSince+`
+        FROM expense_reports er
+        JOIN users u ON u.id = er.user_id
+        LEFT JOIN report_approval_steps s ON s.report_id = er.id AND s.status = ? AND s.position =
+            (SELECT MIN(p.position) FROM report_approval_steps p WHERE p.report_id = er.id AND p.status = ?)
+        WHERE er.status = ? AND (
+            s.approver_id IN (`+actingAs+`)
+            OR s.approver_group_id IN (SELECT group_id FROM user_groups WHERE user_id IN (`+actingAs+`))
+            OR s.escalated_group_id IN (SELECT group_id FROM user_groups WHERE user_id IN (`+actingAs+`))
+            OR (er.approver_id IN (`+actingAs+`) AND NOT EXISTS (SELECT 1 FROM report_approval_steps p WHERE p.report_id = er.id)))
+        ORDER BY er.id`, ApproverManager, StepPending, StepPending, StatusSubmitted, userID, userID, userID, userID, userID, userID, userID, userID)
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
+        return
+    }
+    defer rows.Close()
+    type reportOut struct {
+        ID           int64     `json:"id"`
+        UserID       int64     `json:"user_id"`
+        Email        string    `json:"email"`
+        Title        string    `json:"title"`
+        Step         string    `json:"step"`
+        CreatedAt    time.Time `json:"created_at"`
+        WaitingSince time.Time `json:"waiting_since"`
+        Overdue      bool      `json:"overdue"`
+    }
+    reports := []reportOut{}
+    deadline := time.Now().UTC().Add(-approvalSLA)
+    for rows.Next() {
+        var r reportOut
+        var waitingSince sqliteTime
+        if err := rows.Scan(&r.ID, &r.UserID, &r.Email, &r.Title, &r.Step, &r.CreatedAt, &waitingSince); err != nil {
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
+            return
+        }
+        r.WaitingSince = waitingSince.Time
+        r.Overdue = r.WaitingSince.Before(deadline)
+        reports = append(reports, r)
+    }
+    c.JSON(http.StatusOK, reports)
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// createValidator creates a user in the Validateurs group.
+func createValidator(t *testing.T, h *Handlers, email string) int64 {
+	id := createTestUser(t, h, email)
+	_, err := h.db.Exec("INSERT INTO user_groups (user_id, group_id) VALUES (?, 2)", id)
+	require.NoError(t, err)
+	return id
+}
+
+// createDraftReport creates a report through the API with one expense of amountHT before
+// 20% VAT, or no expense when amountHT is zero.
+func createDraftReport(t *testing.T, r *gin.Engine, key string, amountHT float64) int64 {
+	w := doAs(r, http.MethodPost, "/api/reports", `{"title":"Trip"}`, key)
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	var created struct {
+		ID int64 `json:"id"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &created))
+	if amountHT > 0 {
+		body := fmt.Sprintf(`{"description":"Hotel","expense_date":"2024-03-01","amount_ht":%g,"vat_rate":0.2}`, amountHT)
+		w = doAs(r, http.MethodPost, fmt.Sprintf("/api/reports/%d/items", created.ID), body, key)
+		require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	}
+	return created.ID
+}
+
+// submitReport submits a report through the API and returns the response.
+func submitReport(t *testing.T, r *gin.Engine, key string, reportID int64) map[string]interface{} {
+	w := doAs(r, http.MethodPost, fmt.Sprintf("/api/reports/%d/submit", reportID), "", key)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var out map[string]interface{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &out))
+	return out
+}
+
+// submitNewReport creates and submits a report without expenses.
+func submitNewReport(t *testing.T, r *gin.Engine, key string) (int64, map[string]interface{}) {
+	reportID := createDraftReport(t, r, key, 0)
+	return reportID, submitReport(t, r, key, reportID)
+}
+
+func TestSubmitRoutesToLineManager(t *testing.T) {
+	r, h := newReportRouter(t)
+	employee := createTestUser(t, h, "emp@example.com")
+	manager := createValidator(t, h, "manager@example.com")
+	director := createValidator(t, h, "director@example.com")
+	adminKey := issueAPIToken(t, h.db, "1")
+	setManager := func(userID, managerID int64) int {
+		return doAs(r, http.MethodPut, fmt.Sprintf("/api/admin/users/%d/manager", userID), fmt.Sprintf(`{"manager_id":%d}`, managerID), adminKey).Code
+	}
+	require.Equal(t, http.StatusOK, setManager(employee, manager))
+	require.Equal(t, http.StatusOK, setManager(manager, director))
+	assert.Equal(t, http.StatusBadRequest, setManager(director, employee))
+	assert.Equal(t, http.StatusBadRequest, setManager(employee, employee))
+
+	empKey := issueAPIToken(t, h.db, fmt.Sprint(employee))
+	managerKey := issueAPIToken(t, h.db, fmt.Sprint(manager))
+	directorKey := issueAPIToken(t, h.db, fmt.Sprint(director))
+	reportID, out := submitNewReport(t, r, empKey)
+	assert.EqualValues(t, manager, out["approver_id"])
+
+	w := doAs(r, http.MethodGet, "/api/approvals", "", managerKey)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"title":"Trip"`)
+	w = doAs(r, http.MethodGet, "/api/approvals", "", directorKey)
+	assert.JSONEq(t, `[]`, w.Body.String())
+
+	// Only the expected approver decides, besides global reviewers
+	assert.Equal(t, http.StatusForbidden, doAs(r, http.MethodPost, fmt.Sprintf("/api/admin/reports/%d/approve", reportID), "", directorKey).Code)
+	assert.Equal(t, http.StatusOK, doAs(r, http.MethodPost, fmt.Sprintf("/api/admin/reports/%d/approve", reportID), "", managerKey).Code)
+}
+
+func TestApprovalFallsBackUpTheChain(t *testing.T) {
+	r, h := newReportRouter(t)
+	employee := createTestUser(t, h, "emp@example.com")
+	lead := createTestUser(t, h, "lead@example.com") // cannot approve
+	manager := createValidator(t, h, "manager@example.com")
+	director := createValidator(t, h, "director@example.com")
+	_, err := h.db.Exec("UPDATE users SET manager_id = CASE id WHEN ? THEN ? WHEN ? THEN ? WHEN ? THEN ? END WHERE id IN (?, ?, ?)",
+		employee, lead, lead, manager, manager, director, employee, lead, manager)
+	require.NoError(t, err)
+	empKey := issueAPIToken(t, h.db, fmt.Sprint(employee))
+
+	_, out := submitNewReport(t, r, empKey)
+	assert.EqualValues(t, manager, out["approver_id"])
+
+	_, err = h.db.Exec("UPDATE users SET disabled_at = CURRENT_TIMESTAMP WHERE id = ?", manager)
+	require.NoError(t, err)
+	_, out = submitNewReport(t, r, empKey)
+	assert.EqualValues(t, director, out["approver_id"])
+
+	_, err = h.db.Exec("UPDATE users SET manager_id = NULL WHERE id = ?", employee)
+	require.NoError(t, err)
+	_, out = submitNewReport(t, r, empKey)
+	assert.NotContains(t, out, "approver_id")
+}
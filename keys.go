@@ -0,0 +1,322 @@
+package main
+
+import (
+    "crypto"
+    "crypto/ed25519"
+    "crypto/rsa"
+    "crypto/x509"
+    "encoding/base64"
+    "encoding/pem"
+    "errors"
+    "fmt"
+    "log"
+    "math/big"
+    "net/http"
+    "os"
+    "path/filepath"
+    "strings"
+
+    "github.com/gin-gonic/gin"
+    "github.com/golang-jwt/jwt/v5"
+    yaml "gopkg.in/yaml.v3"
+)
+
+// defaultJWTSecret is the insecure HMAC secret historically used when nothing was configured.
+// It is only accepted in development mode.
+const defaultJWTSecret = "secret"
+
+// jwtKeys is the key ring used to sign and verify JWTs. It is loaded at startup by LoadKeyRing.
+var jwtKeys *KeyRing
+
+// SigningKey is a key used to sign or verify JWTs, identified by the "kid" header.
+// Supported algorithms are HS256, RS256 and EdDSA (Ed25519).
+type SigningKey struct {
+    ID      string
+    Alg     string
+    secret  []byte
+    private crypto.Signer
+}
+
+// method returns the jwt signing method matching the key algorithm.
+func (k *SigningKey) method() jwt.SigningMethod {
+    switch k.Alg {
+    case "RS256":
+        return jwt.SigningMethodRS256
+    case "EdDSA":
+        return jwt.SigningMethodEdDSA
+    default:
+        return jwt.SigningMethodHS256
+    }
+}
+
+// signingKey returns the key material passed to jwt when signing.
+func (k *SigningKey) signingKey() interface{} {
+    if k.private != nil {
+        return k.private
+    }
+    return k.secret
+}
+
+// verificationKey returns the key material passed to jwt when verifying.
+func (k *SigningKey) verificationKey() interface{} {
+    if k.private != nil {
+        return k.private.Public()
+    }
+    return k.secret
+}
+
+// KeyRing holds the active JWT keys. Tokens are signed with a single signing key and
+// verified against any key of the ring, selected by the token's kid header.
+type KeyRing struct {
+    keys    map[string]*SigningKey
+    order   []string
+    signing *SigningKey
+}
+
+// NewKeyRing builds a key ring from active keys. signingKID selects the key used to sign
+// new tokens; when empty the first key is used.
+func NewKeyRing(keys []*SigningKey, signingKID string) (*KeyRing, error) {
+    if len(keys) == 0 {
+        return nil, errors.New("key ring has no active key")
+    }
+    kr := &KeyRing{keys: make(map[string]*SigningKey, len(keys))}
+    for _, k := range keys {
+        if k.ID == "" {
+            return nil, errors.New("key without kid")
+        }
+        if _, dup := kr.keys[k.ID]; dup {
+            return nil, fmt.Errorf("duplicate kid %q", k.ID)
+        }
+        kr.keys[k.ID] = k
+        kr.order = append(kr.order, k.ID)
+    }
+    if signingKID == "" {
+        signingKID = keys[0].ID
+    }
+    signing, ok := kr.keys[signingKID]
+    if !ok {
+        return nil, fmt.Errorf("signing key %q is not an active key", signingKID)
+    }
+    kr.signing = signing
+    return kr, nil
+}
+
+// Sign signs the claims with the current signing key and stamps the token with its kid.
+func (kr *KeyRing) Sign(claims jwt.Claims) (string, error) {
+    token := jwt.NewWithClaims(kr.signing.method(), claims)
+    token.Header["kid"] = kr.signing.ID
+    return token.SignedString(kr.signing.signingKey())
+}
+
+// Parse verifies a token against the key named by its kid header. Tokens without a kid,
+// signed by an unknown key or with an algorithm other than the key's are rejected.
+func (kr *KeyRing) Parse(tokenString string) (*jwt.Token, error) {
+    return jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+        kid, _ := token.Header["kid"].(string)
+        key, ok := kr.keys[kid]
+        if !ok {
+            return nil, fmt.Errorf("unknown signing key %q", kid)
+        }
+        if token.Method.Alg() != key.method().Alg() {
+            return nil, jwt.ErrTokenSignatureInvalid
+        }
+        return key.verificationKey(), nil
+    })
+}
+
+// JSONWebKey is the public part of an asymmetric signing key as published in the JWKS.
+type JSONWebKey struct {
+    Kty string `json:"kty"`
+    Kid string `json:"kid"`
+    Use string `json:"use"`
+    Alg string `json:"alg"`
+    N   string `json:"n,omitempty"`
+    E   string `json:"e,omitempty"`
+    Crv string `json:"crv,omitempty"`
+    X   string `json:"x,omitempty"`
+}
+
+// JWKS returns the public keys of the ring. HMAC keys are secret and never published.
+func (kr *KeyRing) JWKS() []JSONWebKey {
+    out := []JSONWebKey{}
+    for _, kid := range kr.order {
+        k := kr.keys[kid]
+        switch pub := k.verificationKey().(type) {
+        case *rsa.PublicKey:
+            out = append(out, JSONWebKey{
+                Kty: "RSA", Kid: k.ID, Use: "sig", Alg: k.Alg,
+                N: base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+                E: base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+            })
+        case ed25519.PublicKey:
+            out = append(out, JSONWebKey{
+                Kty: "OKP", Kid: k.ID, Use: "sig", Alg: k.Alg,
+                Crv: "Ed25519", X: base64.RawURLEncoding.EncodeToString(pub),
+            })
+        }
+    }
+    return out
+}
+
+// keyRingConfig is the layout of the key ring file.
+type keyRingConfig struct {
+    SigningKey string           `yaml:"signing_key"`
+    Keys       []keyConfigEntry `yaml:"keys"`
+}
+
+// keyConfigEntry describes one key of the key ring file. Asymmetric keys are read from a
+// PEM file (PKCS#8, or PKCS#1 for RSA) relative to the key ring file. HMAC secrets are
+// given inline or through an environment variable. Keys with active set to false are
+// ignored, which retires them: tokens they signed are no longer accepted.
+type keyConfigEntry struct {
+    Kid       string `yaml:"kid"`
+    Alg       string `yaml:"alg"`
+    File      string `yaml:"file"`
+    Secret    string `yaml:"secret"`
+    SecretEnv string `yaml:"secret_env"`
+    Active    *bool  `yaml:"active"`
+}
+
+// devMode reports whether the server runs in development mode (APP_ENV=development),
+// which allows insecure defaults such as the "secret" JWT key.
+func devMode() bool {
+    env := strings.ToLower(os.Getenv("APP_ENV"))
+    return env == "development" || env == "dev"
+}
+
+// LoadKeyRing loads the JWT key ring. Keys are read from the file named by JWT_KEYS_FILE,
+// or datadir/jwt_keys.yaml when it exists. Otherwise a single HS256 key is built from
+// JWT_SECRET. The default "secret" is refused outside development mode.
+func LoadKeyRing(datadir string) (*KeyRing, error) {
+    path := os.Getenv("JWT_KEYS_FILE")
+    if path == "" {
+        path = filepath.Join(datadir, "jwt_keys.yaml")
+        if _, err := os.Stat(path); err != nil {
+            path = ""
+        }
+    }
+    if path != "" {
+        return loadKeyRingFile(path)
+    }
+    secret := os.Getenv("JWT_SECRET")
+    if secret == "" {
+        if !devMode() {
+            return nil, errors.New("no JWT signing key configured: set JWT_SECRET or provide a key ring in JWT_KEYS_FILE (APP_ENV=development allows the insecure default)")
+        }
+        log.Printf("[WARN] JWT_SECRET is not set, signing tokens with the insecure default secret (development mode)")
+        secret = defaultJWTSecret
+    }
+    if err := checkHMACSecret(secret); err != nil {
+        return nil, err
+    }
+    return NewKeyRing([]*SigningKey{{ID: "default", Alg: "HS256", secret: []byte(secret)}}, "")
+}
+
+// checkHMACSecret refuses empty secrets, and the default secret outside development mode.
+func checkHMACSecret(secret string) error {
+    if secret == "" {
+        return errors.New("empty HMAC secret")
+    }
+    if secret == defaultJWTSecret && !devMode() {
+        return errors.New("refusing to use the default JWT secret outside development mode")
+    }
+    return nil
+}
+
+// loadKeyRingFile reads a key ring file and the key files it references.
+func loadKeyRingFile(path string) (*KeyRing, error) {
+    data, err := os.ReadFile(path)
+    if err != nil {
+        return nil, fmt.Errorf("read key ring %s: %w", path, err)
+    }
+    var cfg keyRingConfig
+    if err := yaml.Unmarshal(data, &cfg); err != nil {
+        return nil, fmt.Errorf("parse key ring %s: %w", path, err)
+    }
+    baseDir := filepath.Dir(path)
+    var keys []*SigningKey
+    for _, entry := range cfg.Keys {
+        if entry.Active != nil && !*entry.Active {
+            continue
+        }
+        key, err := loadSigningKey(entry, baseDir)
+        if err != nil {
+            return nil, fmt.Errorf("key %q: %w", entry.Kid, err)
+        }
+        keys = append(keys, key)
+    }
+    return NewKeyRing(keys, cfg.SigningKey)
+}
+
+// loadSigningKey builds a SigningKey from its configuration entry.
+func loadSigningKey(entry keyConfigEntry, baseDir string) (*SigningKey, error) {
+    key := &SigningKey{ID: entry.Kid, Alg: entry.Alg}
+    switch entry.Alg {
+    case "HS256":
+        secret := entry.Secret
+        if entry.SecretEnv != "" {
+            secret = os.Getenv(entry.SecretEnv)
+        }
+        if err := checkHMACSecret(secret); err != nil {
+            return nil, err
+        }
+        key.secret = []byte(secret)
+    case "RS256", "EdDSA":
+        file := entry.File
+        if file == "" {
+            return nil, errors.New("file is required for asymmetric keys")
+        }
+        if !filepath.IsAbs(file) {
+            file = filepath.Join(baseDir, file)
+        }
+        signer, err := readPrivateKey(file)
+        if err != nil {
+            return nil, err
+        }
+        switch signer.(type) {
+        case *rsa.PrivateKey:
+            if entry.Alg != "RS256" {
+                return nil, fmt.Errorf("%s holds an RSA key, expected %s", file, entry.Alg)
+            }
+        case ed25519.PrivateKey:
+            if entry.Alg != "EdDSA" {
+                return nil, fmt.Errorf("%s holds an Ed25519 key, expected %s", file, entry.Alg)
+            }
+        default:
+            return nil, fmt.Errorf("%s: unsupported key type %T", file, signer)
+        }
+        key.private = signer
+    default:
+        return nil, fmt.Errorf("unsupported algorithm %q", entry.Alg)
+    }
+    return key, nil
+}
+
+// readPrivateKey parses a PEM encoded PKCS#8 or PKCS#1 private key.
+func readPrivateKey(path string) (crypto.Signer, error) {
+    data, err := os.ReadFile(path)
+    if err != nil {
+        return nil, fmt.Errorf("read key file: %w", err)
+    }
+    block, _ := pem.Decode(data)
+    if block == nil {
+        return nil, fmt.Errorf("%s: no PEM block found", path)
+    }
+    if block.Type == "RSA PRIVATE KEY" {
+        return x509.ParsePKCS1PrivateKey(block.Bytes)
+    }
+    parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+    if err != nil {
+        return nil, fmt.Errorf("%s: %w", path, err)
+    }
+    signer, ok := parsed.(crypto.Signer)
+    if !ok {
+        return nil, fmt.Errorf("%s: unsupported key type %T", path, parsed)
+    }
+    return signer, nil
+}
+
+// JWKS publishes the public signing keys so that other services can verify our tokens.
+func (h *Handlers) JWKS(c *gin.Context) {
+    c.JSON(http.StatusOK, gin.H{"keys": jwtKeys.JWKS()})
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestMain installs an HMAC key ring so that tests can issue and verify tokens.
+func TestMain(m *testing.M) {
+	keys, err := NewKeyRing([]*SigningKey{{ID: "test", Alg: "HS256", secret: []byte("test-secret")}}, "")
+	if err != nil {
+		panic(err)
+	}
+	jwtKeys = keys
+	// The seeded admin has no second factor; MFA policy tests turn enforcement back on
+	mfaEnforced = false
+	os.Exit(m.Run())
+}
+
+func writePEM(t *testing.T, dir, name string, key interface{}) {
+	t.Helper()
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	require.NoError(t, err)
+	data := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	require.NoError(t, os.WriteFile(filepath.Join(dir, name), data, 0o600))
+}
+
+func writeKeyRing(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	writePEM(t, dir, "ed.pem", edKey)
+	writePEM(t, dir, "rsa.pem", rsaKey)
+	cfg := `signing_key: ed-2024
+keys:
+  - kid: ed-2024
+    alg: EdDSA
+    file: ed.pem
+  - kid: rsa-2023
+    alg: RS256
+    file: rsa.pem
+  - kid: hmac-old
+    alg: HS256
+    secret: old-secret
+    active: false
+`
+	path := filepath.Join(dir, "jwt_keys.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(cfg), 0o600))
+	return path
+}
+
+func TestKeyRingSignsWithKid(t *testing.T) {
+	kr, err := loadKeyRingFile(writeKeyRing(t))
+	require.NoError(t, err)
+
+	signed, err := kr.Sign(jwt.MapClaims{"sub": 1, "exp": time.Now().Add(time.Minute).Unix()})
+	require.NoError(t, err)
+	token, err := kr.Parse(signed)
+	require.NoError(t, err)
+	assert.Equal(t, "ed-2024", token.Header["kid"])
+	assert.Equal(t, "EdDSA", token.Method.Alg())
+}
+
+func TestKeyRingVerifiesAnyActiveKey(t *testing.T) {
+	kr, err := loadKeyRingFile(writeKeyRing(t))
+	require.NoError(t, err)
+
+	// A token signed by the non-signing RSA key is still accepted
+	rsaToken := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{"sub": 1})
+	rsaToken.Header["kid"] = "rsa-2023"
+	signed, err := rsaToken.SignedString(kr.keys["rsa-2023"].signingKey())
+	require.NoError(t, err)
+	_, err = kr.Parse(signed)
+	assert.NoError(t, err)
+
+	// Retired keys are not part of the ring
+	oldToken := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"sub": 1})
+	oldToken.Header["kid"] = "hmac-old"
+	signed, err = oldToken.SignedString([]byte("old-secret"))
+	require.NoError(t, err)
+	_, err = kr.Parse(signed)
+	assert.Error(t, err)
+
+	// Tokens without kid are rejected
+	noKid := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{"sub": 1})
+	signed, err = noKid.SignedString(kr.keys["rsa-2023"].signingKey())
+	require.NoError(t, err)
+	_, err = kr.Parse(signed)
+	assert.Error(t, err)
+}
+
+func TestKeyRingJWKSPublishesOnlyPublicKeys(t *testing.T) {
+	kr, err := loadKeyRingFile(writeKeyRing(t))
+	require.NoError(t, err)
+	jwks := kr.JWKS()
+	require.Len(t, jwks, 2)
+	assert.Equal(t, "OKP", jwks[0].Kty)
+	assert.Equal(t, "ed-2024", jwks[0].Kid)
+	assert.Equal(t, "RSA", jwks[1].Kty)
+	assert.Equal(t, "AQAB", jwks[1].E)
+}
+
+func TestLoadKeyRingRefusesDefaultSecret(t *testing.T) {
+	t.Setenv("JWT_KEYS_FILE", "")
+	t.Setenv("APP_ENV", "")
+	t.Setenv("JWT_SECRET", "")
+	_, err := LoadKeyRing(t.TempDir())
+	assert.Error(t, err)
+
+	t.Setenv("JWT_SECRET", "secret")
+	_, err = LoadKeyRing(t.TempDir())
+	assert.Error(t, err)
+
+	t.Setenv("APP_ENV", "development")
+	_, err = LoadKeyRing(t.TempDir())
+	assert.NoError(t, err)
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+    "crypto/tls"
+    "database/sql"
+    "errors"
+    "fmt"
+    "log"
+    "os"
+    "strings"
+    "time"
+
+    "github.com/go-ldap/ldap/v3"
+)
+
+// ErrLDAPUserNotFound is returned when no directory entry matches a login.
+var ErrLDAPUserNotFound = errors.New("user not found in directory")
+
+// LDAPConfig holds the settings of the LDAP / Active Directory integration.
+type LDAPConfig struct {
+    URL            string
+    StartTLS       bool
+    BindDN         string
+    BindPassword   string
+    BaseDN         string
+    UserFilter     string
+    EmailAttribute string
+    IDAttribute    string
+    GroupAttribute string
+    GroupMapping   GroupMapping
+    SyncInterval   time.Duration
+}
+
+// LoadLDAPConfig reads the directory settings from the environment. It returns nil when
+// LDAP_URL is not set, which disables directory authentication.
+func LoadLDAPConfig() *LDAPConfig {
+    url := os.Getenv("LDAP_URL")
+    if url == "" {
+        return nil
+    }
+    cfg := &LDAPConfig{
+        URL:            url,
+        StartTLS:       os.Getenv("LDAP_START_TLS") == "true",
+        BindDN:         os.Getenv("LDAP_BIND_DN"),
+        BindPassword:   os.Getenv("LDAP_BIND_PASSWORD"),
+        BaseDN:         os.Getenv("LDAP_BASE_DN"),
+        UserFilter:     "(mail=%s)",
+        EmailAttribute: "mail",
+        IDAttribute:    os.Getenv("LDAP_ID_ATTRIBUTE"),
+        GroupAttribute: "memberOf",
+        GroupMapping:   parseGroupMapping(os.Getenv("LDAP_GROUP_MAPPING")),
+    }
+    // 0 disables the periodic sync, which durationFromEnv would reject as invalid
+    if os.Getenv("LDAP_SYNC_INTERVAL") != "0" {
+        cfg.SyncInterval = durationFromEnv("LDAP_SYNC_INTERVAL", time.Hour)
+    }
+    if v := os.Getenv("LDAP_USER_FILTER"); v != "" {
+        cfg.UserFilter = v
+    }
+    if v := os.Getenv("LDAP_EMAIL_ATTRIBUTE"); v != "" {
+        cfg.EmailAttribute = v
+    }
+    if v := os.Getenv("LDAP_GROUP_ATTRIBUTE"); v != "" {
+        cfg.GroupAttribute = v
+    }
+    return cfg
+}
+
+// DirectoryUser is a user entry read from the directory.
+type DirectoryUser struct {
+    DN     string
+    ID     string
+    Email  string
+    Groups []string
+}
+
+// LDAPDirectory authenticates users against an LDAP server. Users are located with a
+// search made under the service account, then authenticated by binding as their entry.
+type LDAPDirectory struct {
+    cfg *LDAPConfig
+}
+
+// NewLDAPDirectory returns a directory client for the given configuration.
+func NewLDAPDirectory(cfg *LDAPConfig) *LDAPDirectory {
+    return &LDAPDirectory{cfg: cfg}
+}
+
+// connect opens a connection and binds as the service account. An empty bind DN performs
+// the searches anonymously.
+func (d *LDAPDirectory) connect() (*ldap.Conn, error) {
+    conn, err := ldap.DialURL(d.cfg.URL)
+    if err != nil {
+        return nil, fmt.Errorf("dial %s: %w", d.cfg.URL, err)
+    }
+    if d.cfg.StartTLS {
+        host := d.cfg.URL
+        if i := strings.Index(host, "://"); i >= 0 {
+            host = host[i+3:]
+        }
+        if i := strings.LastIndex(host, ":"); i >= 0 {
+            host = host[:i]
+        }
+        if err := conn.StartTLS(&tls.Config{ServerName: host}); err != nil {
+            conn.Close()
+            return nil, fmt.Errorf("start TLS: %w", err)
+        }
+    }
+    if d.cfg.BindDN != "" {
+        if err := conn.Bind(d.cfg.BindDN, d.cfg.BindPassword); err != nil {
+            conn.Close()
+            return nil, fmt.Errorf("service bind: %w", err)
+        }
+    }
+    return conn, nil
+}
+
+// search returns the single entry matching filter under the base DN.
+func (d *LDAPDirectory) search(conn *ldap.Conn, filter string) (*DirectoryUser, error) {
+    attributes := []string{d.cfg.EmailAttribute, d.cfg.GroupAttribute}
+    if d.cfg.IDAttribute != "" {
+        attributes = append(attributes, d.cfg.IDAttribute)
+    }
+    res, err := conn.Search(ldap.NewSearchRequest(
+        d.cfg.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, 0, false,
+        filter, attributes, nil,
+    ))
+    if err != nil {
+        return nil, fmt.Errorf("search %s: %w", filter, err)
+    }
+    if len(res.Entries) == 0 {
+        return nil, ErrLDAPUserNotFound
+    }
+    if len(res.Entries) > 1 {
+        return nil, fmt.Errorf("search %s: several entries match", filter)
+    }
+    entry := res.Entries[0]
+    user := &DirectoryUser{
+        DN:     entry.DN,
+        ID:     entry.DN,
+        Email:  entry.GetAttributeValue(d.cfg.EmailAttribute),
+        Groups: entry.GetAttributeValues(d.cfg.GroupAttribute),
+    }
+    // Distinguished names change when entries move, a stable attribute is preferred
+    if d.cfg.IDAttribute != "" {
+        if id := entry.GetAttributeValue(d.cfg.IDAttribute); id != "" {
+            user.ID = id
+        }
+    }
+    return user, nil
+}
+
+// Authenticate checks the credentials of a login against the directory and returns the
+// user entry. Empty passwords are refused: LDAP treats them as anonymous binds.
+func (d *LDAPDirectory) Authenticate(login, password string) (*DirectoryUser, error) {
+    if password == "" {
+        return nil, ErrInvalidCredentials
+    }
+    conn, err := d.connect()
+    if err != nil {
+        return nil, err
+    }
+    defer conn.Close()
+    user, err := d.search(conn, fmt.Sprintf(d.cfg.UserFilter, ldap.EscapeFilter(login)))
+    if errors.Is(err, ErrLDAPUserNotFound) {
+        return nil, ErrInvalidCredentials
+    } else if err != nil {
+        return nil, err
+    }
+    if err := conn.Bind(user.DN, password); err != nil {
+        if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+            return nil, ErrInvalidCredentials
+        }
+        return nil, fmt.Errorf("user bind: %w", err)
+    }
+    if user.Email == "" {
+        user.Email = login
+    }
+    return user, nil
+}
+
+// loginLDAP authenticates a login against the directory, provisions the local account on
+// first login and aligns its mapped groups with the directory.
+func (h *Handlers) loginLDAP(login, password string) (*User, error) {
+    entry, err := h.ldap.Authenticate(login, password)
+    if err != nil {
+        return nil, err
+    }
+    tx, err := h.db.Begin()
+    if err != nil {
+        return nil, err
+    }
+    defer tx.Rollback()
+    userID, err := provisionExternalUser(tx, AuthSourceLDAP, entry.ID, entry.Email)
+    if err != nil {
+        return nil, err
+    }
+    if err := syncMappedGroups(tx, userID, h.ldap.cfg.GroupMapping, entry.Groups); err != nil {
+        return nil, err
+    }
+    if err := tx.Commit(); err != nil {
+        return nil, err
+    }
+    invalidateUserPermissions(h.db, userID)
+    return &User{ID: userID, Email: entry.Email, AuthSource: AuthSourceLDAP}, nil
+}
+
+// SyncGroups refreshes the mapped group memberships of every directory account. Accounts
+// are found by their stable ID when IDAttribute is set, by email otherwise; those that no
+// longer exist in the directory lose their mapped groups. An account that cannot be looked
+// up is skipped.
+func (d *LDAPDirectory) SyncGroups(db *sql.DB) error {
+    rows, err := db.Query("SELECT id, email, external_id FROM users WHERE auth_source = ?", AuthSourceLDAP)
+    if err != nil {
+        return fmt.Errorf("list directory users: %w", err)
+    }
+    type account struct {
+        id         int64
+        email      string
+        externalID sql.NullString
+    }
+    var accounts []account
+    for rows.Next() {
+        var a account
+        if err := rows.Scan(&a.id, &a.email, &a.externalID); err != nil {
+            rows.Close()
+            return err
+        }
+        accounts = append(accounts, a)
+    }
+    rows.Close()
+    if len(accounts) == 0 {
+        return nil
+    }
+    conn, err := d.connect()
+    if err != nil {
+        return err
+    }
+    defer conn.Close()
+    for _, a := range accounts {
+        // Emails change in the directory, the stable ID does not
+        filter := fmt.Sprintf("(%s=%s)", ldap.EscapeFilter(d.cfg.EmailAttribute), ldap.EscapeFilter(a.email))
+        if d.cfg.IDAttribute != "" && a.externalID.Valid {
+            filter = fmt.Sprintf("(%s=%s)", ldap.EscapeFilter(d.cfg.IDAttribute), ldap.EscapeFilter(a.externalID.String))
+        }
+        entry, err := d.search(conn, filter)
+        var groups []string
+        if err == nil {
+            groups = entry.Groups
+        } else if errors.Is(err, ErrLDAPUserNotFound) {
+            log.Printf("[WARN] directory user %s no longer exists, removing mapped groups", a.email)
+        } else {
+            log.Printf("[WARN] cannot sync the groups of directory user %s: %v", a.email, err)
+            continue
+        }
+        tx, err := db.Begin()
+        if err != nil {
+            return err
+        }
+        if err := syncMappedGroups(tx, a.id, d.cfg.GroupMapping, groups); err != nil {
+            tx.Rollback()
+            return err
+        }
+        if err := tx.Commit(); err != nil {
+            return err
+        }
+        invalidateUserPermissions(db, a.id)
+    }
+    return nil
+}
+
+// StartGroupSync runs SyncGroups every SyncInterval in the background. A zero interval
+// disables the periodic sync; groups are then only refreshed at login.
+func (d *LDAPDirectory) StartGroupSync(db *sql.DB) {
+    if d.cfg.SyncInterval <= 0 {
+        return
+    }
+    go func() {
+        ticker := time.NewTicker(d.cfg.SyncInterval)
+        defer ticker.Stop()
+        for range ticker.C {
+            if err := d.SyncGroups(db); err != nil {
+                log.Printf("[WARN] directory group sync failed: %v", err)
+            }
+        }
+    }()
+}
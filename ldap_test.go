@@ -0,0 +1,283 @@
+package main
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// LDAP protocol operations handled by the stub server.
+const (
+	ldapBindRequest   = 0
+	ldapBindResponse  = 1
+	ldapUnbindRequest = 2
+	ldapSearchRequest = 3
+	ldapSearchEntry   = 4
+	ldapSearchDone    = 5
+)
+
+type stubEntry struct {
+	dn       string
+	password string
+	attrs    map[string][]string
+}
+
+// stubLDAPServer is a minimal in-process LDAP server. It supports simple binds and
+// searches with equality filters, which is all the directory client needs.
+type stubLDAPServer struct {
+	t        *testing.T
+	listener net.Listener
+
+	mu      sync.Mutex
+	entries []*stubEntry
+}
+
+func newStubLDAPServer(t *testing.T) *stubLDAPServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s := &stubLDAPServer{t: t, listener: l}
+	s.add("cn=svc,dc=example,dc=com", "svc-secret", nil)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	t.Cleanup(func() { l.Close() })
+	return s
+}
+
+func (s *stubLDAPServer) url() string {
+	return "ldap://" + s.listener.Addr().String()
+}
+
+func (s *stubLDAPServer) add(dn, password string, attrs map[string][]string) *stubEntry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e := &stubEntry{dn: dn, password: password, attrs: attrs}
+	s.entries = append(s.entries, e)
+	return e
+}
+
+func (s *stubLDAPServer) setGroups(dn string, groups ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, e := range s.entries {
+		if e.dn == dn {
+			e.attrs["memberOf"] = groups
+		}
+	}
+}
+
+func (s *stubLDAPServer) remove(dn string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, e := range s.entries {
+		if e.dn == dn {
+			s.entries = append(s.entries[:i], s.entries[i+1:]...)
+			return
+		}
+	}
+}
+
+func (s *stubLDAPServer) serve(conn net.Conn) {
+	defer conn.Close()
+	for {
+		packet, err := ber.ReadPacket(conn)
+		if err != nil || len(packet.Children) < 2 {
+			return
+		}
+		id := packet.Children[0].Value.(int64)
+		op := packet.Children[1]
+		switch op.Tag {
+		case ldapBindRequest:
+			dn := op.Children[1].Data.String()
+			password := op.Children[2].Data.String()
+			code := int64(49) // invalidCredentials
+			s.mu.Lock()
+			for _, e := range s.entries {
+				if e.dn == dn && e.password != "" && e.password == password {
+					code = 0
+				}
+			}
+			s.mu.Unlock()
+			conn.Write(ldapResult(id, ldapBindResponse, code).Bytes())
+		case ldapSearchRequest:
+			attr, value := equalityFilter(op.Children[6])
+			s.mu.Lock()
+			for _, e := range s.entries {
+				for _, v := range e.attrs[attr] {
+					if strings.EqualFold(v, value) {
+						conn.Write(searchEntry(id, e).Bytes())
+						break
+					}
+				}
+			}
+			s.mu.Unlock()
+			conn.Write(ldapResult(id, ldapSearchDone, 0).Bytes())
+		case ldapUnbindRequest:
+			return
+		}
+	}
+}
+
+// equalityFilter decodes an (attr=value) filter.
+func equalityFilter(filter *ber.Packet) (string, string) {
+	if filter.Tag != 3 || len(filter.Children) != 2 {
+		return "", ""
+	}
+	return filter.Children[0].Data.String(), filter.Children[1].Data.String()
+}
+
+func ldapEnvelope(id int64, op *ber.Packet) *ber.Packet {
+	msg := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Response")
+	msg.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, "MessageID"))
+	msg.AppendChild(op)
+	return msg
+}
+
+func ldapResult(id int64, tag ber.Tag, code int64) *ber.Packet {
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "Result")
+	op.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, code, "resultCode"))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "matchedDN"))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "diagnosticMessage"))
+	return ldapEnvelope(id, op)
+}
+
+func searchEntry(id int64, e *stubEntry) *ber.Packet {
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldapSearchEntry, nil, "SearchResultEntry")
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, e.dn, "objectName"))
+	attrs := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "attributes")
+	for name, values := range e.attrs {
+		attr := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "attribute")
+		attr.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, name, "type"))
+		vals := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "vals")
+		for _, v := range values {
+			vals.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, v, "value"))
+		}
+		attr.AppendChild(vals)
+		attrs.AppendChild(attr)
+	}
+	op.AppendChild(attrs)
+	return ldapEnvelope(id, op)
+}
+
+const financeGroupDN = "cn=finance,ou=groups,dc=example,dc=com"
+
+func newLDAPHandlers(t *testing.T, server *stubLDAPServer) *Handlers {
+	h := NewHandlers(newTestDB(t), t.TempDir())
+	h.ldap = NewLDAPDirectory(&LDAPConfig{
+		URL:            server.url(),
+		BindDN:         "cn=svc,dc=example,dc=com",
+		BindPassword:   "svc-secret",
+		BaseDN:         "dc=example,dc=com",
+		UserFilter:     "(mail=%s)",
+		EmailAttribute: "mail",
+		GroupAttribute: "memberOf",
+		GroupMapping:   parseGroupMapping(financeGroupDN + "=Validateurs"),
+	})
+	return h
+}
+
+func TestLDAPLoginProvisionsDirectoryUser(t *testing.T) {
+	server := newStubLDAPServer(t)
+	server.add("uid=bob,ou=people,dc=example,dc=com", "bob-pass", map[string][]string{
+		"mail":     {"bob@example.com"},
+		"memberOf": {financeGroupDN},
+	})
+	h := newLDAPHandlers(t, server)
+	r := newTestRouter(h.db, PermUsersRead)
+	r.POST("/api/auth/login", h.Login)
+
+	w := postJSON(r, "/api/auth/login", `{"email":"bob@example.com","password":"wrong"}`, "")
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	w = postJSON(r, "/api/auth/login", `{"email":"bob@example.com","password":""}`, "")
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	w = postJSON(r, "/api/auth/login", `{"email":"bob@example.com","password":"bob-pass"}`, "")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var source, hash, externalID string
+	require.NoError(t, h.db.QueryRow("SELECT auth_source, password_hash, external_id FROM users WHERE email = ?", "bob@example.com").Scan(&source, &hash, &externalID))
+	assert.Equal(t, AuthSourceLDAP, source)
+	assert.Empty(t, hash)
+	assert.Equal(t, "uid=bob,ou=people,dc=example,dc=com", externalID)
+	assert.Equal(t, []string{"Validateurs"}, userGroupNames(t, h.db, "bob@example.com"))
+
+	// Local accounts keep using their bcrypt password
+	w = postJSON(r, "/api/auth/login", `{"email":"admin@example.com","password":"admin"}`, "")
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestLDAPGroupSync(t *testing.T) {
+	server := newStubLDAPServer(t)
+	bob := "uid=bob,ou=people,dc=example,dc=com"
+	server.add(bob, "bob-pass", map[string][]string{"mail": {"bob@example.com"}})
+	h := newLDAPHandlers(t, server)
+	_, err := h.authenticate("bob@example.com", "bob-pass")
+	require.NoError(t, err)
+	assert.Empty(t, userGroupNames(t, h.db, "bob@example.com"))
+
+	server.setGroups(bob, financeGroupDN)
+	require.NoError(t, h.ldap.SyncGroups(h.db))
+	assert.Equal(t, []string{"Validateurs"}, userGroupNames(t, h.db, "bob@example.com"))
+
+	server.remove(bob)
+	require.NoError(t, h.ldap.SyncGroups(h.db))
+	assert.Empty(t, userGroupNames(t, h.db, "bob@example.com"))
+}
+
+func TestLoadLDAPConfigSyncInterval(t *testing.T) {
+	t.Setenv("LDAP_URL", "ldap://127.0.0.1:389")
+	var logs strings.Builder
+	log.SetOutput(&logs)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	assert.Equal(t, time.Hour, LoadLDAPConfig().SyncInterval)
+	t.Setenv("LDAP_SYNC_INTERVAL", "15m")
+	assert.Equal(t, 15*time.Minute, LoadLDAPConfig().SyncInterval)
+	// 0 disables the sync without a warning
+	t.Setenv("LDAP_SYNC_INTERVAL", "0")
+	assert.Zero(t, LoadLDAPConfig().SyncInterval)
+	assert.Empty(t, logs.String())
+}
+
+func TestLDAPGroupSyncFindsUsersByID(t *testing.T) {
+	server := newStubLDAPServer(t)
+	bob := server.add("uid=bob,ou=people,dc=example,dc=com", "bob-pass", map[string][]string{
+		"mail": {"bob@example.com"}, "entryUUID": {"uuid-bob"}, "memberOf": {financeGroupDN},
+	})
+	server.add("uid=carol,ou=people,dc=example,dc=com", "carol-pass", map[string][]string{
+		"mail": {"carol@example.com"}, "entryUUID": {"uuid-carol"}, "memberOf": {financeGroupDN},
+	})
+	dave := "uid=dave,ou=people,dc=example,dc=com"
+	server.add(dave, "dave-pass", map[string][]string{"mail": {"dave@example.com"}, "entryUUID": {"uuid-dave"}})
+	h := newLDAPHandlers(t, server)
+	h.ldap.cfg.IDAttribute = "entryUUID"
+	for _, login := range []string{"bob", "carol", "dave"} {
+		_, err := h.authenticate(login+"@example.com", login+"-pass")
+		require.NoError(t, err)
+	}
+
+	// Bob's address changes, and a duplicate entry makes Carol ambiguous
+	server.mu.Lock()
+	bob.attrs["mail"] = []string{"robert@example.com"}
+	server.mu.Unlock()
+	server.add("uid=carol2,ou=people,dc=example,dc=com", "", map[string][]string{"entryUUID": {"uuid-carol"}})
+	server.setGroups(dave, financeGroupDN)
+	require.NoError(t, h.ldap.SyncGroups(h.db))
+	assert.Equal(t, []string{"Validateurs"}, userGroupNames(t, h.db, "bob@example.com"))
+	assert.Equal(t, []string{"Validateurs"}, userGroupNames(t, h.db, "carol@example.com"))
+	assert.Equal(t, []string{"Validateurs"}, userGroupNames(t, h.db, "dave@example.com"))
+}
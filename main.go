@@ -21,9 +21,16 @@ func main() {
     if err := os.MkdirAll(datadir, 0o755); err != nil {
         log.Fatalf("failed to create data dir: %v", err)
     }
+    // Load the JWT key ring; refuses insecure defaults outside development mode
+    keys, err := LoadKeyRing(datadir)
+    if err != nil {
+        log.Fatalf("failed to load JWT keys: %v", err)
+    }
+    jwtKeys = keys
     // Connect to SQLite database stored in datadir
     dbPath := filepath.Join(datadir, "expense.db")
-    db, err := sql.Open("sqlite3", dbPath)
+    // Foreign keys are enabled on every pooled connection so that deletes cascade
+    db, err := sql.Open("sqlite3", dbPath+"?_foreign_keys=on")
     if err != nil {
         log.Fatalf("failed to open database: %v", err)
     }
@@ -34,18 +41,62 @@ func main() {
     }
     // Create handlers
     handlers := NewHandlers(db, datadir)
+    if cfg := LoadOIDCConfig(); cfg != nil {
+        handlers.oidc = NewOIDCProvider(cfg)
+        log.Printf("Single sign-on enabled with issuer %s", cfg.Issuer)
+    }
+    if cfg := LoadLDAPConfig(); cfg != nil {
+        handlers.ldap = NewLDAPDirectory(cfg)
+        handlers.ldap.StartGroupSync(db)
+        log.Printf("Directory authentication enabled with %s", cfg.URL)
+    }
+    StartEscalationScheduler(db)
     r := gin.Default()
+    // Client addresses are used to throttle logins; only trust forwarding headers set by
+    // known reverse proxies
+    if err := r.SetTrustedProxies(trustedProxies()); err != nil {
+        log.Fatalf("invalid TRUSTED_PROXIES: %v", err)
+    }
     // Public routes
     r.POST("/api/auth/login", handlers.Login)
+    r.POST("/api/auth/refresh", handlers.Refresh)
+    r.POST("/api/auth/mfa/verify", handlers.VerifyMFA)
+    r.POST("/api/auth/password/reset", handlers.ResetPassword)
+    r.GET("/api/auth/jwks.json", handlers.JWKS)
+    r.GET("/api/auth/providers", handlers.AuthProviders)
+    r.GET("/api/auth/oidc/login", handlers.OIDCLogin)
+    r.GET("/api/auth/oidc/callback", handlers.OIDCCallback)
     // Protected routes with authentication
     api := r.Group("/api")
     api.Use(AuthMiddleware(db))
     {
+        api.POST("/auth/logout", handlers.Logout)
+        // Open to accounts flagged for a password change, which RequirePermission blocks
+        api.POST("/auth/password", handlers.ChangePassword)
+        // MFA enrollment is open to every authenticated user, including those the
+        // MFA policy currently blocks
+        api.POST("/auth/mfa/enroll", handlers.EnrollMFA)
+        api.POST("/auth/mfa/confirm", handlers.ConfirmMFA)
+        api.POST("/auth/mfa/recovery-codes", handlers.RegenerateRecoveryCodes)
+        // Notifications
+        api.GET("/notifications", handlers.ListNotifications)
+        api.POST("/notifications/:id/read", handlers.MarkNotificationRead)
         // Reports
         api.POST("/reports", RequirePermission(db, PermReportsCreate), handlers.CreateReport)
         api.POST("/reports/:id/submit", RequirePermission(db, PermReportsUpdateOwn), handlers.SubmitReport)
+        api.POST("/reports/:id/reopen", RequirePermission(db, PermReportsUpdateOwn), handlers.ReopenReport)
+        api.POST("/reports/:id/withdraw", RequirePermission(db, PermReportsUpdateOwn), handlers.WithdrawReport)
         api.DELETE("/reports/:id", RequirePermission(db, PermReportsUpdateOwn), handlers.DeleteReport)
         api.GET("/reports", RequirePermission(db, PermReportsReadOwn), handlers.ListOwnReports)
+        api.GET("/principals", RequirePermission(db, PermReportsCreate), handlers.ListPrincipals)
+        api.GET("/reports/:id/steps", RequirePermission(db, PermReportsReadOwn), handlers.ListApprovalSteps)
+        api.GET("/reports/:id/comments", RequireAnyPermission(db, PermReportsReadOwn, PermReportsReadAll, PermReportsReadScoped), handlers.ListReportComments)
+        api.POST("/reports/:id/comments", RequireAnyPermission(db, PermReportsReadOwn, PermReportsReadAll, PermReportsReadScoped), handlers.AddReportComment)
+        api.GET("/reports/:id/timeline", RequireAnyPermission(db, PermReportsReadOwn, PermReportsReadAll, PermReportsReadScoped), handlers.GetReportTimeline)
+        api.GET("/approvals", RequirePermission(db, PermReportsApprove), handlers.ListAwaitingApproval)
+        api.GET("/delegations", RequirePermission(db, PermReportsApprove), handlers.ListDelegations)
+        api.POST("/delegations", RequirePermission(db, PermReportsApprove), handlers.CreateDelegation)
+        api.DELETE("/delegations/:id", RequirePermission(db, PermReportsApprove), handlers.DeleteDelegation)
         // Items
         api.POST("/reports/:id/items", RequirePermission(db, PermReportsCreate), handlers.AddItem)
         api.PUT("/items/:id", RequirePermission(db, PermReportsUpdateOwn), handlers.UpdateItem)
@@ -54,15 +105,48 @@ func main() {
         // Admin sub routes
         admin := api.Group("/admin")
         {
-            admin.GET("/reports", RequirePermission(db, PermReportsReadAll), handlers.AdminListReports)
+            admin.GET("/reports", RequireAnyPermission(db, PermReportsReadAll, PermReportsReadScoped), handlers.AdminListReports)
             admin.POST("/reports/:id/approve", RequirePermission(db, PermReportsApprove), handlers.ApproveReport)
             admin.POST("/reports/:id/reject", RequirePermission(db, PermReportsReject), handlers.RejectReport)
+            admin.POST("/reports/bulk-approve", RequirePermission(db, PermReportsApprove), handlers.BulkApproveReports)
+            admin.POST("/reports/bulk-reject", RequirePermission(db, PermReportsReject), handlers.BulkRejectReports)
+            admin.GET("/audit/approvals", RequirePermission(db, PermAuditRead), handlers.ListApprovalAudit)
+            admin.GET("/approvals/overdue", RequireAnyPermission(db, PermReportsReadAll, PermReportsApprove), handlers.ListOverdueApprovals)
+            admin.GET("/payments/pending", RequirePermission(db, PermReportsPay), handlers.ListPendingPayments)
+            admin.GET("/payment-batches", RequirePermission(db, PermReportsPay), handlers.ListPaymentBatches)
+            admin.POST("/payment-batches", RequirePermission(db, PermReportsPay), handlers.CreatePaymentBatch)
+            admin.GET("/payment-batches/:id", RequirePermission(db, PermReportsPay), handlers.GetPaymentBatch)
+            admin.DELETE("/payment-batches/:id", RequirePermission(db, PermReportsPay), handlers.DeletePaymentBatch)
+            admin.POST("/payment-batches/:id/pay", RequirePermission(db, PermReportsPay), handlers.PayBatch)
             admin.GET("/users", RequirePermission(db, PermUsersRead), handlers.ListUsers)
             admin.POST("/users", RequirePermission(db, PermUsersCreate), handlers.CreateUser)
+            admin.PUT("/users/:id", RequirePermission(db, PermUsersUpdate), handlers.UpdateUser)
+            admin.DELETE("/users/:id", RequirePermission(db, PermUsersDelete), handlers.DeleteUser)
+            admin.POST("/users/:id/deactivate", RequirePermission(db, PermUsersUpdate), handlers.DeactivateUser)
+            admin.POST("/users/:id/reactivate", RequirePermission(db, PermUsersUpdate), handlers.ReactivateUser)
+            admin.PUT("/users/:id/manager", RequirePermission(db, PermUsersUpdate), handlers.SetManager)
+            admin.GET("/users/:id/scope", RequirePermission(db, PermUsersRead), handlers.ListValidatorScope)
+            admin.PUT("/users/:id/scope", RequirePermission(db, PermUsersUpdate), handlers.SetValidatorScope)
+            admin.GET("/users/:id/proxies", RequirePermission(db, PermUsersRead), handlers.ListProxies)
+            admin.PUT("/users/:id/proxies", RequirePermission(db, PermUsersUpdate), handlers.SetProxies)
+            admin.POST("/users/:id/groups", RequirePermission(db, PermUsersUpdate), handlers.AddUserToGroup)
+            admin.DELETE("/users/:id/groups/:group_id", RequirePermission(db, PermUsersUpdate), handlers.RemoveUserFromGroup)
+            admin.POST("/users/:id/unlock", RequirePermission(db, PermUsersUpdate), handlers.UnlockUser)
+            admin.POST("/users/:id/password-reset", RequirePermission(db, PermUsersUpdate), handlers.IssuePasswordReset)
             admin.GET("/groups", RequirePermission(db, PermGroupsRead), handlers.ListGroups)
             admin.POST("/groups", RequirePermission(db, PermGroupsCreate), handlers.CreateGroup)
+            admin.PUT("/groups/:id", RequirePermission(db, PermGroupsUpdate), handlers.RenameGroup)
+            admin.DELETE("/groups/:id", RequirePermission(db, PermGroupsDelete), handlers.DeleteGroup)
+            admin.GET("/groups/:id/permissions", RequirePermission(db, PermGroupsRead), handlers.ListGroupPermissions)
             admin.POST("/groups/:id/permissions", RequirePermission(db, PermPermissionsAssign), handlers.AssignPermissions)
+            admin.PUT("/groups/:id/permissions", RequirePermission(db, PermPermissionsAssign), handlers.ReplacePermissions)
+            admin.DELETE("/groups/:id/permissions/:permission_id", RequirePermission(db, PermPermissionsAssign), handlers.RevokePermission)
+            admin.GET("/permissions", RequirePermission(db, PermGroupsRead), handlers.ListPermissions)
             admin.POST("/users/:id/token", RequirePermission(db, PermTokensCreate), handlers.GenerateAPIToken)
+            admin.GET("/users/:id/tokens", RequirePermission(db, PermTokensRead), handlers.ListAPITokens)
+            admin.PUT("/tokens/:id", RequirePermission(db, PermTokensCreate), handlers.UpdateAPIToken)
+            admin.POST("/tokens/:id/revoke", RequirePermission(db, PermTokensRevoke), handlers.RevokeAPIToken)
+            admin.POST("/users/:id/sessions/revoke", RequirePermission(db, PermSessionsRevoke), handlers.RevokeUserSessions)
             admin.GET("/export/csv", RequirePermission(db, PermReportsExportAll), handlers.ExportCSV)
             admin.GET("/export/json", RequirePermission(db, PermReportsExportAll), handlers.ExportJSON)
             admin.GET("/export/yaml", RequirePermission(db, PermReportsExportAll), handlers.ExportYAML)
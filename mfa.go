@@ -0,0 +1,436 @@
+package main
+
+import (
+    "crypto/hmac"
+    "crypto/rand"
+    "crypto/sha1"
+    "database/sql"
+    "encoding/base32"
+    "encoding/binary"
+    "encoding/hex"
+    "errors"
+    "fmt"
+    "log"
+    "net/http"
+    "net/url"
+    "os"
+    "strings"
+    "time"
+
+    "github.com/gin-gonic/gin"
+)
+
+// TOTP parameters (RFC 6238). They match the defaults of authenticator apps.
+const (
+    totpPeriod = 30
+    totpDigits = 6
+    // totpSkew is the number of periods accepted before and after the current one, to
+    // tolerate clock drift between the server and the device.
+    totpSkew = 1
+)
+
+const (
+    // mfaChallengeTTL bounds the time between the password step and the second factor.
+    mfaChallengeTTL = 5 * time.Minute
+    // mfaMaxAttempts is the number of wrong codes accepted for one login challenge.
+    mfaMaxAttempts = 5
+    // recoveryCodeCount is the number of recovery codes issued at enrollment.
+    recoveryCodeCount = 10
+)
+
+// ErrMFAChallengeInvalid is returned for unknown, expired or exhausted login challenges.
+var ErrMFAChallengeInvalid = errors.New("invalid or expired MFA challenge")
+
+// mfaPolicyPermissions lists the permissions whose holders must enroll a second factor
+// before any permission-protected route lets them through.
+var mfaPolicyPermissions = []string{PermPermissionsAssign, PermUsersCreate, PermReportsApprove}
+
+// mfaEnforced enables the enrollment policy. It can only be turned off with
+// MFA_ENFORCEMENT=off, e.g. for functional tests.
+var mfaEnforced = strings.ToLower(os.Getenv("MFA_ENFORCEMENT")) != "off"
+
+// mfaIssuer is the account issuer shown by authenticator apps.
+var mfaIssuer = envOrDefault("MFA_ISSUER", "Expense App")
+
+// envOrDefault returns the value of an environment variable, or def when it is unset.
+func envOrDefault(name, def string) string {
+    if v := os.Getenv(name); v != "" {
+        return v
+    }
+    return def
+}
+
+// generateTOTPSecret returns a random 160-bit secret encoded in unpadded base32.
+func generateTOTPSecret() (string, error) {
+    b := make([]byte, 20)
+    if _, err := rand.Read(b); err != nil {
+        return "", err
+    }
+    return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(b), nil
+}
+
+// pow10 holds the modulus of a code by number of digits.
+var pow10 = [...]uint32{1, 10, 100, 1000, 10000, 100000, 1000000, 10000000, 100000000, 1000000000}
+
+// totpCode computes the code of a time step (HOTP with HMAC-SHA1, RFC 4226).
+func totpCode(secret []byte, step int64) string {
+    var msg [8]byte
+    binary.BigEndian.PutUint64(msg[:], uint64(step))
+    mac := hmac.New(sha1.New, secret)
+    mac.Write(msg[:])
+    sum := mac.Sum(nil)
+    offset := sum[len(sum)-1] & 0x0f
+    value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+    return fmt.Sprintf("%0*d", totpDigits, value%pow10[totpDigits])
+}
+
+// verifyTOTP checks a code against the secret at the given time. To prevent replays, only
+// steps after lastStep are accepted. It returns the matched step.
+func verifyTOTP(secret, code string, now time.Time, lastStep int64) (int64, bool) {
+    key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.ToUpper(secret))
+    if err != nil {
+        return 0, false
+    }
+    code = strings.TrimSpace(code)
+    current := now.Unix() / totpPeriod
+    for step := current - totpSkew; step <= current+totpSkew; step++ {
+        if step <= lastStep {
+            continue
+        }
+        if hmac.Equal([]byte(totpCode(key, step)), []byte(code)) {
+            return step, true
+        }
+    }
+    return 0, false
+}
+
+// totpURI returns the otpauth:// URI encoded in enrollment QR codes.
+func totpURI(email, secret string) string {
+    v := url.Values{}
+    v.Set("secret", secret)
+    v.Set("issuer", mfaIssuer)
+    v.Set("algorithm", "SHA1")
+    v.Set("digits", fmt.Sprint(totpDigits))
+    v.Set("period", fmt.Sprint(totpPeriod))
+    label := url.PathEscape(mfaIssuer + ":" + email)
+    return "otpauth://totp/" + label + "?" + v.Encode()
+}
+
+// normalizeRecoveryCode lowercases a recovery code and strips separators.
+func normalizeRecoveryCode(code string) string {
+    code = strings.ToLower(code)
+    return strings.NewReplacer("-", "", " ", "").Replace(code)
+}
+
+// issueRecoveryCodes replaces the user's recovery codes and returns the new ones. Only
+// their hashes are stored.
+func issueRecoveryCodes(tx *sql.Tx, userID int64) ([]string, error) {
+    if _, err := tx.Exec("DELETE FROM mfa_recovery_codes WHERE user_id = ?", userID); err != nil {
+        return nil, fmt.Errorf("delete recovery codes: %w", err)
+    }
+    codes := make([]string, 0, recoveryCodeCount)
+    for i := 0; i < recoveryCodeCount; i++ {
+        b := make([]byte, 5)
+        if _, err := rand.Read(b); err != nil {
+            return nil, err
+        }
+        code := hex.EncodeToString(b)
+        if _, err := tx.Exec("INSERT INTO mfa_recovery_codes (user_id, code_hash) VALUES (?, ?)", userID, hashAPIToken(code)); err != nil {
+            return nil, fmt.Errorf("insert recovery code: %w", err)
+        }
+        codes = append(codes, code[:5]+"-"+code[5:])
+    }
+    return codes, nil
+}
+
+// mfaEnabled reports whether the user has confirmed a TOTP enrollment.
+func mfaEnabled(db *sql.DB, userID int64) (bool, error) {
+    var enabled bool
+    err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM user_mfa WHERE user_id = ? AND enabled_at IS NOT NULL)", userID).Scan(&enabled)
+    if err != nil {
+        return false, fmt.Errorf("check mfa enrollment: %w", err)
+    }
+    return enabled, nil
+}
+
+// mfaEnrollmentMissing reports whether the MFA policy blocks a user holding the given
+// permissions. Accounts signing in through OpenID Connect get their second factor from
+// the identity provider and are exempt.
+func mfaEnrollmentMissing(db *sql.DB, userID int64, perms map[string]bool) (bool, error) {
+    if !mfaEnforced {
+        return false, nil
+    }
+    privileged := false
+    for _, p := range mfaPolicyPermissions {
+        if perms[p] {
+            privileged = true
+        }
+    }
+    if !privileged {
+        return false, nil
+    }
+    var satisfied bool
+    err := db.QueryRow(`SELECT u.auth_source = ? OR m.enabled_at IS NOT NULL FROM users u
+        LEFT JOIN user_mfa m ON m.user_id = u.id WHERE u.id = ?`, AuthSourceOIDC, userID).Scan(&satisfied)
+    if err != nil {
+        return false, fmt.Errorf("check mfa policy: %w", err)
+    }
+    return !satisfied, nil
+}
+
+// checkSecondFactor verifies a TOTP code or, when code is empty, a recovery code. Used
+// TOTP steps and recovery codes cannot be replayed.
+func checkSecondFactor(tx *sql.Tx, userID int64, code, recoveryCode string) (bool, error) {
+    if code != "" {
+        var secret string
+        var lastStep int64
+        err := tx.QueryRow("SELECT secret, last_step FROM user_mfa WHERE user_id = ? AND enabled_at IS NOT NULL", userID).Scan(&secret, &lastStep)
+        if errors.Is(err, sql.ErrNoRows) {
+            return false, nil
+        } else if err != nil {
+            return false, fmt.Errorf("select mfa secret: %w", err)
+        }
+        step, ok := verifyTOTP(secret, code, time.Now(), lastStep)
+        if !ok {
+            return false, nil
+        }
+        if _, err := tx.Exec("UPDATE user_mfa SET last_step = ? WHERE user_id = ?", step, userID); err != nil {
+            return false, fmt.Errorf("update mfa step: %w", err)
+        }
+        return true, nil
+    }
+    if recoveryCode == "" {
+        return false, nil
+    }
+    res, err := tx.Exec("UPDATE mfa_recovery_codes SET used_at = ? WHERE user_id = ? AND code_hash = ? AND used_at IS NULL",
+        time.Now().UTC(), userID, hashAPIToken(normalizeRecoveryCode(recoveryCode)))
+    if err != nil {
+        return false, fmt.Errorf("use recovery code: %w", err)
+    }
+    n, err := res.RowsAffected()
+    return n == 1, err
+}
+
+// createMFAChallenge records a login that passed the password step and returns the token
+// the client exchanges, along with a second factor, for a session.
+func createMFAChallenge(db *sql.DB, userID int64) (string, error) {
+    token, err := randomToken()
+    if err != nil {
+        return "", err
+    }
+    now := time.Now().UTC()
+    // Expired challenges are purged opportunistically
+    if _, err := db.Exec("DELETE FROM mfa_challenges WHERE expires_at < ?", now); err != nil {
+        return "", fmt.Errorf("purge mfa challenges: %w", err)
+    }
+    _, err = db.Exec("INSERT INTO mfa_challenges (user_id, token_hash, created_at, expires_at) VALUES (?, ?, ?, ?)",
+        userID, hashAPIToken(token), now, now.Add(mfaChallengeTTL))
+    if err != nil {
+        return "", fmt.Errorf("insert mfa challenge: %w", err)
+    }
+    return token, nil
+}
+
+// MFAVerifyRequest completes a login with a TOTP code or a recovery code.
+type MFAVerifyRequest struct {
+    MFAToken     string `json:"mfa_token"`
+    Code         string `json:"code"`
+    RecoveryCode string `json:"recovery_code"`
+}
+
+// VerifyMFA is the second step of a login for accounts with MFA enabled. It exchanges the
+// challenge token returned by Login and a valid code for a session.
+func (h *Handlers) VerifyMFA(c *gin.Context) {
+    var req MFAVerifyRequest
+    if err := c.ShouldBindJSON(&req); err != nil || req.MFAToken == "" || (req.Code == "" && req.RecoveryCode == "") {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "mfa_token and code or recovery_code are required"})
+        return
+    }
+    tx, err := h.db.Begin()
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
+        return
+    }
+    defer tx.Rollback()
+    var challengeID, userID int64
+    var attempts int
+    var expiresAt time.Time
+    err = tx.QueryRow("SELECT id, user_id, attempts, expires_at FROM mfa_challenges WHERE token_hash = ?", hashAPIToken(req.MFAToken)).
+        Scan(&challengeID, &userID, &attempts, &expiresAt)
+    if errors.Is(err, sql.ErrNoRows) || (err == nil && (time.Now().After(expiresAt) || attempts >= mfaMaxAttempts)) {
+        c.JSON(http.StatusUnauthorized, gin.H{"error": ErrMFAChallengeInvalid.Error()})
+        return
+    } else if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
+        return
+    }
+    var email string
+    var mustChange bool
+    if err := tx.QueryRow("SELECT email, must_change_password FROM users WHERE id = ?", userID).Scan(&email, &mustChange); err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
+        return
+    }
+    // Wrong codes count as failed logins of the account, whatever challenge they were sent to
+    if !h.allowLoginAttempt(c, email) {
+        return
+    }
+    ok, err := checkSecondFactor(tx, userID, req.Code, req.RecoveryCode)
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to verify code"})
+        return
+    }
+    if !ok {
+        if _, err := tx.Exec("UPDATE mfa_challenges SET attempts = attempts + 1 WHERE id = ?", challengeID); err == nil {
+            tx.Commit()
+        }
+        if err := recordLoginFailure(h.db, email, c.ClientIP(), time.Now()); err != nil {
+            log.Printf("[ERROR] %v", err)
+        }
+        c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid code"})
+        return
+    }
+    if _, err := tx.Exec("DELETE FROM mfa_challenges WHERE id = ?", challengeID); err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
+        return
+    }
+    if err := tx.Commit(); err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
+        return
+    }
+    tokens, err := h.startSession(userID)
+    if errors.Is(err, ErrAccountDisabled) {
+        c.JSON(http.StatusForbidden, gin.H{"error": err.Error(), "code": "account_disabled"})
+        return
+    } else if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to generate token"})
+        return
+    }
+    if err := clearAccountThrottle(h.db, email); err != nil {
+        log.Printf("[ERROR] %v", err)
+    }
+    tokens["user"] = gin.H{"id": userID, "email": email}
+    tokens["password_change_required"] = mustChange
+    c.JSON(http.StatusOK, tokens)
+}
+
+// EnrollMFA starts a TOTP enrollment for the current user. It returns the secret to add
+// to an authenticator app; the enrollment becomes effective once confirmed with a code.
+func (h *Handlers) EnrollMFA(c *gin.Context) {
+    userIDIfc, _ := c.Get(ContextUserIDKey)
+    userID := userIDIfc.(int64)
+    enabled, err := mfaEnabled(h.db, userID)
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
+        return
+    }
+    if enabled {
+        c.JSON(http.StatusConflict, gin.H{"error": "MFA is already enabled"})
+        return
+    }
+    var email string
+    if err := h.db.QueryRow("SELECT email FROM users WHERE id = ?", userID).Scan(&email); err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
+        return
+    }
+    secret, err := generateTOTPSecret()
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to generate secret"})
+        return
+    }
+    // A new enrollment replaces a pending one that was never confirmed
+    _, err = h.db.Exec("INSERT OR REPLACE INTO user_mfa (user_id, secret, last_step, created_at, enabled_at) VALUES (?, ?, 0, ?, NULL)",
+        userID, secret, time.Now().UTC())
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to start enrollment"})
+        return
+    }
+    c.JSON(http.StatusOK, gin.H{"secret": secret, "otpauth_url": totpURI(email, secret)})
+}
+
+// MFACodeRequest carries a TOTP code.
+type MFACodeRequest struct {
+    Code string `json:"code"`
+}
+
+// ConfirmMFA completes a pending enrollment with a code from the authenticator app and
+// returns the recovery codes. They are shown only once.
+func (h *Handlers) ConfirmMFA(c *gin.Context) {
+    var req MFACodeRequest
+    if err := c.ShouldBindJSON(&req); err != nil || req.Code == "" {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "code is required"})
+        return
+    }
+    userIDIfc, _ := c.Get(ContextUserIDKey)
+    userID := userIDIfc.(int64)
+    tx, err := h.db.Begin()
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
+        return
+    }
+    defer tx.Rollback()
+    var secret string
+    err = tx.QueryRow("SELECT secret FROM user_mfa WHERE user_id = ? AND enabled_at IS NULL", userID).Scan(&secret)
+    if errors.Is(err, sql.ErrNoRows) {
+        c.JSON(http.StatusNotFound, gin.H{"error": "no pending MFA enrollment"})
+        return
+    } else if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
+        return
+    }
+    step, ok := verifyTOTP(secret, req.Code, time.Now(), 0)
+    if !ok {
+        c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid code"})
+        return
+    }
+    if _, err := tx.Exec("UPDATE user_mfa SET enabled_at = ?, last_step = ? WHERE user_id = ?", time.Now().UTC(), step, userID); err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to enable MFA"})
+        return
+    }
+    codes, err := issueRecoveryCodes(tx, userID)
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to issue recovery codes"})
+        return
+    }
+    if err := tx.Commit(); err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
+        return
+    }
+    c.JSON(http.StatusOK, gin.H{"enabled": true, "recovery_codes": codes})
+}
+
+// RegenerateRecoveryCodes replaces the recovery codes of the current user. A valid TOTP
+// code is required so that a stolen session cannot take over the second factor.
+func (h *Handlers) RegenerateRecoveryCodes(c *gin.Context) {
+    var req MFACodeRequest
+    if err := c.ShouldBindJSON(&req); err != nil || req.Code == "" {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "code is required"})
+        return
+    }
+    userIDIfc, _ := c.Get(ContextUserIDKey)
+    userID := userIDIfc.(int64)
+    tx, err := h.db.Begin()
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
+        return
+    }
+    defer tx.Rollback()
+    ok, err := checkSecondFactor(tx, userID, req.Code, "")
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to verify code"})
+        return
+    }
+    if !ok {
+        c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid code"})
+        return
+    }
+    codes, err := issueRecoveryCodes(tx, userID)
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to issue recovery codes"})
+        return
+    }
+    if err := tx.Commit(); err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
+        return
+    }
+    c.JSON(http.StatusOK, gin.H{"recovery_codes": codes})
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/base32"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTOTPMatchesRFC6238Vectors(t *testing.T) {
+	secret := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString([]byte("12345678901234567890"))
+	for ts, code := range map[int64]string{59: "287082", 1111111109: "081804", 2000000000: "279037"} {
+		step, ok := verifyTOTP(secret, code, time.Unix(ts, 0), 0)
+		assert.True(t, ok, "code at %d", ts)
+		// A step cannot be used twice
+		_, ok = verifyTOTP(secret, code, time.Unix(ts, 0), step)
+		assert.False(t, ok)
+	}
+}
+
+// currentTOTP returns the code of the current time step shifted by offset, so that
+// successive calls in a test are not rejected as replays.
+func currentTOTP(t *testing.T, secret string, offset int64) string {
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(secret)
+	require.NoError(t, err)
+	return totpCode(key, time.Now().Unix()/totpPeriod+offset)
+}
+
+func TestMFAEnrollmentAndTwoStepLogin(t *testing.T) {
+	mfaEnforced = true
+	defer func() { mfaEnforced = false }()
+	db := newTestDB(t)
+	h := NewHandlers(db, t.TempDir())
+	r := newTestRouter(db, PermUsersRead)
+	r.POST("/api/auth/login", h.Login)
+	r.POST("/api/auth/mfa/verify", h.VerifyMFA)
+	api := r.Group("/api/auth/mfa", AuthMiddleware(db))
+	api.POST("/enroll", h.EnrollMFA)
+	api.POST("/confirm", h.ConfirmMFA)
+
+	w := postJSON(r, "/api/auth/login", `{"email":"admin@example.com","password":"admin"}`, "")
+	require.Equal(t, http.StatusOK, w.Code)
+	var login tokenPair
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &login))
+
+	// The admin holds permissions:assign and is blocked until enrolled
+	w = getWithBearer(r, "/api/protected", login.Token)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Contains(t, w.Body.String(), "mfa_enrollment_required")
+
+	w = postJSON(r, "/api/auth/mfa/enroll", "", login.Token)
+	require.Equal(t, http.StatusOK, w.Code)
+	var enrollment struct {
+		Secret     string `json:"secret"`
+		OTPAuthURL string `json:"otpauth_url"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &enrollment))
+	assert.Contains(t, enrollment.OTPAuthURL, "otpauth://totp/")
+	assert.Equal(t, http.StatusUnauthorized, postJSON(r, "/api/auth/mfa/confirm", `{"code":"000000"}`, login.Token).Code)
+	w = postJSON(r, "/api/auth/mfa/confirm", `{"code":"`+currentTOTP(t, enrollment.Secret, 0)+`"}`, login.Token)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var confirmed struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &confirmed))
+	assert.Len(t, confirmed.RecoveryCodes, recoveryCodeCount)
+	assert.Equal(t, http.StatusOK, getWithBearer(r, "/api/protected", login.Token).Code)
+
+	// Password login now stops at the MFA challenge
+	w = postJSON(r, "/api/auth/login", `{"email":"admin@example.com","password":"admin"}`, "")
+	require.Equal(t, http.StatusOK, w.Code)
+	var challenge struct {
+		MFARequired bool   `json:"mfa_required"`
+		MFAToken    string `json:"mfa_token"`
+		Token       string `json:"token"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &challenge))
+	assert.True(t, challenge.MFARequired)
+	assert.Empty(t, challenge.Token)
+	assert.Equal(t, http.StatusUnauthorized, postJSON(r, "/api/auth/mfa/verify", `{"mfa_token":"`+challenge.MFAToken+`","code":"000000"}`, "").Code)
+	w = postJSON(r, "/api/auth/mfa/verify", `{"mfa_token":"`+challenge.MFAToken+`","code":"`+currentTOTP(t, enrollment.Secret, 1)+`"}`, "")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Contains(t, w.Body.String(), "refresh_token")
+	// The challenge is single use
+	assert.Equal(t, http.StatusUnauthorized, postJSON(r, "/api/auth/mfa/verify", `{"mfa_token":"`+challenge.MFAToken+`","code":"`+currentTOTP(t, enrollment.Secret, 0)+`"}`, "").Code)
+
+	// A recovery code works once
+	recovery := `{"mfa_token":"%s","recovery_code":"` + confirmed.RecoveryCodes[0] + `"}`
+	for i, want := range []int{http.StatusOK, http.StatusUnauthorized} {
+		w = postJSON(r, "/api/auth/login", `{"email":"admin@example.com","password":"admin"}`, "")
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &challenge))
+		w = postJSON(r, "/api/auth/mfa/verify", fmt.Sprintf(recovery, challenge.MFAToken), "")
+		assert.Equal(t, want, w.Code, "attempt %d", i)
+	}
+}
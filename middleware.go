@@ -2,6 +2,7 @@ package main
 
 import (
     "database/sql"
+    "errors"
     "net/http"
     "strings"
 
@@ -11,17 +12,36 @@ import (
 
 const ContextUserIDKey = "userID"
 
+// ContextTokenScopesKey holds the set of actions an API token is restricted to. It is
+// only present when the request was authenticated with a restricted API token.
+const ContextTokenScopesKey = "tokenScopes"
+
 // AuthMiddleware checks for an Authorization header containing a valid JWT and
 // adds the user ID to the request context. It also supports static API tokens
-// via the X-API-Key header (not implemented fully; reserved for future use).
+// via the X-API-Key header; the token owner becomes the authenticated user.
 func AuthMiddleware(db *sql.DB) gin.HandlerFunc {
     return func(c *gin.Context) {
-        // Check X-API-Key for static token support (placeholder)
+        // Static API tokens take precedence over JWTs
         apiKey := c.GetHeader("X-API-Key")
         if apiKey != "" {
-            // In a complete implementation, we would verify apiKey against a database table.
-            // For now, we reject with unauthorized.
-            c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "API keys not supported"})
+            token, err := authenticateAPIToken(db, apiKey)
+            if err != nil {
+                if errors.Is(err, ErrAPITokenInvalid) || errors.Is(err, ErrAPITokenExpired) || errors.Is(err, ErrAPITokenRevoked) || errors.Is(err, ErrAccountDisabled) {
+                    c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+                } else {
+                    c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "failed to verify API key"})
+                }
+                return
+            }
+            c.Set(ContextUserIDKey, token.UserID)
+            if token.Restricted {
+                scopes := make(map[string]bool, len(token.Permissions))
+                for _, action := range token.Permissions {
+                    scopes[action] = true
+                }
+                c.Set(ContextTokenScopesKey, scopes)
+            }
+            c.Next()
             return
         }
         // Parse JWT from Authorization header
@@ -31,12 +51,7 @@ func AuthMiddleware(db *sql.DB) gin.HandlerFunc {
             return
         }
         tokenString := strings.TrimSpace(auth[len("Bearer "):])
-        token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-            if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-                return nil, jwt.ErrTokenMalformed
-            }
-            return []byte(jwtSecret), nil
-        })
+        token, err := jwtKeys.Parse(tokenString)
         if err != nil || !token.Valid {
             c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid token"})
             return
@@ -51,15 +66,38 @@ func AuthMiddleware(db *sql.DB) gin.HandlerFunc {
             c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid token subject"})
             return
         }
-        // Set user ID in context
+        sid, ok := claims["sid"].(float64)
+        if !ok {
+            c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid token session"})
+            return
+        }
+        // Reject tokens whose session was revoked, e.g. on logout
+        active, err := sessionActive(db, int64(sid), int64(sub))
+        if err != nil {
+            c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "failed to verify session"})
+            return
+        }
+        if !active {
+            c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "session revoked"})
+            return
+        }
+        // Set user and session IDs in context
         c.Set(ContextUserIDKey, int64(sub))
+        c.Set(ContextSessionIDKey, int64(sid))
         c.Next()
     }
 }
 
 // RequirePermission ensures that the authenticated user possesses a specific permission.
-// When a user lacks the permission, a 403 Forbidden response is returned.
+// When a user lacks the permission, must change their password, or holds sensitive
+// permissions without having enrolled a second factor, a 403 Forbidden response is returned.
 func RequirePermission(db *sql.DB, permission string) gin.HandlerFunc {
+    return RequireAnyPermission(db, permission)
+}
+
+// RequireAnyPermission is like RequirePermission but lets the request through when the
+// user holds at least one of the permissions.
+func RequireAnyPermission(db *sql.DB, permissions ...string) gin.HandlerFunc {
     return func(c *gin.Context) {
         userIDIfc, exists := c.Get(ContextUserIDKey)
         if !exists {
@@ -67,15 +105,53 @@ func RequirePermission(db *sql.DB, permission string) gin.HandlerFunc {
             return
         }
         userID, _ := userIDIfc.(int64)
-        has, err := UserHasPermission(db, userID, permission)
+        perms, err := requestPermissions(c, db, userID)
         if err != nil {
             c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "failed to check permissions"})
             return
         }
-        if !has {
+        allowed := false
+        for _, permission := range permissions {
+            if perms[permission] && tokenScopeAllows(c, permission) {
+                allowed = true
+                break
+            }
+        }
+        if !allowed {
             c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "forbidden"})
             return
         }
+        // Accounts flagged for a password change must pick a new password first
+        mustChange, err := passwordChangeRequired(db, userID)
+        if err != nil {
+            c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "failed to check password policy"})
+            return
+        }
+        if mustChange {
+            c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "password change required", "code": "password_change_required"})
+            return
+        }
+        // Holders of sensitive permissions must enroll a second factor first
+        missing, err := mfaEnrollmentMissing(db, userID, perms)
+        if err != nil {
+            c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "failed to check MFA policy"})
+            return
+        }
+        if missing {
+            c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "MFA enrollment required", "code": "mfa_enrollment_required"})
+            return
+        }
         c.Next()
     }
 }
+
+// tokenScopeAllows reports whether the API token used to authenticate the request, if
+// any, is allowed to perform the action. Requests without a restricted token are allowed.
+func tokenScopeAllows(c *gin.Context, permission string) bool {
+    scopesIfc, exists := c.Get(ContextTokenScopesKey)
+    if !exists {
+        return true
+    }
+    scopes, _ := scopesIfc.(map[string]bool)
+    return scopes[permission]
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestDB returns an initialized database stored in a temporary directory.
+func newTestDB(t testing.TB) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "expense.db")+"?_foreign_keys=on")
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+	require.NoError(t, InitDB(db))
+	// Tests log in as the seeded admin, which must otherwise change its default password
+	_, err = db.Exec("UPDATE users SET must_change_password = 0")
+	require.NoError(t, err)
+	return db
+}
+
+// newTestRouter exposes a route protected by AuthMiddleware and RequirePermission.
+func newTestRouter(db *sql.DB, permission string) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	api := r.Group("/api")
+	api.Use(AuthMiddleware(db))
+	api.GET("/protected", RequirePermission(db, permission), func(c *gin.Context) {
+		userID, _ := c.Get(ContextUserIDKey)
+		c.JSON(http.StatusOK, gin.H{"user_id": userID})
+	})
+	return r
+}
+
+// issueAPIToken calls GenerateAPIToken for the given user and returns the plaintext token.
+func issueAPIToken(t *testing.T, db *sql.DB, userID string) string {
+	return issueAPITokenWith(t, db, userID, "")
+}
+
+// issueAPITokenWith is like issueAPIToken but sends body as the request payload.
+func issueAPITokenWith(t *testing.T, db *sql.DB, userID string, body string) string {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.POST("/users/:id/token", NewHandlers(db, t.TempDir()).GenerateAPIToken)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/users/"+userID+"/token", strings.NewReader(body)))
+	require.Equal(t, http.StatusOK, w.Code)
+	var out struct {
+		Token string `json:"token"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &out))
+	return out.Token
+}
+
+func doWithAPIKey(r *gin.Engine, key string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, "/api/protected", nil)
+	req.Header.Set("X-API-Key", key)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestAPIKeyAuthentication(t *testing.T) {
+	db := newTestDB(t)
+	r := newTestRouter(db, PermUsersRead)
+	token := issueAPIToken(t, db, "1")
+
+	// The plaintext token is never stored
+	var stored int
+	require.NoError(t, db.QueryRow("SELECT COUNT(*) FROM api_tokens WHERE token_hash = ?", token).Scan(&stored))
+	assert.Equal(t, 0, stored)
+
+	w := doWithAPIKey(r, token)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"user_id":1}`, w.Body.String())
+
+	var lastUsed sql.NullTime
+	require.NoError(t, db.QueryRow("SELECT last_used_at FROM api_tokens WHERE token_hash = ?", hashAPIToken(token)).Scan(&lastUsed))
+	assert.True(t, lastUsed.Valid)
+
+	w = doWithAPIKey(r, "unknown")
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
+
+func TestAPIKeyExpiredOrRevoked(t *testing.T) {
+	db := newTestDB(t)
+	r := newTestRouter(db, PermUsersRead)
+
+	expired := issueAPIToken(t, db, "1")
+	_, err := db.Exec("UPDATE api_tokens SET expires_at = ? WHERE token_hash = ?", time.Now().UTC().Add(-time.Minute), hashAPIToken(expired))
+	require.NoError(t, err)
+	w := doWithAPIKey(r, expired)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Contains(t, w.Body.String(), ErrAPITokenExpired.Error())
+
+	revoked := issueAPIToken(t, db, "1")
+	_, err = db.Exec("UPDATE api_tokens SET revoked_at = ? WHERE token_hash = ?", time.Now().UTC(), hashAPIToken(revoked))
+	require.NoError(t, err)
+	w = doWithAPIKey(r, revoked)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Contains(t, w.Body.String(), ErrAPITokenRevoked.Error())
+}
+
+func TestAPIKeyRespectsPermissions(t *testing.T) {
+	db := newTestDB(t)
+	_, err := db.Exec("INSERT INTO users (email, password_hash, created_at) VALUES (?, ?, ?)", "user@example.com", "x", time.Now().UTC())
+	require.NoError(t, err)
+	token := issueAPIToken(t, db, "2")
+
+	w := doWithAPIKey(newTestRouter(db, PermUsersRead), token)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+}
+
+func TestAPIKeyRestrictedToPermissions(t *testing.T) {
+	db := newTestDB(t)
+	token := issueAPITokenWith(t, db, "1", `{"name":"ci exporter","permissions":["reports:export:all"]}`)
+
+	w := doWithAPIKey(newTestRouter(db, PermReportsExportAll), token)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// The owner is an administrator, but the token only carries reports:export:all
+	w = doWithAPIKey(newTestRouter(db, PermUsersRead), token)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	// Losing its last permission, e.g. through a cascade, leaves the token with nothing
+	_, err := db.Exec("DELETE FROM api_token_permissions")
+	require.NoError(t, err)
+	w = doWithAPIKey(newTestRouter(db, PermReportsExportAll), token)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	w = doWithAPIKey(newTestRouter(db, PermUsersRead), token)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+}
+
+func TestGenerateAPITokenRejectsUnknownPermission(t *testing.T) {
+	db := newTestDB(t)
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.POST("/users/:id/token", NewHandlers(db, t.TempDir()).GenerateAPIToken)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/users/1/token", strings.NewReader(`{"permissions":["reports:delete:all"]}`)))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestUpdateAPITokenKeepsOmittedFields(t *testing.T) {
+	db := newTestDB(t)
+	token := issueAPIToken(t, db, "1")
+	expiry := time.Now().UTC().Add(24 * time.Hour).Truncate(time.Second)
+	_, err := db.Exec("UPDATE api_tokens SET expires_at = ? WHERE token_hash = ?", expiry, hashAPIToken(token))
+	require.NoError(t, err)
+	var tokenID int64
+	require.NoError(t, db.QueryRow("SELECT id FROM api_tokens WHERE token_hash = ?", hashAPIToken(token)).Scan(&tokenID))
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.PUT("/tokens/:id", NewHandlers(db, t.TempDir()).UpdateAPIToken)
+	update := func(body string) {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodPut, "/tokens/"+fmt.Sprint(tokenID), strings.NewReader(body)))
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	}
+	var name string
+	var expiresAt sql.NullTime
+
+	// Renaming leaves the expiry alone
+	update(`{"name":"renamed"}`)
+	require.NoError(t, db.QueryRow("SELECT name, expires_at FROM api_tokens WHERE id = ?", tokenID).Scan(&name, &expiresAt))
+	assert.Equal(t, "renamed", name)
+	require.True(t, expiresAt.Valid)
+	assert.True(t, expiry.Equal(expiresAt.Time))
+
+	// An explicit null removes it
+	update(`{"expires_at":null}`)
+	require.NoError(t, db.QueryRow("SELECT name, expires_at FROM api_tokens WHERE id = ?", tokenID).Scan(&name, &expiresAt))
+	assert.Equal(t, "renamed", name)
+	assert.False(t, expiresAt.Valid)
+}
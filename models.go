@@ -8,14 +8,30 @@ import (
     "time"
 )
 
-// User represents a system user. PasswordHash stores the bcrypt hashed password.
+// User represents a system user. PasswordHash stores the bcrypt hashed password; it is
+// empty for accounts managed by an external identity provider, identified by AuthSource
+// and ExternalID. MustChangePassword blocks protected routes until the user picks a new
+// password, e.g. after an administrator created the account. DisabledAt is set while the
+// account is deactivated.
 type User struct {
-    ID           int64     `db:"id" json:"id"`
-    Email        string    `db:"email" json:"email"`
-    PasswordHash string    `db:"password_hash" json:"-"`
-    CreatedAt    time.Time `db:"created_at" json:"created_at"`
+    ID                 int64      `db:"id" json:"id"`
+    Email              string     `db:"email" json:"email"`
+    PasswordHash       string     `db:"password_hash" json:"-"`
+    AuthSource         string     `db:"auth_source" json:"auth_source"`
+    ExternalID         *string    `db:"external_id" json:"external_id,omitempty"`
+    MustChangePassword bool       `db:"must_change_password" json:"must_change_password"`
+    DisabledAt         *time.Time `db:"disabled_at" json:"disabled_at,omitempty"`
+    ManagerID          *int64     `db:"manager_id" json:"manager_id,omitempty"`
+    CreatedAt          time.Time  `db:"created_at" json:"created_at"`
 }
 
+// Authentication sources of user accounts.
+const (
+    AuthSourceLocal = "local"
+    AuthSourceOIDC  = "oidc"
+    AuthSourceLDAP  = "ldap"
+)
+
 // Group represents a collection of permissions.
 type Group struct {
     ID   int64  `db:"id" json:"id"`
@@ -50,6 +66,50 @@ type ExpenseItem struct {
     CreatedAt   time.Time `db:"created_at" json:"created_at"`
 }
 
+// APIToken represents a static API token. Only the SHA-256 digest of the token is stored,
+// along with its first characters so that users can recognise it. A Restricted token is
+// limited to the actions in Permissions, and allows nothing once they are all deleted.
+type APIToken struct {
+    ID          int64      `db:"id" json:"id"`
+    UserID      int64      `db:"user_id" json:"user_id"`
+    Name        string     `db:"name" json:"name"`
+    Prefix      string     `db:"prefix" json:"-"`
+    TokenHash   string     `db:"token_hash" json:"-"`
+    Permissions []string   `json:"permissions"`
+    Restricted  bool       `db:"restricted" json:"restricted"`
+    CreatedAt   time.Time  `db:"created_at" json:"created_at"`
+    LastUsedAt  *time.Time `db:"last_used_at" json:"last_used_at"`
+    ExpiresAt   *time.Time `db:"expires_at" json:"expires_at"`
+    RevokedAt   *time.Time `db:"revoked_at" json:"revoked_at"`
+}
+
+// Session represents an interactive login. Access tokens reference the session through
+// their "sid" claim and the refresh token is rotated on every use.
+type Session struct {
+    ID               int64      `db:"id" json:"id"`
+    UserID           int64      `db:"user_id" json:"user_id"`
+    RefreshTokenHash string     `db:"refresh_token_hash" json:"-"`
+    CreatedAt        time.Time  `db:"created_at" json:"created_at"`
+    LastUsedAt       *time.Time `db:"last_used_at" json:"last_used_at"`
+    ExpiresAt        time.Time  `db:"expires_at" json:"expires_at"`
+    RevokedAt        *time.Time `db:"revoked_at" json:"revoked_at"`
+}
+
+// apiTokensTable is the schema of the API_TOKENS table. It is shared with the legacy
+// token migration which recreates the table.
+const apiTokensTable = `CREATE TABLE IF NOT EXISTS api_tokens (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        user_id INTEGER NOT NULL,
+        name TEXT NOT NULL DEFAULT '',
+        prefix TEXT NOT NULL DEFAULT '',
+        token_hash TEXT NOT NULL UNIQUE,
+        created_at DATETIME NOT NULL,
+        last_used_at DATETIME,
+        expires_at DATETIME,
+        revoked_at DATETIME,
+        FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+    )`
+
 // InitDB creates all required tables and seeds default data.
 // It is idempotent and can be called multiple times.
 func InitDB(db *sql.DB) error {
@@ -62,11 +122,37 @@ func InitDB(db *sql.DB) error {
         id INTEGER PRIMARY KEY AUTOINCREMENT,
         email TEXT NOT NULL UNIQUE,
         password_hash TEXT NOT NULL,
+        auth_source TEXT NOT NULL DEFAULT 'local',
+        external_id TEXT,
+        must_change_password INTEGER NOT NULL DEFAULT 0,
+        password_changed_at DATETIME,
+        disabled_at DATETIME,
         created_at DATETIME NOT NULL
     )`;
     if _, err := db.Exec(usersTable); err != nil {
         return fmt.Errorf("create users: %w", err)
     }
+    if err := ensureColumn(db, "users", "auth_source", "TEXT NOT NULL DEFAULT 'local'"); err != nil {
+        return err
+    }
+    if err := ensureColumn(db, "users", "external_id", "TEXT"); err != nil {
+        return err
+    }
+    if err := ensureColumn(db, "users", "must_change_password", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+        return err
+    }
+    if err := ensureColumn(db, "users", "password_changed_at", "DATETIME"); err != nil {
+        return err
+    }
+    if err := ensureColumn(db, "users", "disabled_at", "DATETIME"); err != nil {
+        return err
+    }
+    if err := ensureColumn(db, "users", "manager_id", "INTEGER REFERENCES users(id) ON DELETE SET NULL"); err != nil {
+        return err
+    }
+    if _, err := db.Exec("CREATE UNIQUE INDEX IF NOT EXISTS idx_users_external ON users(auth_source, external_id) WHERE external_id IS NOT NULL"); err != nil {
+        return fmt.Errorf("create users external index: %w", err)
+    }
     // Create GROUPS table
     groupsTable := `CREATE TABLE IF NOT EXISTS groups (
         id INTEGER PRIMARY KEY AUTOINCREMENT,
@@ -117,6 +203,14 @@ func InitDB(db *sql.DB) error {
     if _, err := db.Exec(reportsTable); err != nil {
         return fmt.Errorf("create expense_reports: %w", err)
     }
+    // Expected approver of a submitted report, resolved from the manager hierarchy
+    if err := ensureColumn(db, "expense_reports", "approver_id", "INTEGER REFERENCES users(id) ON DELETE SET NULL"); err != nil {
+        return err
+    }
+    // Time of the last submission, from which approval delays are measured
+    if err := ensureColumn(db, "expense_reports", "submitted_at", "DATETIME"); err != nil {
+        return err
+    }
     // Create EXPENSE_ITEMS table
     itemsTable := `CREATE TABLE IF NOT EXISTS expense_items (
         id INTEGER PRIMARY KEY AUTOINCREMENT,
@@ -133,10 +227,312 @@ func InitDB(db *sql.DB) error {
     if _, err := db.Exec(itemsTable); err != nil {
         return fmt.Errorf("create expense_items: %w", err)
     }
+    // Migrate API tokens stored in plaintext by earlier versions
+    if err := migrateLegacyAPITokens(db); err != nil {
+        return err
+    }
+    // Create API_TOKENS table
+    if _, err := db.Exec(apiTokensTable); err != nil {
+        return fmt.Errorf("create api_tokens: %w", err)
+    }
+    if err := ensureColumn(db, "api_tokens", "name", "TEXT NOT NULL DEFAULT ''"); err != nil {
+        return err
+    }
+    if err := ensureColumn(db, "api_tokens", "prefix", "TEXT NOT NULL DEFAULT ''"); err != nil {
+        return err
+    }
+    // Create API_TOKEN_PERMISSIONS table restricting tokens to a subset of actions
+    tokenPermsTable := `CREATE TABLE IF NOT EXISTS api_token_permissions (
+        token_id INTEGER NOT NULL,
+        permission_id INTEGER NOT NULL,
+        PRIMARY KEY(token_id, permission_id),
+        FOREIGN KEY(token_id) REFERENCES api_tokens(id) ON DELETE CASCADE,
+        FOREIGN KEY(permission_id) REFERENCES permissions(id) ON DELETE CASCADE
+    )`;
+    if _, err := db.Exec(tokenPermsTable); err != nil {
+        return fmt.Errorf("create api_token_permissions: %w", err)
+    }
+    // A restricted token whose permissions were all deleted must not become unrestricted
+    if err := ensureColumn(db, "api_tokens", "restricted", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+        return err
+    }
+    if _, err := db.Exec("UPDATE api_tokens SET restricted = 1 WHERE restricted = 0 AND id IN (SELECT token_id FROM api_token_permissions)"); err != nil {
+        return fmt.Errorf("flag restricted api tokens: %w", err)
+    }
+    // Create SESSIONS table
+    sessionsTable := `CREATE TABLE IF NOT EXISTS sessions (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        user_id INTEGER NOT NULL,
+        refresh_token_hash TEXT NOT NULL UNIQUE,
+        created_at DATETIME NOT NULL,
+        last_used_at DATETIME,
+        expires_at DATETIME NOT NULL,
+        revoked_at DATETIME,
+        FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+    )`;
+    if _, err := db.Exec(sessionsTable); err != nil {
+        return fmt.Errorf("create sessions: %w", err)
+    }
+    // Create ROTATED_REFRESH_TOKENS table keeping the digests of used refresh tokens, so
+    // that a replayed one revokes its session
+    rotatedTokensTable := `CREATE TABLE IF NOT EXISTS rotated_refresh_tokens (
+        token_hash TEXT PRIMARY KEY,
+        session_id INTEGER NOT NULL,
+        rotated_at DATETIME NOT NULL,
+        FOREIGN KEY(session_id) REFERENCES sessions(id) ON DELETE CASCADE
+    )`;
+    if _, err := db.Exec(rotatedTokensTable); err != nil {
+        return fmt.Errorf("create rotated_refresh_tokens: %w", err)
+    }
+    // Create OIDC_LOGIN_STATES table holding pending single sign-on logins
+    oidcStatesTable := `CREATE TABLE IF NOT EXISTS oidc_login_states (
+        state TEXT PRIMARY KEY,
+        code_verifier TEXT NOT NULL,
+        nonce TEXT NOT NULL,
+        created_at DATETIME NOT NULL,
+        expires_at DATETIME NOT NULL
+    )`;
+    if _, err := db.Exec(oidcStatesTable); err != nil {
+        return fmt.Errorf("create oidc_login_states: %w", err)
+    }
+    // Create USER_MFA table holding TOTP secrets; enabled_at is set once enrollment is confirmed
+    userMFATable := `CREATE TABLE IF NOT EXISTS user_mfa (
+        user_id INTEGER PRIMARY KEY,
+        secret TEXT NOT NULL,
+        last_step INTEGER NOT NULL DEFAULT 0,
+        created_at DATETIME NOT NULL,
+        enabled_at DATETIME,
+        FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+    )`;
+    if _, err := db.Exec(userMFATable); err != nil {
+        return fmt.Errorf("create user_mfa: %w", err)
+    }
+    // Create MFA_RECOVERY_CODES table; codes are stored hashed and can be used once
+    recoveryCodesTable := `CREATE TABLE IF NOT EXISTS mfa_recovery_codes (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        user_id INTEGER NOT NULL,
+        code_hash TEXT NOT NULL,
+        used_at DATETIME,
+        FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+    )`;
+    if _, err := db.Exec(recoveryCodesTable); err != nil {
+        return fmt.Errorf("create mfa_recovery_codes: %w", err)
+    }
+    // Create MFA_CHALLENGES table holding logins waiting for their second factor
+    mfaChallengesTable := `CREATE TABLE IF NOT EXISTS mfa_challenges (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        user_id INTEGER NOT NULL,
+        token_hash TEXT NOT NULL UNIQUE,
+        attempts INTEGER NOT NULL DEFAULT 0,
+        created_at DATETIME NOT NULL,
+        expires_at DATETIME NOT NULL,
+        FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+    )`;
+    if _, err := db.Exec(mfaChallengesTable); err != nil {
+        return fmt.Errorf("create mfa_challenges: %w", err)
+    }
+    // Create LOGIN_THROTTLE table counting failed logins per account (email) and per IP
+    loginThrottleTable := `CREATE TABLE IF NOT EXISTS login_throttle (
+        kind TEXT NOT NULL,
+        subject TEXT NOT NULL,
+        failures INTEGER NOT NULL DEFAULT 0,
+        last_failed_at DATETIME NOT NULL,
+        locked_until DATETIME,
+        PRIMARY KEY (kind, subject)
+    )`;
+    if _, err := db.Exec(loginThrottleTable); err != nil {
+        return fmt.Errorf("create login_throttle: %w", err)
+    }
+    // Create PASSWORD_RESETS table holding single-use reset tokens issued by administrators
+    passwordResetsTable := `CREATE TABLE IF NOT EXISTS password_resets (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        user_id INTEGER NOT NULL,
+        token_hash TEXT NOT NULL UNIQUE,
+        created_by INTEGER,
+        created_at DATETIME NOT NULL,
+        expires_at DATETIME NOT NULL,
+        used_at DATETIME,
+        FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+    )`;
+    if _, err := db.Exec(passwordResetsTable); err != nil {
+        return fmt.Errorf("create password_resets: %w", err)
+    }
+    // Create VALIDATOR_SCOPES table attaching validators to the user groups they review
+    validatorScopesTable := `CREATE TABLE IF NOT EXISTS validator_scopes (
+        validator_id INTEGER NOT NULL,
+        group_id INTEGER NOT NULL,
+        PRIMARY KEY(validator_id, group_id),
+        FOREIGN KEY(validator_id) REFERENCES users(id) ON DELETE CASCADE,
+        FOREIGN KEY(group_id) REFERENCES groups(id) ON DELETE CASCADE
+    )`;
+    if _, err := db.Exec(validatorScopesTable); err != nil {
+        return fmt.Errorf("create validator_scopes: %w", err)
+    }
+    // Create REPORT_PROXIES table designating the users who prepare reports for others
+    reportProxiesTable := `CREATE TABLE IF NOT EXISTS report_proxies (
+        principal_id INTEGER NOT NULL,
+        proxy_id INTEGER NOT NULL,
+        PRIMARY KEY(principal_id, proxy_id),
+        FOREIGN KEY(principal_id) REFERENCES users(id) ON DELETE CASCADE,
+        FOREIGN KEY(proxy_id) REFERENCES users(id) ON DELETE CASCADE
+    )`;
+    if _, err := db.Exec(reportProxiesTable); err != nil {
+        return fmt.Errorf("create report_proxies: %w", err)
+    }
+    // Proxy who prepared a report on behalf of its owner
+    if err := ensureColumn(db, "expense_reports", "prepared_by", "INTEGER REFERENCES users(id) ON DELETE SET NULL"); err != nil {
+        return err
+    }
+    // Create REPORT_APPROVAL_STEPS table holding the approval chain of submitted reports
+    approvalStepsTable := `CREATE TABLE IF NOT EXISTS report_approval_steps (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        report_id INTEGER NOT NULL,
+        position INTEGER NOT NULL,
+        name TEXT NOT NULL,
+        approver TEXT NOT NULL,
+        approver_id INTEGER,
+        approver_group_id INTEGER,
+        status TEXT NOT NULL DEFAULT 'pending',
+        decided_by INTEGER,
+        decided_at DATETIME,
+        UNIQUE(report_id, position),
+        FOREIGN KEY(report_id) REFERENCES expense_reports(id) ON DELETE CASCADE,
+        FOREIGN KEY(approver_id) REFERENCES users(id) ON DELETE SET NULL,
+        FOREIGN KEY(approver_group_id) REFERENCES groups(id) ON DELETE SET NULL,
+        FOREIGN KEY(decided_by) REFERENCES users(id) ON DELETE SET NULL
+    )`;
+    if _, err := db.Exec(approvalStepsTable); err != nil {
+        return fmt.Errorf("create report_approval_steps: %w", err)
+    }
+    // Decision comment of a step, the reason of a rejection
+    if err := ensureColumn(db, "report_approval_steps", "comment", "TEXT"); err != nil {
+        return err
+    }
+    // Backup approver group of a step escalated past the approval SLA
+    if err := ensureColumn(db, "report_approval_steps", "escalated_group_id", "INTEGER REFERENCES groups(id) ON DELETE SET NULL"); err != nil {
+        return err
+    }
+    if err := ensureColumn(db, "report_approval_steps", "escalated_at", "DATETIME"); err != nil {
+        return err
+    }
+    // Validator a delegate decided a step on behalf of
+    if err := ensureColumn(db, "report_approval_steps", "on_behalf_of", "INTEGER REFERENCES users(id) ON DELETE SET NULL"); err != nil {
+        return err
+    }
+    // Create REPORT_COMMENTS table holding the thread between a submitter and the reviewers
+    reportCommentsTable := `CREATE TABLE IF NOT EXISTS report_comments (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        report_id INTEGER NOT NULL,
+        author_id INTEGER,
+        body TEXT NOT NULL,
+        created_at DATETIME NOT NULL,
+        FOREIGN KEY(report_id) REFERENCES expense_reports(id) ON DELETE CASCADE,
+        FOREIGN KEY(author_id) REFERENCES users(id) ON DELETE SET NULL
+    )`;
+    if _, err := db.Exec(reportCommentsTable); err != nil {
+        return fmt.Errorf("create report_comments: %w", err)
+    }
+    // Create REPORT_STATUS_HISTORY table recording every status change of a report
+    statusHistoryTable := `CREATE TABLE IF NOT EXISTS report_status_history (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        report_id INTEGER NOT NULL,
+        actor_id INTEGER,
+        from_status TEXT,
+        to_status TEXT NOT NULL,
+        comment TEXT,
+        created_at DATETIME NOT NULL,
+        FOREIGN KEY(report_id) REFERENCES expense_reports(id) ON DELETE CASCADE,
+        FOREIGN KEY(actor_id) REFERENCES users(id) ON DELETE SET NULL
+    )`;
+    if _, err := db.Exec(statusHistoryTable); err != nil {
+        return fmt.Errorf("create report_status_history: %w", err)
+    }
+    // Create NOTIFICATIONS table holding the in-app notifications of users
+    notificationsTable := `CREATE TABLE IF NOT EXISTS notifications (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        user_id INTEGER NOT NULL,
+        report_id INTEGER,
+        kind TEXT NOT NULL,
+        message TEXT NOT NULL,
+        created_at DATETIME NOT NULL,
+        read_at DATETIME,
+        FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE,
+        FOREIGN KEY(report_id) REFERENCES expense_reports(id) ON DELETE CASCADE
+    )`;
+    if _, err := db.Exec(notificationsTable); err != nil {
+        return fmt.Errorf("create notifications: %w", err)
+    }
+    // Create PAYMENT_BATCHES table grouping the approved reports reimbursed together
+    paymentBatchesTable := `CREATE TABLE IF NOT EXISTS payment_batches (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        status TEXT NOT NULL DEFAULT 'open',
+        reference TEXT,
+        paid_at TEXT,
+        paid_by INTEGER,
+        created_by INTEGER,
+        created_at DATETIME NOT NULL,
+        FOREIGN KEY(paid_by) REFERENCES users(id) ON DELETE SET NULL,
+        FOREIGN KEY(created_by) REFERENCES users(id) ON DELETE SET NULL
+    )`;
+    if _, err := db.Exec(paymentBatchesTable); err != nil {
+        return fmt.Errorf("create payment_batches: %w", err)
+    }
+    // Payment batch of an approved or paid report
+    if err := ensureColumn(db, "expense_reports", "payment_batch_id", "INTEGER REFERENCES payment_batches(id) ON DELETE SET NULL"); err != nil {
+        return err
+    }
+    // Create APPROVAL_AUDIT table recording approval decisions and refused attempts
+    approvalAuditTable := `CREATE TABLE IF NOT EXISTS approval_audit (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        report_id INTEGER NOT NULL,
+        step TEXT NOT NULL,
+        actor_id INTEGER,
+        action TEXT NOT NULL,
+        outcome TEXT NOT NULL,
+        created_at DATETIME NOT NULL,
+        FOREIGN KEY(report_id) REFERENCES expense_reports(id) ON DELETE CASCADE,
+        FOREIGN KEY(actor_id) REFERENCES users(id) ON DELETE SET NULL
+    )`;
+    if _, err := db.Exec(approvalAuditTable); err != nil {
+        return fmt.Errorf("create approval_audit: %w", err)
+    }
+    // Validator a delegate acted on behalf of
+    if err := ensureColumn(db, "approval_audit", "on_behalf_of", "INTEGER REFERENCES users(id) ON DELETE SET NULL"); err != nil {
+        return err
+    }
+    // Create APPROVAL_DELEGATIONS table holding the approval rights validators hand over
+    // for a date range
+    approvalDelegationsTable := `CREATE TABLE IF NOT EXISTS approval_delegations (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        delegator_id INTEGER NOT NULL,
+        delegate_id INTEGER NOT NULL,
+        starts_on TEXT NOT NULL,
+        ends_on TEXT NOT NULL,
+        created_at DATETIME NOT NULL,
+        FOREIGN KEY(delegator_id) REFERENCES users(id) ON DELETE CASCADE,
+        FOREIGN KEY(delegate_id) REFERENCES users(id) ON DELETE CASCADE
+    )`;
+    if _, err := db.Exec(approvalDelegationsTable); err != nil {
+        return fmt.Errorf("create approval_delegations: %w", err)
+    }
+    // Create SCHEMA_MIGRATIONS table recording the data migrations already applied
+    schemaMigrationsTable := `CREATE TABLE IF NOT EXISTS schema_migrations (
+        name TEXT PRIMARY KEY,
+        applied_at DATETIME NOT NULL
+    )`;
+    if _, err := db.Exec(schemaMigrationsTable); err != nil {
+        return fmt.Errorf("create schema_migrations: %w", err)
+    }
     // Seed permissions and default groups
     if err := seedPermissionsAndGroups(db); err != nil {
         return err
     }
+    if err := applyPermissionMigrations(db); err != nil {
+        return err
+    }
+    if err := flagDefaultAdminPassword(db); err != nil {
+        return err
+    }
     // Seed super admin if none exists
     if err := seedSuperAdmin(db); err != nil {
         return err
@@ -144,7 +540,95 @@ func InitDB(db *sql.DB) error {
     return nil
 }
 
-// seedPermissionsAndGroups inserts predefined permissions and groups if they do not already exist.
+// migrateLegacyAPITokens converts an api_tokens table created by earlier versions, which
+// stored tokens in plaintext, to the hashed layout. It is a no-op when the table does not
+// exist or has already been migrated.
+func migrateLegacyAPITokens(db *sql.DB) error {
+    legacy, err := tableHasColumn(db, "api_tokens", "token")
+    if err != nil {
+        return err
+    }
+    if !legacy {
+        return nil
+    }
+    type legacyToken struct {
+        userID    int64
+        token     string
+        createdAt time.Time
+    }
+    rows, err := db.Query("SELECT user_id, token, created_at FROM api_tokens")
+    if err != nil {
+        return fmt.Errorf("read legacy api_tokens: %w", err)
+    }
+    var tokens []legacyToken
+    for rows.Next() {
+        var t legacyToken
+        if err := rows.Scan(&t.userID, &t.token, &t.createdAt); err != nil {
+            rows.Close()
+            return fmt.Errorf("scan legacy api token: %w", err)
+        }
+        tokens = append(tokens, t)
+    }
+    rows.Close()
+    tx, err := db.Begin()
+    if err != nil {
+        return fmt.Errorf("begin api_tokens migration: %w", err)
+    }
+    defer tx.Rollback()
+    if _, err := tx.Exec("DROP TABLE api_tokens"); err != nil {
+        return fmt.Errorf("drop legacy api_tokens: %w", err)
+    }
+    if _, err := tx.Exec(apiTokensTable); err != nil {
+        return fmt.Errorf("create api_tokens: %w", err)
+    }
+    for _, t := range tokens {
+        if _, err := tx.Exec("INSERT INTO api_tokens (user_id, prefix, token_hash, created_at) VALUES (?, ?, ?, ?)", t.userID, apiTokenPrefix(t.token), hashAPIToken(t.token), t.createdAt); err != nil {
+            return fmt.Errorf("migrate api token for user %d: %w", t.userID, err)
+        }
+    }
+    return tx.Commit()
+}
+
+// tableHasColumn reports whether the given table exists and has the named column.
+func tableHasColumn(db *sql.DB, table, column string) (bool, error) {
+    rows, err := db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+    if err != nil {
+        return false, fmt.Errorf("table info %s: %w", table, err)
+    }
+    defer rows.Close()
+    for rows.Next() {
+        var cid int
+        var name, colType string
+        var notNull, pk int
+        var dflt sql.NullString
+        if err := rows.Scan(&cid, &name, &colType, &notNull, &dflt, &pk); err != nil {
+            return false, fmt.Errorf("scan table info %s: %w", table, err)
+        }
+        if name == column {
+            return true, nil
+        }
+    }
+    return false, rows.Err()
+}
+
+// ensureColumn adds a column to an existing table when it is missing. It lets InitDB
+// upgrade databases created by earlier versions of the schema.
+func ensureColumn(db *sql.DB, table, column, definition string) error {
+    exists, err := tableHasColumn(db, table, column)
+    if err != nil {
+        return err
+    }
+    if exists {
+        return nil
+    }
+    if _, err := db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition)); err != nil {
+        return fmt.Errorf("add column %s.%s: %w", table, column, err)
+    }
+    return nil
+}
+
+// seedPermissionsAndGroups inserts predefined permissions and groups if they do not already
+// exist. A group's permissions are only seeded when the group is created.
 func seedPermissionsAndGroups(db *sql.DB) error {
     // List of default permissions following the specification
     permissions := []string{
@@ -152,15 +636,26 @@ func seedPermissionsAndGroups(db *sql.DB) error {
         "reports:update:own",
         "reports:read:own",
         "reports:read:all",
+        "reports:read:scoped",
         "reports:approve",
         "reports:reject",
         "users:read",
         "users:create",
+        "users:update",
+        "users:delete",
         "groups:read",
         "groups:create",
+        "groups:update",
+        "groups:delete",
         "permissions:assign",
         "tokens:create",
+        "tokens:read",
+        "tokens:revoke",
+        "sessions:revoke",
         "reports:export:all",
+        "audit:read",
+        "reports:pay",
+        "reports:approve:high",
     }
     for _, action := range permissions {
         var id int
@@ -185,12 +680,22 @@ func seedPermissionsAndGroups(db *sql.DB) error {
         },
         {
             name: "Validateurs",
-            permissions: []string{"reports:read:all", "reports:approve", "reports:reject"},
+            permissions: []string{"reports:read:scoped", "reports:approve", "reports:reject"},
         },
         {
             name: "Utilisateurs",
             permissions: []string{"reports:create", "reports:update:own", "reports:read:own"},
         },
+        // Approvers of the default finance and director approval steps; Finance also
+        // reimburses approved reports
+        {
+            name: "Finance",
+            permissions: []string{"reports:read:scoped", "reports:approve", "reports:reject", "reports:pay"},
+        },
+        {
+            name: "Direction",
+            permissions: []string{"reports:read:scoped", "reports:approve", "reports:reject", "reports:approve:high"},
+        },
     }
     for _, def := range defs {
         var groupID int64
@@ -203,6 +708,10 @@ func seedPermissionsAndGroups(db *sql.DB) error {
             groupID, _ = res.LastInsertId()
         } else if err != nil {
             return fmt.Errorf("select group %s: %w", def.name, err)
+        } else {
+            // Existing groups keep the permissions administrators gave them; permissions
+            // introduced later reach them through permissionMigrations
+            continue
         }
         // Assign permissions
         for _, perm := range def.permissions {
@@ -225,6 +734,122 @@ func seedPermissionsAndGroups(db *sql.DB) error {
     return nil
 }
 
+// permissionMigration changes the permissions of an existing default group once, for
+// databases created before the group's seeded permissions changed.
+type permissionMigration struct {
+    name   string
+    group  string
+    grant  []string
+    revoke []string
+}
+
+// permissionMigrations are applied in order, each once, and recorded in schema_migrations.
+// Append new migrations; never edit or reorder applied ones.
+var permissionMigrations = []permissionMigration{
+    // Validators review the reports of their scope instead of every report
+    {name: "validators-scoped-read", group: "Validateurs", grant: []string{"reports:read:scoped"}, revoke: []string{"reports:read:all"}},
+    // Administrators get the permissions introduced since the first release
+    {name: "administrators-new-permissions", group: "Administrateurs", grant: []string{
+        "reports:read:scoped", "users:update", "users:delete", "groups:update", "groups:delete",
+        "tokens:read", "tokens:revoke", "sessions:revoke", "audit:read", "reports:pay", "reports:approve:high",
+    }},
+    // Finance reimburses approved reports and Direction approves high value ones
+    {name: "finance-reports-pay", group: "Finance", grant: []string{"reports:pay"}},
+    {name: "direction-approve-high", group: "Direction", grant: []string{"reports:approve:high"}},
+}
+
+// applyPermissionMigrations applies the permission migrations not applied yet. A migration
+// of a group that no longer exists is recorded without effect.
+func applyPermissionMigrations(db *sql.DB) error {
+    for _, m := range permissionMigrations {
+        var applied bool
+        if err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM schema_migrations WHERE name = ?)", m.name).Scan(&applied); err != nil {
+            return fmt.Errorf("check migration %s: %w", m.name, err)
+        }
+        if applied {
+            continue
+        }
+        if err := applyPermissionMigration(db, m); err != nil {
+            return fmt.Errorf("apply migration %s: %w", m.name, err)
+        }
+        fmt.Printf("[INFO] Applied migration %s\n", m.name)
+    }
+    return nil
+}
+
+// applyPermissionMigration applies a permission migration and records it in one transaction.
+func applyPermissionMigration(db *sql.DB, m permissionMigration) error {
+    tx, err := db.Begin()
+    if err != nil {
+        return err
+    }
+    defer tx.Rollback()
+    var groupID int64
+    err = tx.QueryRow("SELECT id FROM groups WHERE name = ?", m.group).Scan(&groupID)
+    if err != nil && !errors.Is(err, sql.ErrNoRows) {
+        return err
+    }
+    if err == nil {
+        for _, perm := range m.revoke {
+            if _, err := tx.Exec(`DELETE FROM group_permissions WHERE group_id = ?
+                AND permission_id = (SELECT id FROM permissions WHERE action = ?)`, groupID, perm); err != nil {
+                return err
+            }
+        }
+        for _, perm := range m.grant {
+            if _, err := tx.Exec(`INSERT OR IGNORE INTO group_permissions (group_id, permission_id)
+                SELECT ?, id FROM permissions WHERE action = ?`, groupID, perm); err != nil {
+                return err
+            }
+        }
+    }
+    if _, err := tx.Exec("INSERT INTO schema_migrations (name, applied_at) VALUES (?, ?)", m.name, time.Now().UTC()); err != nil {
+        return err
+    }
+    return tx.Commit()
+}
+
+// defaultAdminPasswordMigration names the migration of flagDefaultAdminPassword.
+const defaultAdminPasswordMigration = "default-admin-password"
+
+// flagDefaultAdminPassword makes the super admin seeded before password changes were
+// enforced change the default password on next login, if it still uses it. It runs once.
+func flagDefaultAdminPassword(db *sql.DB) error {
+    var applied bool
+    if err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM schema_migrations WHERE name = ?)", defaultAdminPasswordMigration).Scan(&applied); err != nil {
+        return fmt.Errorf("check migration %s: %w", defaultAdminPasswordMigration, err)
+    }
+    if applied {
+        return nil
+    }
+    // The seeded super admin is the first account
+    var userID int64
+    var hash string
+    err := db.QueryRow("SELECT id, password_hash FROM users ORDER BY id LIMIT 1").Scan(&userID, &hash)
+    if err != nil && !errors.Is(err, sql.ErrNoRows) {
+        return fmt.Errorf("select super admin: %w", err)
+    }
+    tx, err := db.Begin()
+    if err != nil {
+        return err
+    }
+    defer tx.Rollback()
+    if hash != "" && checkPassword(hash, "admin") == nil {
+        if _, err := tx.Exec("UPDATE users SET must_change_password = 1 WHERE id = ?", userID); err != nil {
+            return fmt.Errorf("flag default admin password: %w", err)
+        }
+        fmt.Printf("[INFO] User %d still uses the default password, it must be changed on next login\n", userID)
+    }
+    if _, err := tx.Exec("INSERT INTO schema_migrations (name, applied_at) VALUES (?, ?)", defaultAdminPasswordMigration, time.Now().UTC()); err != nil {
+        return err
+    }
+    if err := tx.Commit(); err != nil {
+        return err
+    }
+    fmt.Printf("[INFO] Applied migration %s\n", defaultAdminPasswordMigration)
+    return nil
+}
+
 // seedSuperAdmin ensures that at least one user exists. If none, it creates a default super admin
 // user and assigns them to the Administrateurs group. The default credentials are read from
 // environment variables ADMIN_EMAIL and ADMIN_PASSWORD, with fallbacks.
@@ -242,15 +867,20 @@ func seedSuperAdmin(db *sql.DB) error {
 		email = "admin@example.com"
 	}
 	password := os.Getenv("ADMIN_PASSWORD")
+	// The default password is public knowledge, it must be changed on first login
+	mustChange := password == ""
 	if password == "" {
 		password = "admin"
+	} else if err := passwordPolicy.Validate(password, email); err != nil {
+		fmt.Printf("[WARN] ADMIN_PASSWORD does not meet the password policy (%v), it must be changed on first login\n", err)
+		mustChange = true
 	}
     // Hash password using bcrypt
     hash, err := hashPassword(password)
     if err != nil {
         return fmt.Errorf("hash default password: %w", err)
     }
-    res, err := db.Exec("INSERT INTO users (email, password_hash, created_at) VALUES (?, ?, ?)", email, hash, time.Now().UTC())
+    res, err := db.Exec("INSERT INTO users (email, password_hash, must_change_password, created_at) VALUES (?, ?, ?, ?)", email, hash, mustChange, time.Now().UTC())
     if err != nil {
         return fmt.Errorf("insert super admin user: %w", err)
     }
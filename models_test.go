@@ -0,0 +1,115 @@
+package main
+
+import (
+	"database/sql"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// groupPermissions returns the permissions of a group by action.
+func groupPermissions(t *testing.T, db *sql.DB, group string) map[string]bool {
+	t.Helper()
+	rows, err := db.Query(`SELECT p.action FROM permissions p
+		JOIN group_permissions gp ON gp.permission_id = p.id
+		JOIN groups g ON g.id = gp.group_id
+		WHERE g.name = ?`, group)
+	require.NoError(t, err)
+	defer rows.Close()
+	perms := map[string]bool{}
+	for rows.Next() {
+		var action string
+		require.NoError(t, rows.Scan(&action))
+		perms[action] = true
+	}
+	require.NoError(t, rows.Err())
+	return perms
+}
+
+func TestInitDBMigratesValidatorsToScopedRead(t *testing.T) {
+	db := newTestDB(t)
+	// Layout of a database created before validation scopes
+	_, err := db.Exec(`DELETE FROM group_permissions
+		WHERE group_id = (SELECT id FROM groups WHERE name = 'Validateurs')
+		AND permission_id = (SELECT id FROM permissions WHERE action = 'reports:read:scoped')`)
+	require.NoError(t, err)
+	_, err = db.Exec(`INSERT INTO group_permissions (group_id, permission_id)
+		SELECT g.id, p.id FROM groups g, permissions p WHERE g.name = 'Validateurs' AND p.action = 'reports:read:all'`)
+	require.NoError(t, err)
+	_, err = db.Exec("DELETE FROM schema_migrations")
+	require.NoError(t, err)
+
+	require.NoError(t, InitDB(db))
+	perms := groupPermissions(t, db, "Validateurs")
+	assert.True(t, perms[PermReportsReadScoped])
+	assert.False(t, perms[PermReportsReadAll])
+	assert.True(t, perms[PermReportsApprove])
+
+	// Applied once: an administrator's later choice is kept
+	_, err = db.Exec(`INSERT INTO group_permissions (group_id, permission_id)
+		SELECT g.id, p.id FROM groups g, permissions p WHERE g.name = 'Validateurs' AND p.action = 'reports:read:all'`)
+	require.NoError(t, err)
+	require.NoError(t, InitDB(db))
+	assert.True(t, groupPermissions(t, db, "Validateurs")[PermReportsReadAll])
+}
+
+func TestInitDBKeepsAdministratorRevocations(t *testing.T) {
+	db := newTestDB(t)
+	_, err := db.Exec(`DELETE FROM group_permissions
+		WHERE group_id = (SELECT id FROM groups WHERE name = 'Administrateurs')
+		AND permission_id = (SELECT id FROM permissions WHERE action = ?)`, PermReportsExportAll)
+	require.NoError(t, err)
+
+	require.NoError(t, InitDB(db))
+	perms := groupPermissions(t, db, "Administrateurs")
+	assert.False(t, perms[PermReportsExportAll])
+	assert.True(t, perms[PermUsersRead])
+}
+
+func TestInitDBGrantsNewPermissionsOnce(t *testing.T) {
+	db := newTestDB(t)
+	_, err := db.Exec(`DELETE FROM group_permissions
+		WHERE group_id IN (SELECT id FROM groups WHERE name IN ('Administrateurs', 'Finance'))
+		AND permission_id = (SELECT id FROM permissions WHERE action = ?)`, PermReportsPay)
+	require.NoError(t, err)
+	_, err = db.Exec("DELETE FROM schema_migrations")
+	require.NoError(t, err)
+
+	require.NoError(t, InitDB(db))
+	assert.True(t, groupPermissions(t, db, "Administrateurs")[PermReportsPay])
+	assert.True(t, groupPermissions(t, db, "Finance")[PermReportsPay])
+}
+
+func TestInitDBFlagsDefaultAdminPassword(t *testing.T) {
+	db := newTestDB(t)
+	_, err := db.Exec("DELETE FROM schema_migrations WHERE name = ?", defaultAdminPasswordMigration)
+	require.NoError(t, err)
+
+	require.NoError(t, InitDB(db))
+	var mustChange bool
+	require.NoError(t, db.QueryRow("SELECT must_change_password FROM users WHERE id = 1").Scan(&mustChange))
+	assert.True(t, mustChange)
+
+	// Applied once: an administrator who keeps the flag cleared is not asked again
+	_, err = db.Exec("UPDATE users SET must_change_password = 0")
+	require.NoError(t, err)
+	require.NoError(t, InitDB(db))
+	require.NoError(t, db.QueryRow("SELECT must_change_password FROM users WHERE id = 1").Scan(&mustChange))
+	assert.False(t, mustChange)
+}
+
+func TestInitDBKeepsChangedAdminPassword(t *testing.T) {
+	db := newTestDB(t)
+	hash, err := hashPassword("a-much-longer-secret")
+	require.NoError(t, err)
+	_, err = db.Exec("UPDATE users SET password_hash = ? WHERE id = 1", hash)
+	require.NoError(t, err)
+	_, err = db.Exec("DELETE FROM schema_migrations WHERE name = ?", defaultAdminPasswordMigration)
+	require.NoError(t, err)
+
+	require.NoError(t, InitDB(db))
+	var mustChange bool
+	require.NoError(t, db.QueryRow("SELECT must_change_password FROM users WHERE id = 1").Scan(&mustChange))
+	assert.False(t, mustChange)
+}
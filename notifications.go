@@ -0,0 +1,117 @@
+package main
+
+import (
+    "fmt"
+    "net/http"
+    "strconv"
+    "time"
+
+    "github.com/gin-gonic/gin"
+)
+
+// Notification is an in-app message about a report, shown to a user until they read it.
+type Notification struct {
+    ID        int64      `json:"id"`
+    ReportID  *int64     `json:"report_id,omitempty"`
+    Kind      string     `json:"kind"`
+    Message   string     `json:"message"`
+    CreatedAt time.Time  `json:"created_at"`
+    ReadAt    *time.Time `json:"read_at,omitempty"`
+}
+
+// Kinds of notification.
+const (
+    NotifyReportWithdrawn = "report_withdrawn"
+    NotifyReportPaid      = "report_paid"
+    NotifyReportEscalated = "report_escalated"
+)
+
+// notifyUsers sends a notification about a report to each user.
+func notifyUsers(q execer, userIDs []int64, reportID int64, kind, message string) error {
+    now := time.Now().UTC()
+    for _, id := range userIDs {
+        _, err := q.Exec("INSERT INTO notifications (user_id, report_id, kind, message, created_at) VALUES (?, ?, ?, ?, ?)",
+            id, reportID, kind, message, now)
+        if err != nil {
+            return fmt.Errorf("insert notification: %w", err)
+        }
+    }
+    return nil
+}
+
+// stepApprovers returns the users a pending step waits for: its approver or the members of
+// its approver group, and the members of its backup group once escalated. A manager step
+// without a manager waits for the validators scoped to one of the owner's groups.
+func stepApprovers(q queryer, ownerID int64, step *ApprovalStep) ([]int64, error) {
+    var scopedOwner *int64
+    if step.Approver == ApproverManager && step.ApproverID == nil {
+        scopedOwner = &ownerID
+    }
+    rows, err := q.Query(`SELECT id FROM users WHERE id = ?
+        UNION SELECT user_id FROM user_groups WHERE group_id IN (?, ?)
+        UNION SELECT vs.validator_id FROM validator_scopes vs
+            JOIN user_groups ug ON ug.group_id = vs.group_id
+            WHERE ug.user_id = ? AND vs.validator_id != ug.user_id
+        ORDER BY 1`, step.ApproverID, step.ApproverGroupID, step.EscalatedGroupID, scopedOwner)
+    if err != nil {
+        return nil, fmt.Errorf("select step approvers: %w", err)
+    }
+    defer rows.Close()
+    var ids []int64
+    for rows.Next() {
+        var id int64
+        if err := rows.Scan(&id); err != nil {
+            return nil, fmt.Errorf("select step approvers: %w", err)
+        }
+        ids = append(ids, id)
+    }
+    return ids, rows.Err()
+}
+
+// ListNotifications returns the notifications of the current user, newest first. With
+// ?unread=true only the unread ones are returned.
+func (h *Handlers) ListNotifications(c *gin.Context) {
+    userIDIfc, _ := c.Get(ContextUserIDKey)
+    userID := userIDIfc.(int64)
+    query := "SELECT id, report_id, kind, message, created_at, read_at FROM notifications WHERE user_id = ?"
+    if c.Query("unread") == "true" {
+        query += " AND read_at IS NULL"
+    }
+    rows, err := h.db.Query(query+" ORDER BY id DESC", userID)
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
+        return
+    }
+    defer rows.Close()
+    notifications := []Notification{}
+    for rows.Next() {
+        var n Notification
+        if err := rows.Scan(&n.ID, &n.ReportID, &n.Kind, &n.Message, &n.CreatedAt, &n.ReadAt); err != nil {
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
+            return
+        }
+        notifications = append(notifications, n)
+    }
+    c.JSON(http.StatusOK, notifications)
+}
+
+// MarkNotificationRead marks a notification of the current user as read.
+func (h *Handlers) MarkNotificationRead(c *gin.Context) {
+    id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+    if err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "invalid notification id"})
+        return
+    }
+    userIDIfc, _ := c.Get(ContextUserIDKey)
+    userID := userIDIfc.(int64)
+    res, err := h.db.Exec("UPDATE notifications SET read_at = COALESCE(read_at, ?) WHERE id = ? AND user_id = ?", time.Now().UTC(), id, userID)
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
+        return
+    }
+    if n, _ := res.RowsAffected(); n == 0 {
+        c.JSON(http.StatusNotFound, gin.H{"error": "notification not found"})
+        return
+    }
+    c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,445 @@
+package main
+
+import (
+    "crypto/ecdsa"
+    "crypto/ed25519"
+    "crypto/elliptic"
+    "crypto/rsa"
+    "crypto/sha256"
+    "database/sql"
+    "encoding/base64"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "log"
+    "math/big"
+    "net/http"
+    "net/url"
+    "os"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/gin-gonic/gin"
+    "github.com/golang-jwt/jwt/v5"
+)
+
+// oidcStateTTL bounds the time between starting a single sign-on login and its callback.
+const oidcStateTTL = 10 * time.Minute
+
+// OIDCConfig holds the OpenID Connect relying party settings.
+type OIDCConfig struct {
+    Issuer            string
+    ClientID          string
+    ClientSecret      string
+    RedirectURL       string
+    Scopes            []string
+    GroupsClaim       string
+    GroupMapping      GroupMapping
+    PostLoginRedirect string
+}
+
+// LoadOIDCConfig reads the OpenID Connect settings from the environment. It returns nil
+// when OIDC_ISSUER is not set, which disables single sign-on.
+func LoadOIDCConfig() *OIDCConfig {
+    issuer := os.Getenv("OIDC_ISSUER")
+    if issuer == "" {
+        return nil
+    }
+    cfg := &OIDCConfig{
+        Issuer:            strings.TrimSuffix(issuer, "/"),
+        ClientID:          os.Getenv("OIDC_CLIENT_ID"),
+        ClientSecret:      os.Getenv("OIDC_CLIENT_SECRET"),
+        RedirectURL:       os.Getenv("OIDC_REDIRECT_URL"),
+        Scopes:            strings.Fields("openid email profile"),
+        GroupsClaim:       "groups",
+        GroupMapping:      parseGroupMapping(os.Getenv("OIDC_GROUP_MAPPING")),
+        PostLoginRedirect: "/",
+    }
+    if v := os.Getenv("OIDC_SCOPES"); v != "" {
+        cfg.Scopes = strings.Fields(v)
+    }
+    if v := os.Getenv("OIDC_GROUPS_CLAIM"); v != "" {
+        cfg.GroupsClaim = v
+    }
+    if v := os.Getenv("OIDC_POST_LOGIN_REDIRECT"); v != "" {
+        cfg.PostLoginRedirect = v
+    }
+    return cfg
+}
+
+// oidcDiscovery is the subset of the provider metadata used by the login flow.
+type oidcDiscovery struct {
+    Issuer                string `json:"issuer"`
+    AuthorizationEndpoint string `json:"authorization_endpoint"`
+    TokenEndpoint         string `json:"token_endpoint"`
+    JWKSURI               string `json:"jwks_uri"`
+}
+
+// OIDCProvider performs the authorization code flow with PKCE against an identity
+// provider. Provider metadata and signing keys are fetched lazily and cached.
+type OIDCProvider struct {
+    cfg    *OIDCConfig
+    client *http.Client
+
+    mu        sync.Mutex
+    discovery *oidcDiscovery
+    keys      map[string]interface{}
+}
+
+// NewOIDCProvider creates a provider for the given configuration.
+func NewOIDCProvider(cfg *OIDCConfig) *OIDCProvider {
+    return &OIDCProvider{cfg: cfg, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+// getJSON fetches a JSON document from the identity provider.
+func (p *OIDCProvider) getJSON(u string, out interface{}) error {
+    resp, err := p.client.Get(u)
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode != http.StatusOK {
+        return fmt.Errorf("GET %s: status %d", u, resp.StatusCode)
+    }
+    return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// metadata returns the provider metadata, fetching it on first use.
+func (p *OIDCProvider) metadata() (*oidcDiscovery, error) {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    if p.discovery != nil {
+        return p.discovery, nil
+    }
+    var d oidcDiscovery
+    if err := p.getJSON(p.cfg.Issuer+"/.well-known/openid-configuration", &d); err != nil {
+        return nil, fmt.Errorf("oidc discovery: %w", err)
+    }
+    if strings.TrimSuffix(d.Issuer, "/") != p.cfg.Issuer {
+        return nil, fmt.Errorf("oidc discovery: issuer mismatch %q", d.Issuer)
+    }
+    p.discovery = &d
+    return p.discovery, nil
+}
+
+// signingKey returns the provider key with the given kid. The key set is refetched when
+// the kid is unknown, which picks up key rotations at the provider.
+func (p *OIDCProvider) signingKey(kid string) (interface{}, error) {
+    p.mu.Lock()
+    key, ok := p.keys[kid]
+    p.mu.Unlock()
+    if ok {
+        return key, nil
+    }
+    meta, err := p.metadata()
+    if err != nil {
+        return nil, err
+    }
+    var set struct {
+        Keys []map[string]string `json:"keys"`
+    }
+    if err := p.getJSON(meta.JWKSURI, &set); err != nil {
+        return nil, fmt.Errorf("oidc jwks: %w", err)
+    }
+    keys := make(map[string]interface{}, len(set.Keys))
+    for _, jwk := range set.Keys {
+        k, err := parseJWK(jwk)
+        if err != nil {
+            log.Printf("[WARN] ignoring OIDC signing key %q: %v", jwk["kid"], err)
+            continue
+        }
+        keys[jwk["kid"]] = k
+    }
+    p.mu.Lock()
+    p.keys = keys
+    p.mu.Unlock()
+    if key, ok := keys[kid]; ok {
+        return key, nil
+    }
+    return nil, fmt.Errorf("unknown oidc signing key %q", kid)
+}
+
+// parseJWK converts a JSON Web Key to a public key usable by jwt.
+func parseJWK(jwk map[string]string) (interface{}, error) {
+    decode := func(name string) ([]byte, error) {
+        b, err := base64.RawURLEncoding.DecodeString(jwk[name])
+        if err != nil || len(b) == 0 {
+            return nil, fmt.Errorf("invalid %s", name)
+        }
+        return b, nil
+    }
+    switch jwk["kty"] {
+    case "RSA":
+        n, err := decode("n")
+        if err != nil {
+            return nil, err
+        }
+        e, err := decode("e")
+        if err != nil {
+            return nil, err
+        }
+        return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+    case "EC":
+        var curve elliptic.Curve
+        switch jwk["crv"] {
+        case "P-256":
+            curve = elliptic.P256()
+        case "P-384":
+            curve = elliptic.P384()
+        default:
+            return nil, fmt.Errorf("unsupported curve %q", jwk["crv"])
+        }
+        x, err := decode("x")
+        if err != nil {
+            return nil, err
+        }
+        y, err := decode("y")
+        if err != nil {
+            return nil, err
+        }
+        return &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+    case "OKP":
+        x, err := decode("x")
+        if err != nil {
+            return nil, err
+        }
+        if jwk["crv"] != "Ed25519" || len(x) != ed25519.PublicKeySize {
+            return nil, fmt.Errorf("unsupported curve %q", jwk["crv"])
+        }
+        return ed25519.PublicKey(x), nil
+    }
+    return nil, fmt.Errorf("unsupported key type %q", jwk["kty"])
+}
+
+// pkceChallenge derives the S256 code challenge of a PKCE code verifier.
+func pkceChallenge(verifier string) string {
+    sum := sha256.Sum256([]byte(verifier))
+    return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// oidcIdentity is the identity asserted by a verified ID token.
+type oidcIdentity struct {
+    Subject string
+    Email   string
+    Groups  []string
+}
+
+// exchangeCode redeems an authorization code and verifies the returned ID token.
+func (p *OIDCProvider) exchangeCode(code, verifier, nonce string) (*oidcIdentity, error) {
+    meta, err := p.metadata()
+    if err != nil {
+        return nil, err
+    }
+    form := url.Values{
+        "grant_type":    {"authorization_code"},
+        "code":          {code},
+        "redirect_uri":  {p.cfg.RedirectURL},
+        "client_id":     {p.cfg.ClientID},
+        "code_verifier": {verifier},
+    }
+    req, err := http.NewRequest(http.MethodPost, meta.TokenEndpoint, strings.NewReader(form.Encode()))
+    if err != nil {
+        return nil, err
+    }
+    req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+    if p.cfg.ClientSecret != "" {
+        req.SetBasicAuth(url.QueryEscape(p.cfg.ClientID), url.QueryEscape(p.cfg.ClientSecret))
+    }
+    resp, err := p.client.Do(req)
+    if err != nil {
+        return nil, fmt.Errorf("oidc token request: %w", err)
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode != http.StatusOK {
+        return nil, fmt.Errorf("oidc token request: status %d", resp.StatusCode)
+    }
+    var tokenResp struct {
+        IDToken string `json:"id_token"`
+    }
+    if err := json.NewDecoder(resp.Body).Decode(&tokenResp); err != nil {
+        return nil, fmt.Errorf("oidc token response: %w", err)
+    }
+    if tokenResp.IDToken == "" {
+        return nil, errors.New("oidc token response has no id_token")
+    }
+    return p.verifyIDToken(tokenResp.IDToken, nonce)
+}
+
+// verifyIDToken checks the signature, issuer, audience, expiry and nonce of an ID token.
+func (p *OIDCProvider) verifyIDToken(raw, nonce string) (*oidcIdentity, error) {
+    claims := jwt.MapClaims{}
+    _, err := jwt.ParseWithClaims(raw, claims, func(token *jwt.Token) (interface{}, error) {
+        kid, _ := token.Header["kid"].(string)
+        return p.signingKey(kid)
+    },
+        jwt.WithValidMethods([]string{"RS256", "ES256", "ES384", "EdDSA"}),
+        jwt.WithIssuer(p.cfg.Issuer),
+        jwt.WithAudience(p.cfg.ClientID),
+        jwt.WithExpirationRequired(),
+    )
+    if err != nil {
+        return nil, fmt.Errorf("invalid id_token: %w", err)
+    }
+    if got, _ := claims["nonce"].(string); got != nonce {
+        return nil, errors.New("invalid id_token: nonce mismatch")
+    }
+    if verified, ok := claims["email_verified"].(bool); ok && !verified {
+        return nil, errors.New("email address is not verified by the identity provider")
+    }
+    id := &oidcIdentity{}
+    id.Subject, _ = claims["sub"].(string)
+    id.Email, _ = claims["email"].(string)
+    if id.Subject == "" {
+        return nil, errors.New("invalid id_token: missing subject")
+    }
+    switch groups := claims[p.cfg.GroupsClaim].(type) {
+    case []interface{}:
+        for _, g := range groups {
+            if name, ok := g.(string); ok {
+                id.Groups = append(id.Groups, name)
+            }
+        }
+    case string:
+        id.Groups = []string{groups}
+    }
+    return id, nil
+}
+
+// OIDCLogin starts a single sign-on login by redirecting to the identity provider.
+func (h *Handlers) OIDCLogin(c *gin.Context) {
+    if h.oidc == nil {
+        c.JSON(http.StatusNotFound, gin.H{"error": "single sign-on is not configured"})
+        return
+    }
+    meta, err := h.oidc.metadata()
+    if err != nil {
+        log.Printf("[ERROR] %v", err)
+        c.JSON(http.StatusBadGateway, gin.H{"error": "identity provider unavailable"})
+        return
+    }
+    state, err1 := randomToken()
+    verifier, err2 := randomToken()
+    nonce, err3 := randomToken()
+    if err1 != nil || err2 != nil || err3 != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to start login"})
+        return
+    }
+    now := time.Now().UTC()
+    if _, err := h.db.Exec("DELETE FROM oidc_login_states WHERE expires_at < ?", now); err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
+        return
+    }
+    if _, err := h.db.Exec("INSERT INTO oidc_login_states (state, code_verifier, nonce, created_at, expires_at) VALUES (?, ?, ?, ?, ?)",
+        state, verifier, nonce, now, now.Add(oidcStateTTL)); err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
+        return
+    }
+    q := url.Values{
+        "response_type":         {"code"},
+        "client_id":             {h.oidc.cfg.ClientID},
+        "redirect_uri":          {h.oidc.cfg.RedirectURL},
+        "scope":                 {strings.Join(h.oidc.cfg.Scopes, " ")},
+        "state":                 {state},
+        "nonce":                 {nonce},
+        "code_challenge":        {pkceChallenge(verifier)},
+        "code_challenge_method": {"S256"},
+    }
+    sep := "?"
+    if strings.Contains(meta.AuthorizationEndpoint, "?") {
+        sep = "&"
+    }
+    c.Redirect(http.StatusFound, meta.AuthorizationEndpoint+sep+q.Encode())
+}
+
+// OIDCCallback completes a single sign-on login. The user is provisioned on first login
+// and their mapped group memberships follow the identity provider's group claim.
+func (h *Handlers) OIDCCallback(c *gin.Context) {
+    if h.oidc == nil {
+        c.JSON(http.StatusNotFound, gin.H{"error": "single sign-on is not configured"})
+        return
+    }
+    if e := c.Query("error"); e != "" {
+        c.JSON(http.StatusUnauthorized, gin.H{"error": "identity provider error: " + e})
+        return
+    }
+    state, code := c.Query("state"), c.Query("code")
+    if state == "" || code == "" {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "state and code are required"})
+        return
+    }
+    // Consume the state so that a callback cannot be replayed
+    var verifier, nonce string
+    var expiresAt time.Time
+    err := h.db.QueryRow("SELECT code_verifier, nonce, expires_at FROM oidc_login_states WHERE state = ?", state).Scan(&verifier, &nonce, &expiresAt)
+    if errors.Is(err, sql.ErrNoRows) {
+        c.JSON(http.StatusUnauthorized, gin.H{"error": "unknown or expired login state"})
+        return
+    } else if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
+        return
+    }
+    res, err := h.db.Exec("DELETE FROM oidc_login_states WHERE state = ?", state)
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
+        return
+    }
+    if count, _ := res.RowsAffected(); count == 0 || !time.Now().UTC().Before(expiresAt) {
+        c.JSON(http.StatusUnauthorized, gin.H{"error": "unknown or expired login state"})
+        return
+    }
+    identity, err := h.oidc.exchangeCode(code, verifier, nonce)
+    if err != nil {
+        log.Printf("[WARN] oidc login failed: %v", err)
+        c.JSON(http.StatusUnauthorized, gin.H{"error": "single sign-on failed"})
+        return
+    }
+    tx, err := h.db.Begin()
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to begin transaction"})
+        return
+    }
+    defer tx.Rollback()
+    userID, err := provisionExternalUser(tx, AuthSourceOIDC, identity.Subject, identity.Email)
+    if err != nil {
+        if errors.Is(err, ErrExternalAccountConflict) {
+            c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+        } else {
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to provision user"})
+        }
+        return
+    }
+    if err := syncMappedGroups(tx, userID, h.oidc.cfg.GroupMapping, identity.Groups); err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to sync groups"})
+        return
+    }
+    if err := tx.Commit(); err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to commit transaction"})
+        return
+    }
+    invalidateUserPermissions(h.db, userID)
+    tokens, err := h.startSession(userID)
+    if errors.Is(err, ErrAccountDisabled) {
+        c.JSON(http.StatusForbidden, gin.H{"error": err.Error(), "code": "account_disabled"})
+        return
+    } else if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to generate token"})
+        return
+    }
+    if h.oidc.cfg.PostLoginRedirect == "" {
+        tokens["user"] = gin.H{"id": userID, "email": identity.Email}
+        c.JSON(http.StatusOK, tokens)
+        return
+    }
+    // Hand the tokens to the single-page app in the URL fragment, which is not sent to servers
+    fragment := url.Values{
+        "token":         {tokens["token"].(string)},
+        "refresh_token": {tokens["refresh_token"].(string)},
+    }
+    c.Redirect(http.StatusFound, h.oidc.cfg.PostLoginRedirect+"#"+fragment.Encode())
+}
+
+// AuthProviders tells the client which login methods are available.
+func (h *Handlers) AuthProviders(c *gin.Context) {
+    c.JSON(http.StatusOK, gin.H{"password": true, "oidc": h.oidc != nil, "ldap": h.ldap != nil})
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// mockOIDCProvider is a minimal OpenID Connect provider. Tests play the browser: they
+// authorize a pending login with authorize() and get back an authorization code.
+type mockOIDCProvider struct {
+	t      *testing.T
+	server *httptest.Server
+	key    *rsa.PrivateKey
+
+	mu    sync.Mutex
+	codes map[string]mockGrant
+}
+
+type mockGrant struct {
+	challenge string
+	nonce     string
+	claims    jwt.MapClaims
+}
+
+func newMockOIDCProvider(t *testing.T) *mockOIDCProvider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	m := &mockOIDCProvider{t: t, key: key, codes: map[string]mockGrant{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 m.server.URL,
+			"authorization_endpoint": m.server.URL + "/authorize",
+			"token_endpoint":         m.server.URL + "/token",
+			"jwks_uri":               m.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "mock-key",
+			"alg": "RS256",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, r.ParseForm())
+		m.mu.Lock()
+		grant, ok := m.codes[r.PostForm.Get("code")]
+		delete(m.codes, r.PostForm.Get("code"))
+		m.mu.Unlock()
+		if !ok || pkceChallenge(r.PostForm.Get("code_verifier")) != grant.challenge {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+		grant.claims["iss"] = m.server.URL
+		grant.claims["aud"] = "expense-app"
+		grant.claims["nonce"] = grant.nonce
+		grant.claims["exp"] = time.Now().Add(time.Minute).Unix()
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, grant.claims)
+		token.Header["kid"] = "mock-key"
+		signed, err := token.SignedString(key)
+		require.NoError(t, err)
+		json.NewEncoder(w).Encode(map[string]string{"access_token": "opaque", "token_type": "Bearer", "id_token": signed})
+	})
+	m.server = httptest.NewServer(mux)
+	t.Cleanup(m.server.Close)
+	return m
+}
+
+// authorize accepts the authorization request found in location and returns a code that
+// redeems an ID token with the given claims.
+func (m *mockOIDCProvider) authorize(location string, claims jwt.MapClaims) (state, code string) {
+	u, err := url.Parse(location)
+	require.NoError(m.t, err)
+	q := u.Query()
+	assert.Equal(m.t, "S256", q.Get("code_challenge_method"))
+	assert.Equal(m.t, "code", q.Get("response_type"))
+	code, err = randomToken()
+	require.NoError(m.t, err)
+	m.mu.Lock()
+	m.codes[code] = mockGrant{challenge: q.Get("code_challenge"), nonce: q.Get("nonce"), claims: claims}
+	m.mu.Unlock()
+	return q.Get("state"), code
+}
+
+func newOIDCRouter(t *testing.T, db *sql.DB, provider *mockOIDCProvider) *gin.Engine {
+	h := NewHandlers(db, t.TempDir())
+	h.oidc = NewOIDCProvider(&OIDCConfig{
+		Issuer:       provider.server.URL,
+		ClientID:     "expense-app",
+		RedirectURL:  "http://localhost/api/auth/oidc/callback",
+		Scopes:       []string{"openid", "email", "groups"},
+		GroupsClaim:  "groups",
+		GroupMapping: parseGroupMapping("expense-validators=Validateurs;staff=Utilisateurs"),
+	})
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/api/auth/oidc/login", h.OIDCLogin)
+	r.GET("/api/auth/oidc/callback", h.OIDCCallback)
+	return r
+}
+
+// oidcLogin runs a full login for an identity and returns the callback response.
+func oidcLogin(t *testing.T, r *gin.Engine, provider *mockOIDCProvider, claims jwt.MapClaims) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/auth/oidc/login", nil))
+	require.Equal(t, http.StatusFound, w.Code)
+	state, code := provider.authorize(w.Header().Get("Location"), claims)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/auth/oidc/callback?state="+state+"&code="+code, nil))
+	return w
+}
+
+func userGroupNames(t *testing.T, db *sql.DB, email string) []string {
+	rows, err := db.Query(`SELECT g.name FROM groups g
+		JOIN user_groups ug ON ug.group_id = g.id
+		JOIN users u ON u.id = ug.user_id
+		WHERE u.email = ? ORDER BY g.name`, email)
+	require.NoError(t, err)
+	defer rows.Close()
+	names := []string{}
+	for rows.Next() {
+		var name string
+		require.NoError(t, rows.Scan(&name))
+		names = append(names, name)
+	}
+	return names
+}
+
+func TestOIDCLoginProvisionsUserAndGroups(t *testing.T) {
+	db := newTestDB(t)
+	provider := newMockOIDCProvider(t)
+	r := newOIDCRouter(t, db, provider)
+
+	w := oidcLogin(t, r, provider, jwt.MapClaims{"sub": "abc-123", "email": "jane@example.com", "groups": []string{"staff", "expense-validators", "unmapped"}})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Contains(t, w.Body.String(), "refresh_token")
+
+	var source, hash string
+	require.NoError(t, db.QueryRow("SELECT auth_source, password_hash FROM users WHERE email = ?", "jane@example.com").Scan(&source, &hash))
+	assert.Equal(t, AuthSourceOIDC, source)
+	assert.Empty(t, hash)
+	assert.Equal(t, []string{"Utilisateurs", "Validateurs"}, userGroupNames(t, db, "jane@example.com"))
+
+	// Leaving a directory group removes the mapped membership on next login
+	w = oidcLogin(t, r, provider, jwt.MapClaims{"sub": "abc-123", "email": "jane@example.com", "groups": []string{"staff"}})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, []string{"Utilisateurs"}, userGroupNames(t, db, "jane@example.com"))
+}
+
+func TestOIDCCallbackRejectsReplayedState(t *testing.T) {
+	db := newTestDB(t)
+	provider := newMockOIDCProvider(t)
+	r := newOIDCRouter(t, db, provider)
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/auth/oidc/login", nil))
+	state, code := provider.authorize(w.Header().Get("Location"), jwt.MapClaims{"sub": "abc", "email": "a@example.com"})
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/auth/oidc/callback?state="+state+"&code="+code, nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/auth/oidc/callback?state="+state+"&code="+code, nil))
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
+
+func TestOIDCLoginRefusesLocalAccountTakeover(t *testing.T) {
+	db := newTestDB(t)
+	provider := newMockOIDCProvider(t)
+	r := newOIDCRouter(t, db, provider)
+
+	w := oidcLogin(t, r, provider, jwt.MapClaims{"sub": "evil", "email": "admin@example.com"})
+	assert.Equal(t, http.StatusConflict, w.Code)
+}
+
+func TestOIDCLoginRefusesEmailChangeToTakenAddress(t *testing.T) {
+	db := newTestDB(t)
+	provider := newMockOIDCProvider(t)
+	r := newOIDCRouter(t, db, provider)
+
+	w := oidcLogin(t, r, provider, jwt.MapClaims{"sub": "jane", "email": "jane@example.com"})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	// The provider now reports the address of another account
+	w = oidcLogin(t, r, provider, jwt.MapClaims{"sub": "jane", "email": "admin@example.com"})
+	assert.Equal(t, http.StatusConflict, w.Code)
+	var email string
+	require.NoError(t, db.QueryRow("SELECT email FROM users WHERE external_id = 'jane'").Scan(&email))
+	assert.Equal(t, "jane@example.com", email)
+}
+
+func TestOIDCGroupSyncKeepsLastPermissionsAdmin(t *testing.T) {
+	db := newTestDB(t)
+	provider := newMockOIDCProvider(t)
+	r := newOIDCRouter(t, db, provider)
+	_, err := db.Exec(`INSERT INTO group_permissions (group_id, permission_id)
+		SELECT g.id, p.id FROM groups g, permissions p WHERE g.name = 'Validateurs' AND p.action = ?`, PermPermissionsAssign)
+	require.NoError(t, err)
+
+	w := oidcLogin(t, r, provider, jwt.MapClaims{"sub": "jane", "email": "jane@example.com", "groups": []string{"expense-validators"}})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	// jane becomes the only user able to assign permissions
+	_, err = db.Exec("DELETE FROM user_groups WHERE user_id = 1")
+	require.NoError(t, err)
+
+	w = oidcLogin(t, r, provider, jwt.MapClaims{"sub": "jane", "email": "jane@example.com", "groups": []string{"staff"}})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, []string{"Utilisateurs", "Validateurs"}, userGroupNames(t, db, "jane@example.com"))
+}
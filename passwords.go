@@ -0,0 +1,288 @@
+package main
+
+import (
+    "database/sql"
+    "errors"
+    "fmt"
+    "net/http"
+    "os"
+    "strconv"
+    "strings"
+    "time"
+    "unicode"
+
+    "github.com/gin-gonic/gin"
+)
+
+// bcryptMaxLength is the number of bytes bcrypt takes into account; longer passwords would
+// be silently truncated.
+const bcryptMaxLength = 72
+
+// PasswordPolicy holds the strength rules applied to new local passwords.
+type PasswordPolicy struct {
+    MinLength     int
+    RequireUpper  bool
+    RequireLower  bool
+    RequireDigit  bool
+    RequireSymbol bool
+}
+
+// passwordPolicy is read from PASSWORD_MIN_LENGTH and PASSWORD_REQUIRE_UPPER, _LOWER,
+// _DIGIT and _SYMBOL. By default only the length is checked.
+var passwordPolicy = PasswordPolicy{
+    MinLength:     intFromEnv("PASSWORD_MIN_LENGTH", 12),
+    RequireUpper:  os.Getenv("PASSWORD_REQUIRE_UPPER") == "true",
+    RequireLower:  os.Getenv("PASSWORD_REQUIRE_LOWER") == "true",
+    RequireDigit:  os.Getenv("PASSWORD_REQUIRE_DIGIT") == "true",
+    RequireSymbol: os.Getenv("PASSWORD_REQUIRE_SYMBOL") == "true",
+}
+
+// passwordResetTTL is the validity of reset tokens issued by administrators.
+var passwordResetTTL = durationFromEnv("PASSWORD_RESET_TTL", 24*time.Hour)
+
+// Validate checks a candidate password against the policy. The error message tells the
+// user which rule failed.
+func (p PasswordPolicy) Validate(password, email string) error {
+    if len([]rune(password)) < p.MinLength {
+        return fmt.Errorf("password must be at least %d characters long", p.MinLength)
+    }
+    if len(password) > bcryptMaxLength {
+        return fmt.Errorf("password must not exceed %d bytes", bcryptMaxLength)
+    }
+    if email != "" && strings.EqualFold(password, email) {
+        return errors.New("password must not be the email address")
+    }
+    var upper, lower, digit, symbol bool
+    for _, r := range password {
+        switch {
+        case unicode.IsUpper(r):
+            upper = true
+        case unicode.IsLower(r):
+            lower = true
+        case unicode.IsDigit(r):
+            digit = true
+        default:
+            symbol = true
+        }
+    }
+    switch {
+    case p.RequireUpper && !upper:
+        return errors.New("password must contain an uppercase letter")
+    case p.RequireLower && !lower:
+        return errors.New("password must contain a lowercase letter")
+    case p.RequireDigit && !digit:
+        return errors.New("password must contain a digit")
+    case p.RequireSymbol && !symbol:
+        return errors.New("password must contain a symbol")
+    }
+    return nil
+}
+
+// passwordChangeRequired reports whether the user must change their password before using
+// protected routes.
+func passwordChangeRequired(db *sql.DB, userID int64) (bool, error) {
+    var required bool
+    if err := db.QueryRow("SELECT must_change_password FROM users WHERE id = ?", userID).Scan(&required); err != nil {
+        return false, fmt.Errorf("check password change: %w", err)
+    }
+    return required, nil
+}
+
+// setPassword stores a new password hash, clears the forced change flag and revokes the
+// user's sessions except keepSessionID (0 revokes all of them).
+func setPassword(tx *sql.Tx, userID int64, hash string, keepSessionID int64) error {
+    now := time.Now().UTC()
+    if _, err := tx.Exec("UPDATE users SET password_hash = ?, must_change_password = 0, password_changed_at = ? WHERE id = ?", hash, now, userID); err != nil {
+        return fmt.Errorf("update password: %w", err)
+    }
+    if _, err := tx.Exec("UPDATE sessions SET revoked_at = ? WHERE user_id = ? AND id != ? AND revoked_at IS NULL", now, userID, keepSessionID); err != nil {
+        return fmt.Errorf("revoke sessions: %w", err)
+    }
+    return nil
+}
+
+// ChangePasswordRequest is the payload to change the current user's password.
+type ChangePasswordRequest struct {
+    CurrentPassword string `json:"current_password"`
+    NewPassword     string `json:"new_password"`
+}
+
+// ChangePassword changes the password of the current user. The current password is
+// required. Other sessions of the user are revoked; the current one stays open.
+func (h *Handlers) ChangePassword(c *gin.Context) {
+    var req ChangePasswordRequest
+    if err := c.ShouldBindJSON(&req); err != nil || req.CurrentPassword == "" || req.NewPassword == "" {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "current_password and new_password are required"})
+        return
+    }
+    userIDIfc, _ := c.Get(ContextUserIDKey)
+    userID := userIDIfc.(int64)
+    var email, hash, source string
+    if err := h.db.QueryRow("SELECT email, password_hash, auth_source FROM users WHERE id = ?", userID).Scan(&email, &hash, &source); err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
+        return
+    }
+    if source != AuthSourceLocal {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "password is managed by the identity provider"})
+        return
+    }
+    // A stolen session must not become a way around login throttling
+    ip := c.ClientIP()
+    if !h.allowLoginAttempt(c, email) {
+        return
+    }
+    if err := checkPassword(hash, req.CurrentPassword); err != nil {
+        if err := recordLoginFailure(h.db, email, ip, time.Now()); err != nil {
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
+            return
+        }
+        c.JSON(http.StatusUnauthorized, gin.H{"error": "current password is incorrect"})
+        return
+    }
+    if req.NewPassword == req.CurrentPassword {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "new password must differ from the current one"})
+        return
+    }
+    if err := passwordPolicy.Validate(req.NewPassword, email); err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": err.Error(), "code": "weak_password"})
+        return
+    }
+    newHash, err := hashPassword(req.NewPassword)
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to hash password"})
+        return
+    }
+    var sessionID int64
+    if v, ok := c.Get(ContextSessionIDKey); ok {
+        sessionID = v.(int64)
+    }
+    tx, err := h.db.Begin()
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
+        return
+    }
+    defer tx.Rollback()
+    if err := setPassword(tx, userID, newHash, sessionID); err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to change password"})
+        return
+    }
+    if err := tx.Commit(); err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
+        return
+    }
+    c.Status(http.StatusNoContent)
+}
+
+// IssuePasswordReset creates a single-use reset token for a local account. Earlier unused
+// tokens of the user are invalidated. The token is returned once, for the administrator
+// to hand over.
+func (h *Handlers) IssuePasswordReset(c *gin.Context) {
+    userID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+    if err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "invalid user id"})
+        return
+    }
+    var source string
+    err = h.db.QueryRow("SELECT auth_source FROM users WHERE id = ?", userID).Scan(&source)
+    if errors.Is(err, sql.ErrNoRows) {
+        c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+        return
+    } else if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
+        return
+    }
+    if source != AuthSourceLocal {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "password is managed by the identity provider"})
+        return
+    }
+    token, err := randomToken()
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to generate token"})
+        return
+    }
+    adminIDIfc, _ := c.Get(ContextUserIDKey)
+    now := time.Now().UTC()
+    expiresAt := now.Add(passwordResetTTL)
+    tx, err := h.db.Begin()
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
+        return
+    }
+    defer tx.Rollback()
+    if _, err := tx.Exec("UPDATE password_resets SET used_at = ? WHERE user_id = ? AND used_at IS NULL", now, userID); err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
+        return
+    }
+    _, err = tx.Exec("INSERT INTO password_resets (user_id, token_hash, created_by, created_at, expires_at) VALUES (?, ?, ?, ?, ?)",
+        userID, hashAPIToken(token), adminIDIfc, now, expiresAt)
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to store reset token"})
+        return
+    }
+    if err := tx.Commit(); err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
+        return
+    }
+    c.JSON(http.StatusCreated, gin.H{"user_id": userID, "reset_token": token, "expires_at": expiresAt})
+}
+
+// ResetPasswordRequest is the payload to set a password with a reset token.
+type ResetPasswordRequest struct {
+    Token       string `json:"token"`
+    NewPassword string `json:"new_password"`
+}
+
+// ResetPassword sets a new password with a reset token issued by an administrator. The
+// token is consumed, all sessions of the user are revoked and a lockout is lifted.
+func (h *Handlers) ResetPassword(c *gin.Context) {
+    var req ResetPasswordRequest
+    if err := c.ShouldBindJSON(&req); err != nil || req.Token == "" || req.NewPassword == "" {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "token and new_password are required"})
+        return
+    }
+    tx, err := h.db.Begin()
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
+        return
+    }
+    defer tx.Rollback()
+    var resetID, userID int64
+    var email string
+    var expiresAt time.Time
+    var usedAt sql.NullTime
+    err = tx.QueryRow(`SELECT r.id, r.user_id, u.email, r.expires_at, r.used_at FROM password_resets r
+        JOIN users u ON u.id = r.user_id WHERE r.token_hash = ?`, hashAPIToken(req.Token)).Scan(&resetID, &userID, &email, &expiresAt, &usedAt)
+    if errors.Is(err, sql.ErrNoRows) || (err == nil && (usedAt.Valid || time.Now().After(expiresAt))) {
+        c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid or expired reset token"})
+        return
+    } else if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
+        return
+    }
+    if err := passwordPolicy.Validate(req.NewPassword, email); err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": err.Error(), "code": "weak_password"})
+        return
+    }
+    hash, err := hashPassword(req.NewPassword)
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to hash password"})
+        return
+    }
+    if _, err := tx.Exec("UPDATE password_resets SET used_at = ? WHERE id = ?", time.Now().UTC(), resetID); err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
+        return
+    }
+    if err := setPassword(tx, userID, hash, 0); err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to reset password"})
+        return
+    }
+    if err := tx.Commit(); err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
+        return
+    }
+    if err := clearAccountThrottle(h.db, email); err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
+        return
+    }
+    c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPasswordPolicyValidate(t *testing.T) {
+	p := PasswordPolicy{MinLength: 8, RequireDigit: true, RequireSymbol: true}
+	assert.Error(t, p.Validate("short1!", ""))
+	assert.Error(t, p.Validate("longenough!", ""))
+	assert.Error(t, p.Validate("longenough1", ""))
+	assert.Error(t, p.Validate("Jane1!@x.io", "jane1!@x.io"))
+	assert.NoError(t, p.Validate("longenough1!", "jane@example.com"))
+}
+
+func TestForcedPasswordChangeAndReset(t *testing.T) {
+	db := newTestDB(t)
+	h := NewHandlers(db, t.TempDir())
+	r := newTestRouter(db, PermReportsReadOwn)
+	r.POST("/api/auth/login", h.Login)
+	r.POST("/api/auth/password/reset", h.ResetPassword)
+	r.POST("/api/auth/password", AuthMiddleware(db), h.ChangePassword)
+	r.POST("/api/admin/users", AuthMiddleware(db), h.CreateUser)
+	r.POST("/api/admin/users/:id/password-reset", AuthMiddleware(db), h.IssuePasswordReset)
+
+	w := postJSON(r, "/api/auth/login", `{"email":"admin@example.com","password":"admin"}`, "")
+	require.Equal(t, http.StatusOK, w.Code)
+	var admin tokenPair
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &admin))
+
+	w = postJSON(r, "/api/admin/users", `{"email":"jane@example.com","password":"short","groups":[3]}`, admin.Token)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = postJSON(r, "/api/admin/users", `{"email":"jane@example.com","password":"initial-password","groups":[3]}`, admin.Token)
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+
+	// The new account must change the password chosen by the administrator
+	w = postJSON(r, "/api/auth/login", `{"email":"jane@example.com","password":"initial-password"}`, "")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"password_change_required":true`)
+	var jane tokenPair
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &jane))
+	w = getWithBearer(r, "/api/protected", jane.Token)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Contains(t, w.Body.String(), "password_change_required")
+	w = postJSON(r, "/api/auth/password", `{"current_password":"wrong","new_password":"a-better-password"}`, jane.Token)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	w = postJSON(r, "/api/auth/password", `{"current_password":"initial-password","new_password":"a-better-password"}`, jane.Token)
+	require.Equal(t, http.StatusNoContent, w.Code, w.Body.String())
+	assert.Equal(t, http.StatusOK, getWithBearer(r, "/api/protected", jane.Token).Code)
+
+	// Reset tokens are single use and revoke existing sessions
+	w = postJSON(r, "/api/admin/users/2/password-reset", "", admin.Token)
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	var reset struct {
+		ResetToken string `json:"reset_token"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &reset))
+	body := `{"token":"` + reset.ResetToken + `","new_password":"reset-password-123"}`
+	assert.Equal(t, http.StatusNoContent, postJSON(r, "/api/auth/password/reset", body, "").Code)
+	assert.Equal(t, http.StatusUnauthorized, postJSON(r, "/api/auth/password/reset", body, "").Code)
+	assert.Equal(t, http.StatusUnauthorized, getWithBearer(r, "/api/protected", jane.Token).Code)
+	w = postJSON(r, "/api/auth/login", `{"email":"jane@example.com","password":"reset-password-123"}`, "")
+	assert.Equal(t, http.StatusOK, w.Code)
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+    "database/sql"
+    "errors"
+    "fmt"
+    "net/http"
+    "strconv"
+    "strings"
+    "time"
+
+    "github.com/gin-gonic/gin"
+)
+
+// Statuses of a payment batch.
+const (
+    BatchOpen = "open"
+    BatchPaid = "paid"
+)
+
+// PaymentBatch groups approved reports reimbursed by a single payment run. An open batch is
+// being prepared; a paid batch carries the payment reference and date.
+type PaymentBatch struct {
+    ID        int64           `json:"id"`
+    Status    string          `json:"status"`
+    Reference *string         `json:"reference,omitempty"`
+    PaidAt    *string         `json:"paid_at,omitempty"`
+    CreatedBy *int64          `json:"created_by"`
+    CreatedAt time.Time       `json:"created_at"`
+    Total     float64         `json:"total"`
+    Reports   []PayableReport `json:"reports,omitempty"`
+}
+
+// PayableReport is an approved report to reimburse, with its total tax included.
+type PayableReport struct {
+    ID     int64   `json:"id"`
+    UserID int64   `json:"user_id"`
+    Email  string  `json:"email"`
+    Title  string  `json:"title"`
+    Total  float64 `json:"total"`
+}
+
+// payableReportsQuery selects approved or paid reports with their owner and total.
+const payableReportsQuery = `SELECT er.id, er.user_id, u.email, er.title, COALESCE(SUM(ei.amount_ttc), 0)
+    FROM expense_reports er
+    JOIN users u ON u.id = er.user_id
+    LEFT JOIN expense_items ei ON ei.report_id = er.id`
+
+func scanPayableReports(rows *sql.Rows) ([]PayableReport, float64, error) {
+    defer rows.Close()
+    reports := []PayableReport{}
+    var total float64
+    for rows.Next() {
+        var r PayableReport
+        if err := rows.Scan(&r.ID, &r.UserID, &r.Email, &r.Title, &r.Total); err != nil {
+            return nil, 0, err
+        }
+        reports = append(reports, r)
+        total += r.Total
+    }
+    return reports, total, rows.Err()
+}
+
+// ListPendingPayments returns the approved reports that are not part of a payment batch yet.
+func (h *Handlers) ListPendingPayments(c *gin.Context) {
+    rows, err := h.db.Query(payableReportsQuery+`
+        WHERE er.status = ? AND er.payment_batch_id IS NULL
+        GROUP BY er.id ORDER BY er.id`, StatusApproved)
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
+        return
+    }
+    reports, _, err := scanPayableReports(rows)
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
+        return
+    }
+    c.JSON(http.StatusOK, reports)
+}
+
+// CreatePaymentBatchRequest is the payload to open a payment batch.
+type CreatePaymentBatchRequest struct {
+    ReportIDs []int64 `json:"report_ids"`
+}
+
+// CreatePaymentBatch opens a payment batch with approved reports that are not part of
+// another batch. A report listed several times is added once.
+func (h *Handlers) CreatePaymentBatch(c *gin.Context) {
+    var req CreatePaymentBatchRequest
+    if err := c.ShouldBindJSON(&req); err != nil || len(req.ReportIDs) == 0 {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "report_ids is required"})
+        return
+    }
+    userIDIfc, _ := c.Get(ContextUserIDKey)
+    userID := userIDIfc.(int64)
+    tx, err := h.db.Begin()
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
+        return
+    }
+    defer tx.Rollback()
+    res, err := tx.Exec("INSERT INTO payment_batches (status, created_by, created_at) VALUES (?, ?, ?)", BatchOpen, userID, time.Now().UTC())
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create batch"})
+        return
+    }
+    batchID, _ := res.LastInsertId()
+    seen := map[int64]bool{}
+    for _, reportID := range req.ReportIDs {
+        if seen[reportID] {
+            continue
+        }
+        seen[reportID] = true
+        res, err := tx.Exec("UPDATE expense_reports SET payment_batch_id = ? WHERE id = ? AND status = ? AND payment_batch_id IS NULL",
+            batchID, reportID, StatusApproved)
+        if err != nil {
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create batch"})
+            return
+        }
+        if n, _ := res.RowsAffected(); n == 0 {
+            c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("report %d is not an approved report awaiting payment", reportID)})
+            return
+        }
+    }
+    if err := tx.Commit(); err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
+        return
+    }
+    batch, err := loadPaymentBatch(h.db, batchID)
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
+        return
+    }
+    c.JSON(http.StatusCreated, batch)
+}
+
+// loadPaymentBatch returns a payment batch with its reports, or sql.ErrNoRows.
+func loadPaymentBatch(db *sql.DB, batchID int64) (*PaymentBatch, error) {
+    var b PaymentBatch
+    err := db.QueryRow("SELECT id, status, reference, paid_at, created_by, created_at FROM payment_batches WHERE id = ?", batchID).
+        Scan(&b.ID, &b.Status, &b.Reference, &b.PaidAt, &b.CreatedBy, &b.CreatedAt)
+    if err != nil {
+        return nil, err
+    }
+    rows, err := db.Query(payableReportsQuery+" WHERE er.payment_batch_id = ? GROUP BY er.id ORDER BY er.id", batchID)
+    if err != nil {
+        return nil, fmt.Errorf("select batch reports: %w", err)
+    }
+    if b.Reports, b.Total, err = scanPayableReports(rows); err != nil {
+        return nil, fmt.Errorf("select batch reports: %w", err)
+    }
+    return &b, nil
+}
+
+// paymentBatchParam parses the :id path parameter of the payment batch routes. It writes
+// the error response and returns false when the ID is invalid.
+func paymentBatchParam(c *gin.Context) (int64, bool) {
+    batchID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+    if err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "invalid batch id"})
+        return 0, false
+    }
+    return batchID, true
+}
+
+// ListPaymentBatches returns the payment batches, newest first, with their totals.
+func (h *Handlers) ListPaymentBatches(c *gin.Context) {
+    rows, err := h.db.Query(`SELECT pb.id, pb.status, pb.reference, pb.paid_at, pb.created_by, pb.created_at,
+            COALESCE((SELECT SUM(ei.amount_ttc) FROM expense_items ei
+                JOIN expense_reports er ON er.id = ei.report_id WHERE er.payment_batch_id = pb.id), 0)
+        FROM payment_batches pb ORDER BY pb.id DESC`)
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
+        return
+    }
+    defer rows.Close()
+    batches := []PaymentBatch{}
+    for rows.Next() {
+        var b PaymentBatch
+        if err := rows.Scan(&b.ID, &b.Status, &b.Reference, &b.PaidAt, &b.CreatedBy, &b.CreatedAt, &b.Total); err != nil {
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
+            return
+        }
+        batches = append(batches, b)
+    }
+    c.JSON(http.StatusOK, batches)
+}
+
+// GetPaymentBatch returns a payment batch with its reports.
+func (h *Handlers) GetPaymentBatch(c *gin.Context) {
+    batchID, ok := paymentBatchParam(c)
+    if !ok {
+        return
+    }
+    batch, err := loadPaymentBatch(h.db, batchID)
+    if errors.Is(err, sql.ErrNoRows) {
+        c.JSON(http.StatusNotFound, gin.H{"error": "batch not found"})
+        return
+    } else if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
+        return
+    }
+    c.JSON(http.StatusOK, batch)
+}
+
+// Reimbursement tells the owner of a paid report when and how it was reimbursed.
+type Reimbursement struct {
+    BatchID   int64  `json:"batch_id"`
+    Reference string `json:"reference"`
+    PaidAt    string `json:"paid_at"`
+}
+
+// DeletePaymentBatch deletes an open payment batch; its reports await payment again.
+func (h *Handlers) DeletePaymentBatch(c *gin.Context) {
+    batchID, ok := paymentBatchParam(c)
+    if !ok {
+        return
+    }
+    res, err := h.db.Exec("DELETE FROM payment_batches WHERE id = ? AND status = ?", batchID, BatchOpen)
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to delete batch"})
+        return
+    }
+    if n, _ := res.RowsAffected(); n == 0 {
+        c.JSON(http.StatusNotFound, gin.H{"error": "open batch not found"})
+        return
+    }
+    c.Status(http.StatusNoContent)
+}
+
+// PayBatchRequest is the payload to record the payment of a batch. PaidAt is a
+// YYYY-MM-DD date and defaults to today.
+type PayBatchRequest struct {
+    Reference string `json:"reference"`
+    PaidAt    string `json:"paid_at"`
+}
+
+// PayBatch records the payment of an open batch with its reference and date. Its reports
+// become paid and their owners are notified.
+func (h *Handlers) PayBatch(c *gin.Context) {
+    batchID, ok := paymentBatchParam(c)
+    if !ok {
+        return
+    }
+    var req PayBatchRequest
+    if err := c.ShouldBindJSON(&req); err != nil || strings.TrimSpace(req.Reference) == "" {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "reference is required"})
+        return
+    }
+    reference := strings.TrimSpace(req.Reference)
+    paidAt := time.Now().UTC().Format("2006-01-02")
+    if req.PaidAt != "" {
+        if _, err := time.Parse("2006-01-02", req.PaidAt); err != nil {
+            c.JSON(http.StatusBadRequest, gin.H{"error": "paid_at must be a YYYY-MM-DD date"})
+            return
+        }
+        paidAt = req.PaidAt
+    }
+    userIDIfc, _ := c.Get(ContextUserIDKey)
+    userID := userIDIfc.(int64)
+    tx, err := h.db.Begin()
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
+        return
+    }
+    defer tx.Rollback()
+    res, err := tx.Exec("UPDATE payment_batches SET status = ?, reference = ?, paid_at = ?, paid_by = ? WHERE id = ? AND status = ?",
+        BatchPaid, reference, paidAt, userID, batchID, BatchOpen)
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to record payment"})
+        return
+    }
+    if n, _ := res.RowsAffected(); n == 0 {
+        c.JSON(http.StatusNotFound, gin.H{"error": "open batch not found"})
+        return
+    }
+    type paidReport struct {
+        id, ownerID int64
+        title       string
+    }
+    rows, err := tx.Query("SELECT id, user_id, title FROM expense_reports WHERE payment_batch_id = ?", batchID)
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
+        return
+    }
+    var reports []paidReport
+    for rows.Next() {
+        var r paidReport
+        if err := rows.Scan(&r.id, &r.ownerID, &r.title); err != nil {
+            rows.Close()
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
+            return
+        }
+        reports = append(reports, r)
+    }
+    rows.Close()
+    if len(reports) == 0 {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "batch has no reports"})
+        return
+    }
+    comment := fmt.Sprintf("paid on %s, reference %s", paidAt, reference)
+    for _, r := range reports {
+        if err := transitionReport(tx, r.id, StatusApproved, StatusPaid, userID, comment); err != nil {
+            abortTransition(c, err)
+            return
+        }
+        message := fmt.Sprintf("Report %q was reimbursed on %s (reference %s)", r.title, paidAt, reference)
+        if err := notifyUsers(tx, []int64{r.ownerID}, r.id, NotifyReportPaid, message); err != nil {
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to record payment"})
+            return
+        }
+    }
+    if err := tx.Commit(); err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
+        return
+    }
+    batch, err := loadPaymentBatch(h.db, batchID)
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
+        return
+    }
+    c.JSON(http.StatusOK, batch)
+}
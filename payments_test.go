@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPaymentBatchReimbursesApprovedReports(t *testing.T) {
+	r, h := newReportRouter(t)
+	chain := newApprovalChain(t, h)
+	approved := func() int64 {
+		id := createDraftReport(t, r, chain.employee, 100)
+		submitReport(t, r, chain.employee, id)
+		code, _ := decide(r, chain.manager, id, "approve")
+		require.Equal(t, http.StatusOK, code)
+		return id
+	}
+	first, second := approved(), approved()
+	pending, _ := submitNewReport(t, r, chain.employee)
+
+	assert.Equal(t, http.StatusForbidden, doAs(r, http.MethodGet, "/api/admin/payments/pending", "", chain.employee).Code)
+	w := doAs(r, http.MethodGet, "/api/admin/payments/pending", "", chain.finance)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var payable []PayableReport
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &payable))
+	assert.Len(t, payable, 2)
+
+	w = doAs(r, http.MethodPost, "/api/admin/payment-batches", fmt.Sprintf(`{"report_ids":[%d,%d]}`, first, pending), chain.finance)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	// A report listed twice is batched once
+	w = doAs(r, http.MethodPost, "/api/admin/payment-batches", fmt.Sprintf(`{"report_ids":[%d,%d,%d]}`, first, second, first), chain.finance)
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	var batch PaymentBatch
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &batch))
+	assert.Equal(t, BatchOpen, batch.Status)
+	assert.Len(t, batch.Reports, 2)
+	assert.InDelta(t, 240, batch.Total, 0.001)
+	w = doAs(r, http.MethodGet, "/api/admin/payments/pending", "", chain.finance)
+	assert.JSONEq(t, `[]`, w.Body.String())
+
+	payURL := fmt.Sprintf("/api/admin/payment-batches/%d/pay", batch.ID)
+	assert.Equal(t, http.StatusBadRequest, doAs(r, http.MethodPost, payURL, `{"reference":""}`, chain.finance).Code)
+	w = doAs(r, http.MethodPost, payURL, `{"reference":"SEPA-0042","paid_at":"2026-10-15"}`, chain.finance)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &batch))
+	assert.Equal(t, BatchPaid, batch.Status)
+	assert.Equal(t, "2026-10-15", *batch.PaidAt)
+	assert.Equal(t, http.StatusNotFound, doAs(r, http.MethodPost, payURL, `{"reference":"again"}`, chain.finance).Code)
+
+	// The owner sees when and how their reports were reimbursed
+	w = doAs(r, http.MethodGet, "/api/reports", "", chain.employee)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var reports []struct {
+		ID            int64          `json:"id"`
+		Status        string         `json:"status"`
+		Reimbursement *Reimbursement `json:"reimbursement"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &reports))
+	paid := 0
+	for _, rep := range reports {
+		if rep.ID == first || rep.ID == second {
+			assert.Equal(t, string(StatusPaid), rep.Status)
+			require.NotNil(t, rep.Reimbursement)
+			assert.Equal(t, Reimbursement{BatchID: batch.ID, Reference: "SEPA-0042", PaidAt: "2026-10-15"}, *rep.Reimbursement)
+			paid++
+		} else {
+			assert.Nil(t, rep.Reimbursement)
+		}
+	}
+	assert.Equal(t, 2, paid)
+	w = doAs(r, http.MethodGet, "/api/notifications", "", chain.employee)
+	assert.Contains(t, w.Body.String(), NotifyReportPaid)
+	assert.Contains(t, w.Body.String(), "SEPA-0042")
+}
@@ -3,6 +3,10 @@ package main
 import (
     "database/sql"
     "fmt"
+    "sync"
+    "time"
+
+    "github.com/gin-gonic/gin"
 )
 
 // Constants representing predefined permission actions.
@@ -11,15 +15,26 @@ const (
     PermReportsUpdateOwn = "reports:update:own"
     PermReportsReadOwn   = "reports:read:own"
     PermReportsReadAll   = "reports:read:all"
+    PermReportsReadScoped = "reports:read:scoped"
     PermReportsApprove   = "reports:approve"
     PermReportsReject    = "reports:reject"
     PermUsersRead        = "users:read"
     PermUsersCreate      = "users:create"
+    PermUsersUpdate      = "users:update"
+    PermUsersDelete      = "users:delete"
     PermGroupsRead       = "groups:read"
     PermGroupsCreate     = "groups:create"
+    PermGroupsUpdate     = "groups:update"
+    PermGroupsDelete     = "groups:delete"
     PermPermissionsAssign = "permissions:assign"
     PermTokensCreate      = "tokens:create"
+    PermTokensRead        = "tokens:read"
+    PermTokensRevoke      = "tokens:revoke"
+    PermSessionsRevoke    = "sessions:revoke"
     PermReportsExportAll  = "reports:export:all"
+    PermAuditRead         = "audit:read"
+    PermReportsPay        = "reports:pay"
+    PermReportsApproveHigh = "reports:approve:high"
 )
 
 // GetUserPermissions returns a set of permission actions for a user by
@@ -54,3 +69,87 @@ func UserHasPermission(db *sql.DB, userID int64, action string) (bool, error) {
     }
     return perms[action], nil
 }
+
+// ContextPermissionsKey holds the permission set of the authenticated user, loaded once
+// per request by requestPermissions.
+const ContextPermissionsKey = "permissions"
+
+// permissionCacheTTL bounds how long a cached permission set is trusted. Changes made
+// through the API flush the cache immediately; the TTL covers changes made by other
+// instances or directly in the database.
+var permissionCacheTTL = durationFromEnv("PERMISSION_CACHE_TTL", time.Minute)
+
+type permissionCacheKey struct {
+    db     *sql.DB
+    userID int64
+}
+
+type permissionCacheEntry struct {
+    perms    map[string]bool
+    loadedAt time.Time
+}
+
+// permissionCache keeps the permission sets of users in memory. Entries are keyed by
+// database as well as by user, so that several databases (e.g. in tests) never share
+// entries.
+type permissionCache struct {
+    mu      sync.RWMutex
+    entries map[permissionCacheKey]permissionCacheEntry
+}
+
+var userPermissionCache = &permissionCache{entries: map[permissionCacheKey]permissionCacheEntry{}}
+
+// cachedUserPermissions returns the permission set of a user, from the cache when fresh.
+// The returned map is shared and must not be modified.
+func cachedUserPermissions(db *sql.DB, userID int64) (map[string]bool, error) {
+    key := permissionCacheKey{db, userID}
+    userPermissionCache.mu.RLock()
+    entry, ok := userPermissionCache.entries[key]
+    userPermissionCache.mu.RUnlock()
+    if ok && time.Since(entry.loadedAt) < permissionCacheTTL {
+        return entry.perms, nil
+    }
+    perms, err := GetUserPermissions(db, userID)
+    if err != nil {
+        return nil, err
+    }
+    userPermissionCache.mu.Lock()
+    userPermissionCache.entries[key] = permissionCacheEntry{perms: perms, loadedAt: time.Now()}
+    userPermissionCache.mu.Unlock()
+    return perms, nil
+}
+
+// invalidateUserPermissions drops the cached permission set of a user. It must be called
+// after committing a change to the user's group memberships.
+func invalidateUserPermissions(db *sql.DB, userID int64) {
+    userPermissionCache.mu.Lock()
+    delete(userPermissionCache.entries, permissionCacheKey{db, userID})
+    userPermissionCache.mu.Unlock()
+}
+
+// invalidateAllPermissions drops every cached permission set of the database. It must be
+// called after committing a change to the permissions of a group, which may affect any
+// user.
+func invalidateAllPermissions(db *sql.DB) {
+    userPermissionCache.mu.Lock()
+    for key := range userPermissionCache.entries {
+        if key.db == db {
+            delete(userPermissionCache.entries, key)
+        }
+    }
+    userPermissionCache.mu.Unlock()
+}
+
+// requestPermissions returns the permission set of the authenticated user. It is loaded
+// once per request and kept in the gin context for later checks.
+func requestPermissions(c *gin.Context, db *sql.DB, userID int64) (map[string]bool, error) {
+    if v, ok := c.Get(ContextPermissionsKey); ok {
+        return v.(map[string]bool), nil
+    }
+    perms, err := cachedUserPermissions(db, userID)
+    if err != nil {
+        return nil, err
+    }
+    c.Set(ContextPermissionsKey, perms)
+    return perms, nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPermissionCacheFlushedOnChanges(t *testing.T) {
+	r, h := newGroupAdminRouter(t)
+	r.GET("/api/approve", AuthMiddleware(h.db), RequirePermission(h.db, PermReportsApprove), func(c *gin.Context) { c.Status(http.StatusOK) })
+	userID := createTestUser(t, h, "jane@example.com")
+	token := issueAPIToken(t, h.db, fmt.Sprint(userID))
+	approve := func() int {
+		req := httptest.NewRequest(http.MethodGet, "/api/approve", nil)
+		req.Header.Set("X-API-Key", token)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+	require.Equal(t, http.StatusForbidden, approve())
+
+	// Group membership edits flush the user's entry
+	require.Equal(t, http.StatusOK, postJSON(r, fmt.Sprintf("/api/admin/users/%d/groups", userID), `{"group_id":2}`, "").Code)
+	assert.Equal(t, http.StatusOK, approve())
+	require.Equal(t, http.StatusNoContent, doRequest(r, http.MethodDelete, fmt.Sprintf("/api/admin/users/%d/groups/2", userID)).Code)
+	assert.Equal(t, http.StatusForbidden, approve())
+
+	// Group permission edits flush every entry
+	require.Equal(t, http.StatusOK, postJSON(r, "/api/admin/users/2/groups", `{"group_id":2}`, "").Code)
+	require.Equal(t, http.StatusOK, approve())
+	perm := permissionID(t, h, PermReportsApprove)
+	require.Equal(t, http.StatusNoContent, doRequest(r, http.MethodDelete, fmt.Sprintf("/api/admin/groups/2/permissions/%d", perm)).Code)
+	assert.Equal(t, http.StatusForbidden, approve())
+	require.Equal(t, http.StatusOK, putJSON(r, "/api/admin/groups/2/permissions", fmt.Sprintf(`{"permission_ids":[%d]}`, perm)).Code)
+	assert.Equal(t, http.StatusOK, approve())
+	require.Equal(t, http.StatusNoContent, doRequest(r, http.MethodDelete, "/api/admin/groups/2").Code)
+	assert.Equal(t, http.StatusForbidden, approve())
+}
+
+func TestPermissionCacheIsPerDatabase(t *testing.T) {
+	first, second := newTestDB(t), newTestDB(t)
+	_, err := second.Exec("DELETE FROM user_groups WHERE user_id = 1")
+	require.NoError(t, err)
+
+	perms, err := cachedUserPermissions(first, 1)
+	require.NoError(t, err)
+	assert.True(t, perms[PermPermissionsAssign])
+	perms, err = cachedUserPermissions(second, 1)
+	require.NoError(t, err)
+	assert.Empty(t, perms)
+}
+
+func BenchmarkGetUserPermissions(b *testing.B) {
+	db := newTestDB(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := GetUserPermissions(db, 1); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkCachedUserPermissions(b *testing.B) {
+	db := newTestDB(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := cachedUserPermissions(db, 1); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
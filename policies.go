@@ -0,0 +1,56 @@
+package main
+
+import (
+    "fmt"
+    "log"
+    "os"
+    "strconv"
+)
+
+// autoApproveBelow is read from AUTO_APPROVE_BELOW: reports whose total (tax included) is
+// below it and whose expenses all have a receipt are approved on submission. Zero, the
+// default, sends every report through its approval chain.
+var autoApproveBelow = amountFromEnv("AUTO_APPROVE_BELOW", 0)
+
+// highValueAbove is read from HIGH_VALUE_APPROVAL_ABOVE: approving a step of a report whose
+// total exceeds it requires reports:approve:high. Zero, the default, disables the check.
+var highValueAbove = amountFromEnv("HIGH_VALUE_APPROVAL_ABOVE", 0)
+
+// amountFromEnv reads a non-negative amount from an environment variable, falling back to
+// def when it is unset or invalid.
+func amountFromEnv(name string, def float64) float64 {
+    v := os.Getenv(name)
+    if v == "" {
+        return def
+    }
+    f, err := strconv.ParseFloat(v, 64)
+    if err != nil || f < 0 {
+        log.Printf("[WARN] invalid %s %q, using %g", name, v, def)
+        return def
+    }
+    return f
+}
+
+// receiptsComplete reports whether a report has expenses and a receipt for each of them.
+func receiptsComplete(q queryRower, reportID int64) (bool, error) {
+    var items, receipts int
+    err := q.QueryRow("SELECT COUNT(*), COUNT(NULLIF(receipt_path, '')) FROM expense_items WHERE report_id = ?", reportID).Scan(&items, &receipts)
+    if err != nil {
+        return false, fmt.Errorf("count receipts: %w", err)
+    }
+    return items > 0 && items == receipts, nil
+}
+
+// autoApproves reports whether the auto-approval policy approves a report on submission.
+func autoApproves(q queryRower, reportID int64, total float64) (bool, error) {
+    if autoApproveBelow <= 0 || total >= autoApproveBelow {
+        return false, nil
+    }
+    return receiptsComplete(q, reportID)
+}
+
+// requiresHighApproval reports whether approving a report of this total requires
+// reports:approve:high.
+func requiresHighApproval(total float64) bool {
+    return highValueAbove > 0 && total > highValueAbove
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAutoApprovalPolicy(t *testing.T) {
+	saved := autoApproveBelow
+	autoApproveBelow = 500
+	t.Cleanup(func() { autoApproveBelow = saved })
+	r, h := newReportRouter(t)
+	chain := newApprovalChain(t, h)
+	attachReceipts := func(reportID int64) {
+		_, err := h.db.Exec("UPDATE expense_items SET receipt_path = 'receipt.pdf' WHERE report_id = ?", reportID)
+		require.NoError(t, err)
+	}
+
+	missingReceipt := createDraftReport(t, r, chain.employee, 100)
+	assert.Equal(t, "submitted", submitReport(t, r, chain.employee, missingReceipt)["status"])
+	tooLarge := createDraftReport(t, r, chain.employee, 500)
+	attachReceipts(tooLarge)
+	assert.Equal(t, "submitted", submitReport(t, r, chain.employee, tooLarge)["status"])
+
+	small := createDraftReport(t, r, chain.employee, 100)
+	attachReceipts(small)
+	out := submitReport(t, r, chain.employee, small)
+	assert.Equal(t, "approved", out["status"])
+	assert.Equal(t, true, out["auto_approved"])
+	assert.Empty(t, approvalSteps(t, r, chain.employee, small))
+
+	w := doAs(r, http.MethodGet, fmt.Sprintf("/api/reports/%d/timeline", small), "", chain.employee)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var timeline []StatusChange
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &timeline))
+	last := timeline[len(timeline)-1]
+	assert.Equal(t, StatusApproved, last.To)
+	assert.Nil(t, last.ActorID)
+	assert.Contains(t, *last.Comment, "auto-approved")
+}
+
+func TestHighValueApprovalRequiresPermission(t *testing.T) {
+	saved := highValueAbove
+	highValueAbove = 1000
+	t.Cleanup(func() { highValueAbove = saved })
+	r, h := newReportRouter(t)
+	chain := newApprovalChain(t, h)
+	small := createDraftReport(t, r, chain.employee, 100)
+	submitReport(t, r, chain.employee, small)
+	large := createDraftReport(t, r, chain.employee, 1000)
+	submitReport(t, r, chain.employee, large)
+
+	code, _ := decide(r, chain.manager, small, "approve")
+	assert.Equal(t, http.StatusOK, code)
+	code, out := decide(r, chain.manager, large, "approve")
+	assert.Equal(t, http.StatusForbidden, code)
+	assert.Equal(t, AuditApprovalLimit, out["code"])
+
+	// The permission lifts the limit
+	_, err := h.db.Exec(`INSERT INTO group_permissions (group_id, permission_id)
+		SELECT 2, id FROM permissions WHERE action = ?`, PermReportsApproveHigh)
+	require.NoError(t, err)
+	invalidateAllPermissions(h.db)
+	code, out = decide(r, chain.manager, large, "approve")
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "finance", out["next_step"])
+	code, out = decide(r, chain.finance, large, "approve")
+	assert.Equal(t, http.StatusForbidden, code)
+	assert.Equal(t, AuditApprovalLimit, out["code"])
+
+	// Rejections are not limited
+	code, out = decide(r, chain.finance, large, "reject")
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "rejected", out["status"])
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+    "database/sql"
+    "errors"
+    "fmt"
+    "log"
+    "strings"
+    "time"
+)
+
+// ErrExternalAccountConflict is returned when an external identity uses the email of an
+// account managed by another authentication source.
+var ErrExternalAccountConflict = errors.New("email already used by an account with another authentication source")
+
+// GroupMapping maps external directory group names to local group names.
+type GroupMapping map[string]string
+
+// parseGroupMapping parses a mapping of the form "external=Local;other=Local2". Entries
+// are separated by semicolons and split on their last "=", so that external names may be
+// LDAP distinguished names such as "cn=finance,ou=groups,dc=example,dc=com=Validateurs".
+func parseGroupMapping(s string) GroupMapping {
+    mapping := GroupMapping{}
+    for _, entry := range strings.Split(s, ";") {
+        entry = strings.TrimSpace(entry)
+        i := strings.LastIndex(entry, "=")
+        if i <= 0 || i == len(entry)-1 {
+            continue
+        }
+        mapping[strings.TrimSpace(entry[:i])] = strings.TrimSpace(entry[i+1:])
+    }
+    return mapping
+}
+
+// provisionExternalUser returns the local account of an external identity, creating it on
+// first login. Accounts are matched by source and external ID, then by email. The email is
+// updated when it changed in the directory, unless another account uses it. External
+// accounts have no local password.
+func provisionExternalUser(tx *sql.Tx, source, externalID, email string) (int64, error) {
+    var userID int64
+    var currentEmail string
+    err := tx.QueryRow("SELECT id, email FROM users WHERE auth_source = ? AND external_id = ?", source, externalID).Scan(&userID, &currentEmail)
+    if err == nil {
+        if email != "" && !strings.EqualFold(email, currentEmail) {
+            var taken bool
+            if err := tx.QueryRow("SELECT EXISTS (SELECT 1 FROM users WHERE email = ? AND id != ?)", email, userID).Scan(&taken); err != nil {
+                return 0, fmt.Errorf("lookup user by email: %w", err)
+            }
+            if taken {
+                return 0, ErrExternalAccountConflict
+            }
+            if _, err := tx.Exec("UPDATE users SET email = ? WHERE id = ?", email, userID); err != nil {
+                return 0, fmt.Errorf("update external user email: %w", err)
+            }
+        }
+        return userID, nil
+    } else if !errors.Is(err, sql.ErrNoRows) {
+        return 0, fmt.Errorf("lookup external user: %w", err)
+    }
+    if email == "" {
+        return 0, errors.New("external identity has no email")
+    }
+    // An account provisioned before the external ID was known is linked by email
+    var existingSource string
+    var existingExternalID sql.NullString
+    err = tx.QueryRow("SELECT id, auth_source, external_id FROM users WHERE email = ?", email).Scan(&userID, &existingSource, &existingExternalID)
+    if err == nil {
+        if existingSource != source || existingExternalID.Valid {
+            return 0, ErrExternalAccountConflict
+        }
+        if _, err := tx.Exec("UPDATE users SET external_id = ? WHERE id = ?", externalID, userID); err != nil {
+            return 0, fmt.Errorf("link external user: %w", err)
+        }
+        return userID, nil
+    } else if !errors.Is(err, sql.ErrNoRows) {
+        return 0, fmt.Errorf("lookup user by email: %w", err)
+    }
+    res, err := tx.Exec("INSERT INTO users (email, password_hash, auth_source, external_id, created_at) VALUES (?, '', ?, ?, ?)",
+        email, source, externalID, time.Now().UTC())
+    if err != nil {
+        return 0, fmt.Errorf("insert external user: %w", err)
+    }
+    return res.LastInsertId()
+}
+
+// syncMappedGroups aligns the user's membership of mapped local groups with the external
+// groups reported by the directory. Groups that are not part of the mapping are left
+// untouched, so memberships granted locally survive a sync.
+func syncMappedGroups(tx *sql.Tx, userID int64, mapping GroupMapping, externalGroups []string) error {
+    wanted := map[string]bool{}
+    for _, g := range externalGroups {
+        if local, ok := mapping[g]; ok {
+            wanted[local] = true
+        }
+    }
+    managed := map[string]bool{}
+    for _, local := range mapping {
+        managed[local] = true
+    }
+    for name := range managed {
+        var groupID int64
+        err := tx.QueryRow("SELECT id FROM groups WHERE name = ?", name).Scan(&groupID)
+        if errors.Is(err, sql.ErrNoRows) {
+            log.Printf("[WARN] group mapping references unknown group %q", name)
+            continue
+        } else if err != nil {
+            return fmt.Errorf("select group %s: %w", name, err)
+        }
+        if wanted[name] {
+            _, err = tx.Exec("INSERT OR IGNORE INTO user_groups (user_id, group_id) VALUES (?, ?)", userID, groupID)
+        } else {
+            err = removeMappedGroup(tx, userID, groupID, name)
+        }
+        if err != nil {
+            return fmt.Errorf("sync group %s: %w", name, err)
+        }
+    }
+    return nil
+}
+
+// removeMappedGroup removes the user from a mapped group the directory no longer reports,
+// unless that would leave no active user holding permissions:assign. The membership is
+// then kept and the skipped removal logged.
+func removeMappedGroup(tx *sql.Tx, userID, groupID int64, name string) error {
+    res, err := tx.Exec("DELETE FROM user_groups WHERE user_id = ? AND group_id = ?", userID, groupID)
+    if err != nil {
+        return err
+    }
+    if n, err := res.RowsAffected(); err != nil || n == 0 {
+        return err
+    }
+    err = checkPermissionsAdminRemains(tx)
+    if !errors.Is(err, ErrLastPermissionsAdmin) {
+        return err
+    }
+    log.Printf("[WARN] user %d keeps group %q: %v", userID, name, err)
+    _, err = tx.Exec("INSERT INTO user_groups (user_id, group_id) VALUES (?, ?)", userID, groupID)
+    return err
+}
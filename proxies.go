@@ -0,0 +1,138 @@
+package main
+
+import (
+    "fmt"
+    "net/http"
+
+    "github.com/gin-gonic/gin"
+)
+
+// isProxy reports whether proxyID prepares the reports of principalID.
+func isProxy(q queryRower, principalID, proxyID int64) (bool, error) {
+    var proxy bool
+    err := q.QueryRow("SELECT EXISTS (SELECT 1 FROM report_proxies WHERE principal_id = ? AND proxy_id = ?)", principalID, proxyID).Scan(&proxy)
+    if err != nil {
+        return false, fmt.Errorf("check proxy: %w", err)
+    }
+    return proxy, nil
+}
+
+// canPrepare reports whether a user may create and edit the draft reports of ownerID: the
+// owner and their proxies.
+func canPrepare(q queryRower, ownerID, userID int64) (bool, error) {
+    if ownerID == userID {
+        return true, nil
+    }
+    return isProxy(q, ownerID, userID)
+}
+
+// ListProxies returns the users who prepare the reports of a user.
+func (h *Handlers) ListProxies(c *gin.Context) {
+    userID, ok := h.targetUserID(c)
+    if !ok {
+        return
+    }
+    rows, err := h.db.Query(`SELECT u.id, u.email FROM users u
+        JOIN report_proxies p ON p.proxy_id = u.id
+        WHERE p.principal_id = ? ORDER BY u.email`, userID)
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
+        return
+    }
+    defer rows.Close()
+    type userOut struct {
+        ID    int64  `json:"id"`
+        Email string `json:"email"`
+    }
+    proxies := []userOut{}
+    for rows.Next() {
+        var u userOut
+        if err := rows.Scan(&u.ID, &u.Email); err != nil {
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
+            return
+        }
+        proxies = append(proxies, u)
+    }
+    c.JSON(http.StatusOK, proxies)
+}
+
+// ProxiesRequest is the payload to set the proxies of a user.
+type ProxiesRequest struct {
+    ProxyIDs []int64 `json:"proxy_ids"`
+}
+
+// SetProxies replaces the users who prepare the reports of a user, such as the assistants
+// of an executive. An empty list removes every proxy.
+func (h *Handlers) SetProxies(c *gin.Context) {
+    userID, ok := h.targetUserID(c)
+    if !ok {
+        return
+    }
+    var req ProxiesRequest
+    if err := c.ShouldBindJSON(&req); err != nil || req.ProxyIDs == nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "proxy_ids is required"})
+        return
+    }
+    tx, err := h.db.Begin()
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
+        return
+    }
+    defer tx.Rollback()
+    if _, err := tx.Exec("DELETE FROM report_proxies WHERE principal_id = ?", userID); err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to set proxies"})
+        return
+    }
+    for _, pid := range req.ProxyIDs {
+        if pid == userID {
+            c.JSON(http.StatusBadRequest, gin.H{"error": "a user cannot be their own proxy"})
+            return
+        }
+        var exists bool
+        if err := tx.QueryRow("SELECT EXISTS (SELECT 1 FROM users WHERE id = ?)", pid).Scan(&exists); err != nil {
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
+            return
+        }
+        if !exists {
+            c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("unknown user id %d", pid)})
+            return
+        }
+        if _, err := tx.Exec("INSERT OR IGNORE INTO report_proxies (principal_id, proxy_id) VALUES (?, ?)", userID, pid); err != nil {
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to set proxies"})
+            return
+        }
+    }
+    if err := tx.Commit(); err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
+        return
+    }
+    c.JSON(http.StatusOK, gin.H{"user_id": userID, "proxy_ids": req.ProxyIDs})
+}
+
+// ListPrincipals returns the users whose reports the current user prepares.
+func (h *Handlers) ListPrincipals(c *gin.Context) {
+    userIDIfc, _ := c.Get(ContextUserIDKey)
+    userID := userIDIfc.(int64)
+    rows, err := h.db.Query(`SELECT u.id, u.email FROM users u
+        JOIN report_proxies p ON p.principal_id = u.id
+        WHERE p.proxy_id = ? ORDER BY u.email`, userID)
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
+        return
+    }
+    defer rows.Close()
+    type userOut struct {
+        ID    int64  `json:"id"`
+        Email string `json:"email"`
+    }
+    principals := []userOut{}
+    for rows.Next() {
+        var u userOut
+        if err := rows.Scan(&u.ID, &u.Email); err != nil {
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
+            return
+        }
+        principals = append(principals, u)
+    }
+    c.JSON(http.StatusOK, principals)
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxyPreparesReportsForOwner(t *testing.T) {
+	r, h := newReportRouter(t)
+	execID := createTestUser(t, h, "exec@example.com")
+	assistantID := createTestUser(t, h, "assistant@example.com")
+	otherID := createTestUser(t, h, "other@example.com")
+	exec := issueAPIToken(t, h.db, fmt.Sprint(execID))
+	assistant := issueAPIToken(t, h.db, fmt.Sprint(assistantID))
+	other := issueAPIToken(t, h.db, fmt.Sprint(otherID))
+	admin := issueAPIToken(t, h.db, "1")
+	body := fmt.Sprintf(`{"title":"Board trip","owner_id":%d}`, execID)
+
+	w := doAs(r, http.MethodPost, "/api/reports", body, assistant)
+	require.Equal(t, http.StatusForbidden, w.Code, w.Body.String())
+	w = doAs(r, http.MethodPut, fmt.Sprintf("/api/admin/users/%d/proxies", execID), fmt.Sprintf(`{"proxy_ids":[%d]}`, assistantID), admin)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	w = doAs(r, http.MethodGet, "/api/principals", "", assistant)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Contains(t, w.Body.String(), "exec@example.com")
+
+	w = doAs(r, http.MethodPost, "/api/reports", body, assistant)
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	var created struct {
+		ID         int64 `json:"id"`
+		UserID     int64 `json:"user_id"`
+		PreparedBy int64 `json:"prepared_by"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &created))
+	assert.Equal(t, execID, created.UserID)
+	assert.Equal(t, assistantID, created.PreparedBy)
+
+	item := `{"description":"Train","expense_date":"2024-01-10","amount_ht":100,"vat_rate":0.2}`
+	w = doAs(r, http.MethodPost, fmt.Sprintf("/api/reports/%d/items", created.ID), item, assistant)
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	w = doAs(r, http.MethodPost, fmt.Sprintf("/api/reports/%d/items", created.ID), item, other)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	w = doAs(r, http.MethodGet, fmt.Sprintf("/api/reports?owner_id=%d", execID), "", other)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	w = doAs(r, http.MethodGet, fmt.Sprintf("/api/reports?owner_id=%d", execID), "", assistant)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Contains(t, w.Body.String(), fmt.Sprintf(`"prepared_by":%d`, assistantID))
+
+	// Only the owner submits
+	w = doAs(r, http.MethodPost, fmt.Sprintf("/api/reports/%d/submit", created.ID), "", assistant)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	w = doAs(r, http.MethodPost, fmt.Sprintf("/api/reports/%d/submit", created.ID), "", exec)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	w = doAs(r, http.MethodPost, fmt.Sprintf("/api/reports/%d/items", created.ID), item, assistant)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestProxyCannotDecideReportTheyPrepared(t *testing.T) {
+	r, h := newReportRouter(t)
+	execID := createTestUser(t, h, "exec@example.com")
+	exec := issueAPIToken(t, h.db, fmt.Sprint(execID))
+	// The administrator reviews every report but also prepares those of the executive
+	admin := issueAPIToken(t, h.db, "1")
+	w := doAs(r, http.MethodPut, fmt.Sprintf("/api/admin/users/%d/proxies", execID), `{"proxy_ids":[1]}`, admin)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	w = doAs(r, http.MethodPost, "/api/reports", fmt.Sprintf(`{"title":"Board trip","owner_id":%d}`, execID), admin)
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	var created struct {
+		ID int64 `json:"id"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &created))
+	submitReport(t, r, exec, created.ID)
+
+	code, out := decide(r, admin, created.ID, "approve")
+	assert.Equal(t, http.StatusForbidden, code)
+	assert.Equal(t, AuditPreparerApproval, out["code"])
+	code, out = decide(r, admin, created.ID, "reject")
+	assert.Equal(t, http.StatusForbidden, code)
+	assert.Equal(t, AuditPreparerRejection, out["code"])
+
+	var outcomes []string
+	rows, err := h.db.Query("SELECT outcome FROM approval_audit WHERE report_id = ? ORDER BY id", created.ID)
+	require.NoError(t, err)
+	defer rows.Close()
+	for rows.Next() {
+		var outcome string
+		require.NoError(t, rows.Scan(&outcome))
+		outcomes = append(outcomes, outcome)
+	}
+	assert.Equal(t, []string{AuditPreparerApproval, AuditPreparerRejection}, outcomes)
+}
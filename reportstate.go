@@ -0,0 +1,165 @@
+package main
+
+import (
+    "errors"
+    "fmt"
+    "net/http"
+    "strconv"
+    "time"
+
+    "github.com/gin-gonic/gin"
+)
+
+// ReportStatus is the status of an expense report.
+type ReportStatus string
+
+// Statuses of an expense report.
+const (
+    StatusDraft     ReportStatus = "draft"
+    StatusSubmitted ReportStatus = "submitted"
+    StatusApproved  ReportStatus = "approved"
+    StatusRejected  ReportStatus = "rejected"
+    StatusPaid      ReportStatus = "paid"
+)
+
+// reportTransitions lists the statuses a report may move to from each status. Submitted
+// reports return to draft when withdrawn, rejected ones when reopened; approved reports
+// can only be paid, and paid reports are final.
+var reportTransitions = map[ReportStatus][]ReportStatus{
+    StatusDraft:     {StatusSubmitted},
+    StatusSubmitted: {StatusApproved, StatusRejected, StatusDraft},
+    StatusRejected:  {StatusDraft},
+    StatusApproved:  {StatusPaid},
+}
+
+// canTransitionTo reports whether a report may move from s to the status to.
+func (s ReportStatus) canTransitionTo(to ReportStatus) bool {
+    for _, allowed := range reportTransitions[s] {
+        if allowed == to {
+            return true
+        }
+    }
+    return false
+}
+
+// editable reports whether a report in status s may still be changed by its owner:
+// items, receipts and deletion are limited to drafts.
+func (s ReportStatus) editable() bool {
+    return s == StatusDraft
+}
+
+// reportAction is a status change requested by the owner of a report. Withdrawing and
+// reopening both return a report to draft, so an action also names the status it starts
+// from; from and to must be a transition of reportTransitions.
+type reportAction struct {
+    from, to ReportStatus
+}
+
+// Status changes requested by report owners.
+var (
+    actionWithdraw = reportAction{from: StatusSubmitted, to: StatusDraft}
+    actionReopen   = reportAction{from: StatusRejected, to: StatusDraft}
+)
+
+// allows reports whether the action applies to a report in status s.
+func (a reportAction) allows(s ReportStatus) bool {
+    return s == a.from && s.canTransitionTo(a.to)
+}
+
+// ErrInvalidTransition is returned when a status change is not allowed by reportTransitions.
+var ErrInvalidTransition = errors.New("invalid report status transition")
+
+// ErrStatusChanged is returned when the status of a report changed since it was read.
+var ErrStatusChanged = errors.New("report status changed concurrently")
+
+// transitionReport moves a report from one status to another and records the change, with
+// its actor and an optional comment, in the report's status history.
+func transitionReport(q execer, reportID int64, from, to ReportStatus, actorID int64, comment string) error {
+    if !from.canTransitionTo(to) {
+        return fmt.Errorf("%w: %s to %s", ErrInvalidTransition, from, to)
+    }
+    res, err := q.Exec("UPDATE expense_reports SET status = ? WHERE id = ? AND status = ?", to, reportID, from)
+    if err != nil {
+        return fmt.Errorf("update report status: %w", err)
+    }
+    if n, err := res.RowsAffected(); err != nil {
+        return fmt.Errorf("update report status: %w", err)
+    } else if n == 0 {
+        return ErrStatusChanged
+    }
+    return recordStatusChange(q, reportID, &from, to, actorID, comment)
+}
+
+// systemActor is the actor of the status changes made by the application itself, such as
+// auto-approvals. They are recorded without actor.
+const systemActor int64 = 0
+
+// recordStatusChange appends a status change to the history of a report. A nil from
+// records the creation of the report.
+func recordStatusChange(q execer, reportID int64, from *ReportStatus, to ReportStatus, actorID int64, comment string) error {
+    var note *string
+    if comment != "" {
+        note = &comment
+    }
+    _, err := q.Exec("INSERT INTO report_status_history (report_id, actor_id, from_status, to_status, comment, created_at) VALUES (?, NULLIF(?, 0), ?, ?, ?, ?)",
+        reportID, actorID, from, to, note, time.Now().UTC())
+    if err != nil {
+        return fmt.Errorf("record status change: %w", err)
+    }
+    return nil
+}
+
+// abortTransition writes the error response of a failed transitionReport.
+func abortTransition(c *gin.Context, err error) {
+    switch {
+    case errors.Is(err, ErrInvalidTransition):
+        c.JSON(http.StatusBadRequest, gin.H{"error": err.Error(), "code": "invalid_transition"})
+    case errors.Is(err, ErrStatusChanged):
+        c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+    default:
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update report status"})
+    }
+}
+
+// StatusChange is an entry of the status history of a report.
+type StatusChange struct {
+    ID         int64         `json:"id"`
+    ActorID    *int64        `json:"actor_id"`
+    ActorEmail *string       `json:"actor_email,omitempty"`
+    From       *ReportStatus `json:"from"`
+    To         ReportStatus  `json:"to"`
+    Comment    *string       `json:"comment,omitempty"`
+    CreatedAt  time.Time     `json:"created_at"`
+}
+
+// GetReportTimeline returns the status history of a report, oldest first. It is visible to
+// the owner and to the reviewers who can see the report.
+func (h *Handlers) GetReportTimeline(c *gin.Context) {
+    reportID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+    if err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "invalid report id"})
+        return
+    }
+    if !h.authorizeReportRead(c, reportID) {
+        return
+    }
+    rows, err := h.db.Query(`SELECT sh.id, sh.actor_id, u.email, sh.from_status, sh.to_status, sh.comment, sh.created_at
+        FROM report_status_history sh
+        LEFT JOIN users u ON u.id = sh.actor_id
+        WHERE sh.report_id = ? ORDER BY sh.id`, reportID)
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
+        return
+    }
+    defer rows.Close()
+    timeline := []StatusChange{}
+    for rows.Next() {
+        var sc StatusChange
+        if err := rows.Scan(&sc.ID, &sc.ActorID, &sc.ActorEmail, &sc.From, &sc.To, &sc.Comment, &sc.CreatedAt); err != nil {
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
+            return
+        }
+        timeline = append(timeline, sc)
+    }
+    c.JSON(http.StatusOK, timeline)
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReportTransitions(t *testing.T) {
+	tests := []struct {
+		from, to ReportStatus
+		allowed  bool
+	}{
+		{StatusDraft, StatusSubmitted, true},
+		{StatusDraft, StatusApproved, false},
+		{StatusSubmitted, StatusApproved, true},
+		{StatusSubmitted, StatusRejected, true},
+		{StatusSubmitted, StatusDraft, true},
+		{StatusRejected, StatusDraft, true},
+		{StatusApproved, StatusDraft, false},
+		{StatusApproved, StatusRejected, false},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.allowed, tt.from.canTransitionTo(tt.to), "%s -> %s", tt.from, tt.to)
+	}
+
+	db := newTestDB(t)
+	res, err := db.Exec("INSERT INTO expense_reports (user_id, title, status, created_at) VALUES (1, 'Trip', 'approved', CURRENT_TIMESTAMP)")
+	require.NoError(t, err)
+	reportID, _ := res.LastInsertId()
+	assert.ErrorIs(t, transitionReport(db, reportID, StatusApproved, StatusDraft, 1, ""), ErrInvalidTransition)
+	assert.ErrorIs(t, transitionReport(db, reportID, StatusSubmitted, StatusRejected, 1, ""), ErrStatusChanged)
+}
+
+func TestReportActions(t *testing.T) {
+	for _, a := range []reportAction{actionWithdraw, actionReopen} {
+		assert.True(t, a.from.canTransitionTo(a.to), "%s -> %s", a.from, a.to)
+	}
+	assert.True(t, actionWithdraw.allows(StatusSubmitted))
+	assert.False(t, actionWithdraw.allows(StatusRejected))
+	assert.True(t, actionReopen.allows(StatusRejected))
+	assert.False(t, actionReopen.allows(StatusSubmitted))
+	assert.True(t, StatusDraft.editable())
+	assert.False(t, StatusSubmitted.editable())
+}
+
+func TestReportTimeline(t *testing.T) {
+	r, h := newReportRouter(t)
+	chain := newApprovalChain(t, h)
+	reportID := createDraftReport(t, r, chain.employee, 100)
+	submitReport(t, r, chain.employee, reportID)
+	code, _ := decide(r, chain.manager, reportID, "reject")
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, http.StatusOK, doAs(r, http.MethodPost, fmt.Sprintf("/api/reports/%d/reopen", reportID), "", chain.employee).Code)
+	submitReport(t, r, chain.employee, reportID)
+	code, _ = decide(r, chain.manager, reportID, "approve")
+	require.Equal(t, http.StatusOK, code)
+
+	w := doAs(r, http.MethodGet, fmt.Sprintf("/api/reports/%d/timeline", reportID), "", chain.employee)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var timeline []StatusChange
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &timeline))
+	changes := []string{}
+	for _, sc := range timeline {
+		from := ""
+		if sc.From != nil {
+			from = string(*sc.From)
+		}
+		changes = append(changes, fmt.Sprintf("%s>%s by %s", from, sc.To, *sc.ActorEmail))
+	}
+	assert.Equal(t, []string{
+		">draft by emp@example.com",
+		"draft>submitted by emp@example.com",
+		"submitted>rejected by manager@example.com",
+		"rejected>draft by emp@example.com",
+		"draft>submitted by emp@example.com",
+		"submitted>approved by manager@example.com",
+	}, changes)
+	require.NotNil(t, timeline[2].Comment)
+	assert.Equal(t, "Missing receipt", *timeline[2].Comment)
+	assert.Equal(t, http.StatusForbidden, doAs(r, http.MethodGet, fmt.Sprintf("/api/reports/%d/timeline", reportID), "", chain.finance).Code)
+}
+
+func TestWithdrawReportNotifiesPendingApprovers(t *testing.T) {
+	r, h := newReportRouter(t)
+	chain := newApprovalChain(t, h)
+	reportID := createDraftReport(t, r, chain.employee, 1000)
+	submitReport(t, r, chain.employee, reportID)
+	withdrawURL := fmt.Sprintf("/api/reports/%d/withdraw", reportID)
+	notifications := func(key string) []Notification {
+		w := doAs(r, http.MethodGet, "/api/notifications?unread=true", "", key)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		var out []Notification
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &out))
+		return out
+	}
+
+	assert.Equal(t, http.StatusForbidden, doAs(r, http.MethodPost, withdrawURL, "", chain.manager).Code)
+	w := doAs(r, http.MethodPost, withdrawURL, "", chain.employee)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Contains(t, w.Body.String(), `"status":"draft"`)
+	assert.Empty(t, approvalSteps(t, r, chain.employee, reportID))
+	assert.Equal(t, http.StatusBadRequest, doAs(r, http.MethodPost, withdrawURL, "", chain.employee).Code)
+	got := notifications(chain.manager)
+	require.Len(t, got, 1)
+	assert.Equal(t, NotifyReportWithdrawn, got[0].Kind)
+	assert.Equal(t, reportID, *got[0].ReportID)
+	assert.Empty(t, notifications(chain.finance))
+	w = doAs(r, http.MethodPost, fmt.Sprintf("/api/notifications/%d/read", got[0].ID), "", chain.finance)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	w = doAs(r, http.MethodPost, fmt.Sprintf("/api/notifications/%d/read", got[0].ID), "", chain.manager)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Empty(t, notifications(chain.manager))
+
+	// Once a step is decided the report can no longer be withdrawn
+	submitReport(t, r, chain.employee, reportID)
+	code, _ := decide(r, chain.manager, reportID, "approve")
+	require.Equal(t, http.StatusOK, code)
+	w = doAs(r, http.MethodPost, withdrawURL, "", chain.employee)
+	assert.Equal(t, http.StatusConflict, w.Code)
+	assert.Contains(t, w.Body.String(), "already_decided")
+
+	var last string
+	require.NoError(t, h.db.QueryRow("SELECT from_status || '>' || to_status || ' ' || comment FROM report_status_history WHERE report_id = ? AND comment IS NOT NULL ORDER BY id DESC LIMIT 1", reportID).Scan(&last))
+	assert.Equal(t, "submitted>draft withdrawn by the owner", last)
+}
+
+func TestWithdrawReportNotifiesScopedValidators(t *testing.T) {
+	r, h := newReportRouter(t)
+	employee := createTestUser(t, h, "emp@example.com")
+	validator := createValidator(t, h, "val@example.com")
+	sales := createTestGroup(t, h, "Sales", employee)
+	_, err := h.db.Exec("INSERT INTO validator_scopes (validator_id, group_id) VALUES (?, ?)", validator, sales)
+	require.NoError(t, err)
+	employeeKey := issueAPIToken(t, h.db, fmt.Sprint(employee))
+
+	// Without a manager the step waits for the validators scoped to the employee's groups
+	reportID := createDraftReport(t, r, employeeKey, 100)
+	submitReport(t, r, employeeKey, reportID)
+	// Submitted before approval chains, without an expected approver
+	legacyID := createSubmittedReport(t, h, employee, "Old trip")
+	for _, id := range []int64{reportID, legacyID} {
+		w := doAs(r, http.MethodPost, fmt.Sprintf("/api/reports/%d/withdraw", id), "", employeeKey)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		assert.Contains(t, w.Body.String(), `"notified":1`)
+	}
+	var count int
+	require.NoError(t, h.db.QueryRow("SELECT COUNT(*) FROM notifications WHERE user_id = ? AND kind = ?", validator, NotifyReportWithdrawn).Scan(&count))
+	assert.Equal(t, 2, count)
+}
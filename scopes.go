@@ -0,0 +1,240 @@
+package main
+
+import (
+    "database/sql"
+    "errors"
+    "fmt"
+    "net/http"
+
+    "github.com/gin-gonic/gin"
+)
+
+// reviewScope describes the reports a reviewer may list, read and decide on: every report
+// with reports:read:all, otherwise the reports whose approval chain involves them, directly
+// or through one of their groups, and, with reports:read:scoped, the reports owned by
+// members of the user groups they are attached to in validator_scopes. approveHigh allows
+// approving reports above the high value threshold. delegated holds the scopes of the
+// validators whose approval rights are delegated to the reviewer today.
+type reviewScope struct {
+    all         bool
+    scoped      bool
+    approveHigh bool
+    reviewerID  int64
+    delegated   []reviewScope
+}
+
+// reviewScopeFor returns the review scope of the authenticated user.
+func reviewScopeFor(c *gin.Context, db *sql.DB) (reviewScope, error) {
+    userIDIfc, _ := c.Get(ContextUserIDKey)
+    userID := userIDIfc.(int64)
+    perms, err := requestPermissions(c, db, userID)
+    if err != nil {
+        return reviewScope{}, err
+    }
+    scope := reviewScope{reviewerID: userID}
+    scope.approveHigh = perms[PermReportsApproveHigh] && tokenScopeAllows(c, PermReportsApproveHigh)
+    if perms[PermReportsReadAll] && tokenScopeAllows(c, PermReportsReadAll) {
+        scope.all = true
+    } else if perms[PermReportsReadScoped] && tokenScopeAllows(c, PermReportsReadScoped) {
+        scope.scoped = true
+    }
+    if perms[PermReportsApprove] && tokenScopeAllows(c, PermReportsApprove) {
+        if scope.delegated, err = delegatedScopes(db, userID); err != nil {
+            return reviewScope{}, err
+        }
+    }
+    return scope, nil
+}
+
+// groupScopeCondition restricts an owner column to members of the groups in the
+// validator's scope.
+const groupScopeCondition = ` IN (SELECT ug.user_id FROM user_groups ug
+    JOIN validator_scopes vs ON vs.group_id = ug.group_id
+    WHERE vs.validator_id = ?)`
+
+// approvalChainCondition restricts a report ID column to the reports whose approval chain
+// names the reviewer or one of their groups, as approver or backup approver.
+const approvalChainCondition = ` IN (SELECT s.report_id FROM report_approval_steps s
+    WHERE s.approver_id = ? OR s.approver_group_id IN (SELECT group_id FROM user_groups WHERE user_id = ?)
+        OR s.escalated_group_id IN (SELECT group_id FROM user_groups WHERE user_id = ?))`
+
+// filter returns an SQL condition restricting the reports of expense_reports er to those
+// the reviewer, or a validator they stand in for, may see, with its arguments.
+func (s reviewScope) filter() (string, []interface{}) {
+    if s.all {
+        return "1 = 1", nil
+    }
+    // er.approver_id covers reports submitted before approval chains
+    cond := "(er.approver_id = ? OR er.id" + approvalChainCondition
+    args := []interface{}{s.reviewerID, s.reviewerID, s.reviewerID, s.reviewerID}
+    if s.scoped {
+        cond += " OR er.user_id" + groupScopeCondition
+        args = append(args, s.reviewerID)
+    }
+    for _, d := range s.delegated {
+        dcond, dargs := d.filter()
+        cond += " OR " + dcond
+        args = append(args, dargs...)
+    }
+    return cond + ")", args
+}
+
+// canSee reports whether the reviewer may read a report.
+func (s reviewScope) canSee(db *sql.DB, reportID int64) (bool, error) {
+    cond, args := s.filter()
+    var visible bool
+    err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM expense_reports er WHERE er.id = ? AND "+cond+")",
+        append([]interface{}{reportID}, args...)...).Scan(&visible)
+    if err != nil {
+        return false, fmt.Errorf("check review scope: %w", err)
+    }
+    return visible, nil
+}
+
+// canDecide reports whether the reviewer may decide a step of a report of ownerID. A step
+// is decided by its approver or a member of its approver group. Manager steps without an
+// approver are left to the validators of the owner's groups. Members of the backup group
+// of an escalated step and global reviewers decide it too.
+func (s reviewScope) canDecide(q queryRower, ownerID int64, step *ApprovalStep) (bool, error) {
+    var allowed bool
+    var err error
+    if step.EscalatedGroupID != nil && !s.all {
+        err = q.QueryRow("SELECT EXISTS (SELECT 1 FROM user_groups WHERE user_id = ? AND group_id = ?)", s.reviewerID, *step.EscalatedGroupID).Scan(&allowed)
+        if err != nil {
+            return false, fmt.Errorf("check review scope: %w", err)
+        }
+        if allowed {
+            return true, nil
+        }
+    }
+    switch {
+    case s.all:
+        return true, nil
+    case step.ApproverID != nil:
+        return *step.ApproverID == s.reviewerID, nil
+    case step.ApproverGroupID != nil:
+        err = q.QueryRow("SELECT EXISTS (SELECT 1 FROM user_groups WHERE user_id = ? AND group_id = ?)", s.reviewerID, *step.ApproverGroupID).Scan(&allowed)
+    case step.Approver == ApproverManager && s.scoped:
+        err = q.QueryRow("SELECT EXISTS (SELECT 1 WHERE ?"+groupScopeCondition+")", ownerID, s.reviewerID).Scan(&allowed)
+    }
+    if err != nil {
+        return false, fmt.Errorf("check review scope: %w", err)
+    }
+    return allowed, nil
+}
+
+// authorizeReportRead checks that the authenticated user may read a report: its owner, one
+// of the owner's proxies, or a reviewer who can see it. Otherwise it writes the error
+// response and returns false.
+func (h *Handlers) authorizeReportRead(c *gin.Context, reportID int64) bool {
+    userIDIfc, _ := c.Get(ContextUserIDKey)
+    userID := userIDIfc.(int64)
+    var ownerID int64
+    err := h.db.QueryRow("SELECT user_id FROM expense_reports WHERE id = ?", reportID).Scan(&ownerID)
+    if errors.Is(err, sql.ErrNoRows) {
+        c.JSON(http.StatusNotFound, gin.H{"error": "report not found"})
+        return false
+    } else if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
+        return false
+    }
+    allowed, err := canPrepare(h.db, ownerID, userID)
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "permission check failed"})
+        return false
+    }
+    if allowed {
+        return true
+    }
+    scope, err := reviewScopeFor(c, h.db)
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "permission check failed"})
+        return false
+    }
+    visible, err := scope.canSee(h.db, reportID)
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "permission check failed"})
+        return false
+    }
+    if !visible {
+        c.JSON(http.StatusForbidden, gin.H{"error": "forbidden"})
+        return false
+    }
+    return true
+}
+
+// ListValidatorScope returns the user groups whose reports a validator reviews.
+func (h *Handlers) ListValidatorScope(c *gin.Context) {
+    userID, ok := h.targetUserID(c)
+    if !ok {
+        return
+    }
+    rows, err := h.db.Query(`SELECT g.id, g.name FROM groups g
+        JOIN validator_scopes vs ON vs.group_id = g.id
+        WHERE vs.validator_id = ? ORDER BY g.name`, userID)
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
+        return
+    }
+    defer rows.Close()
+    groups := []Group{}
+    for rows.Next() {
+        var g Group
+        if err := rows.Scan(&g.ID, &g.Name); err != nil {
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
+            return
+        }
+        groups = append(groups, g)
+    }
+    c.JSON(http.StatusOK, groups)
+}
+
+// ValidatorScopeRequest is the payload to set the scope of a validator.
+type ValidatorScopeRequest struct {
+    GroupIDs []int64 `json:"group_ids"`
+}
+
+// SetValidatorScope replaces the user groups whose reports a validator reviews. An empty
+// list leaves the validator with the reports whose approval chain names them only, unless
+// they hold reports:read:all.
+func (h *Handlers) SetValidatorScope(c *gin.Context) {
+    userID, ok := h.targetUserID(c)
+    if !ok {
+        return
+    }
+    var req ValidatorScopeRequest
+    if err := c.ShouldBindJSON(&req); err != nil || req.GroupIDs == nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "group_ids is required"})
+        return
+    }
+    tx, err := h.db.Begin()
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
+        return
+    }
+    defer tx.Rollback()
+    if _, err := tx.Exec("DELETE FROM validator_scopes WHERE validator_id = ?", userID); err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to set scope"})
+        return
+    }
+    for _, gid := range req.GroupIDs {
+        var exists bool
+        if err := tx.QueryRow("SELECT EXISTS (SELECT 1 FROM groups WHERE id = ?)", gid).Scan(&exists); err != nil {
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
+            return
+        }
+        if !exists {
+            c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("unknown group id %d", gid)})
+            return
+        }
+        if _, err := tx.Exec("INSERT OR IGNORE INTO validator_scopes (validator_id, group_id) VALUES (?, ?)", userID, gid); err != nil {
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to set scope"})
+            return
+        }
+    }
+    if err := tx.Commit(); err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
+        return
+    }
+    c.JSON(http.StatusOK, gin.H{"user_id": userID, "group_ids": req.GroupIDs})
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newReportRouter exposes the report and review routes behind AuthMiddleware, as main does.
+func newReportRouter(t *testing.T) (*gin.Engine, *Handlers) {
+	db := newTestDB(t)
+	h := NewHandlers(db, t.TempDir())
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	api := r.Group("/api")
+	api.Use(AuthMiddleware(db))
+	api.POST("/reports", RequirePermission(db, PermReportsCreate), h.CreateReport)
+	api.POST("/reports/:id/submit", RequirePermission(db, PermReportsUpdateOwn), h.SubmitReport)
+	api.GET("/reports", RequirePermission(db, PermReportsReadOwn), h.ListOwnReports)
+	api.GET("/principals", RequirePermission(db, PermReportsCreate), h.ListPrincipals)
+	api.GET("/reports/:id/steps", RequirePermission(db, PermReportsReadOwn), h.ListApprovalSteps)
+	api.POST("/reports/:id/reopen", RequirePermission(db, PermReportsUpdateOwn), h.ReopenReport)
+	api.POST("/reports/:id/withdraw", RequirePermission(db, PermReportsUpdateOwn), h.WithdrawReport)
+	api.GET("/notifications", h.ListNotifications)
+	api.POST("/notifications/:id/read", h.MarkNotificationRead)
+	api.GET("/reports/:id/comments", RequireAnyPermission(db, PermReportsReadOwn, PermReportsReadAll, PermReportsReadScoped), h.ListReportComments)
+	api.POST("/reports/:id/comments", RequireAnyPermission(db, PermReportsReadOwn, PermReportsReadAll, PermReportsReadScoped), h.AddReportComment)
+	api.GET("/reports/:id/timeline", RequireAnyPermission(db, PermReportsReadOwn, PermReportsReadAll, PermReportsReadScoped), h.GetReportTimeline)
+	api.POST("/reports/:id/items", RequirePermission(db, PermReportsCreate), h.AddItem)
+	api.GET("/items/:id/receipt", RequirePermission(db, PermReportsReadOwn), h.GetReceipt)
+	api.GET("/approvals", RequirePermission(db, PermReportsApprove), h.ListAwaitingApproval)
+	api.GET("/delegations", RequirePermission(db, PermReportsApprove), h.ListDelegations)
+	api.POST("/delegations", RequirePermission(db, PermReportsApprove), h.CreateDelegation)
+	api.DELETE("/delegations/:id", RequirePermission(db, PermReportsApprove), h.DeleteDelegation)
+	admin := api.Group("/admin")
+	admin.GET("/reports", RequireAnyPermission(db, PermReportsReadAll, PermReportsReadScoped), h.AdminListReports)
+	admin.POST("/reports/:id/approve", RequirePermission(db, PermReportsApprove), h.ApproveReport)
+	admin.POST("/reports/:id/reject", RequirePermission(db, PermReportsReject), h.RejectReport)
+	admin.POST("/reports/bulk-approve", RequirePermission(db, PermReportsApprove), h.BulkApproveReports)
+	admin.POST("/reports/bulk-reject", RequirePermission(db, PermReportsReject), h.BulkRejectReports)
+	admin.GET("/audit/approvals", RequirePermission(db, PermAuditRead), h.ListApprovalAudit)
+	admin.GET("/approvals/overdue", RequireAnyPermission(db, PermReportsReadAll, PermReportsApprove), h.ListOverdueApprovals)
+	admin.GET("/payments/pending", RequirePermission(db, PermReportsPay), h.ListPendingPayments)
+	admin.POST("/payment-batches", RequirePermission(db, PermReportsPay), h.CreatePaymentBatch)
+	admin.GET("/payment-batches/:id", RequirePermission(db, PermReportsPay), h.GetPaymentBatch)
+	admin.POST("/payment-batches/:id/pay", RequirePermission(db, PermReportsPay), h.PayBatch)
+	admin.PUT("/users/:id/scope", RequirePermission(db, PermUsersUpdate), h.SetValidatorScope)
+	admin.PUT("/users/:id/proxies", RequirePermission(db, PermUsersUpdate), h.SetProxies)
+	admin.PUT("/users/:id/manager", RequirePermission(db, PermUsersUpdate), h.SetManager)
+	return r, h
+}
+
+// doAs sends a request authenticated with an API token.
+func doAs(r *gin.Engine, method, path, body, key string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-API-Key", key)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+// createTestGroup creates a group and adds the users to it.
+func createTestGroup(t *testing.T, h *Handlers, name string, userIDs ...int64) int64 {
+	res, err := h.db.Exec("INSERT INTO groups (name) VALUES (?)", name)
+	require.NoError(t, err)
+	groupID, err := res.LastInsertId()
+	require.NoError(t, err)
+	for _, id := range userIDs {
+		_, err := h.db.Exec("INSERT INTO user_groups (user_id, group_id) VALUES (?, ?)", id, groupID)
+		require.NoError(t, err)
+	}
+	return groupID
+}
+
+// createSubmittedReport inserts a submitted report owned by the user.
+func createSubmittedReport(t *testing.T, h *Handlers, userID int64, title string) int64 {
+	res, err := h.db.Exec("INSERT INTO expense_reports (user_id, title, status, created_at) VALUES (?, ?, 'submitted', ?)", userID, title, time.Now().UTC())
+	require.NoError(t, err)
+	id, err := res.LastInsertId()
+	require.NoError(t, err)
+	return id
+}
+
+func adminReportTitles(t *testing.T, r *gin.Engine, key string) []string {
+	w := doAs(r, http.MethodGet, "/api/admin/reports", "", key)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var reports []struct {
+		Title string `json:"title"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &reports))
+	titles := []string{}
+	for _, rep := range reports {
+		titles = append(titles, rep.Title)
+	}
+	return titles
+}
+
+func TestValidatorScopeFiltersReview(t *testing.T) {
+	r, h := newReportRouter(t)
+	validator := createTestUser(t, h, "val@example.com")
+	_, err := h.db.Exec("INSERT INTO user_groups (user_id, group_id) VALUES (?, 2)", validator)
+	require.NoError(t, err)
+	bob := createTestUser(t, h, "bob@example.com")
+	alice := createTestUser(t, h, "alice@example.com")
+	sales := createTestGroup(t, h, "Sales", bob)
+	createTestGroup(t, h, "Engineering", alice)
+	bobReport := createSubmittedReport(t, h, bob, "Bob trip")
+	aliceReport := createSubmittedReport(t, h, alice, "Alice trip")
+	valKey := issueAPIToken(t, h.db, fmt.Sprint(validator))
+	adminKey := issueAPIToken(t, h.db, "1")
+
+	// Without a scope a validator reviews nothing
+	assert.Empty(t, adminReportTitles(t, r, valKey))
+	assert.Equal(t, http.StatusForbidden, doAs(r, http.MethodPost, fmt.Sprintf("/api/admin/reports/%d/approve", bobReport), "", valKey).Code)
+
+	w := doAs(r, http.MethodPut, fmt.Sprintf("/api/admin/users/%d/scope", validator), fmt.Sprintf(`{"group_ids":[%d]}`, sales), adminKey)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, []string{"Bob trip"}, adminReportTitles(t, r, valKey))
+	assert.ElementsMatch(t, []string{"Bob trip", "Alice trip"}, adminReportTitles(t, r, adminKey))
+
+	w = doAs(r, http.MethodPost, fmt.Sprintf("/api/admin/reports/%d/reject", aliceReport), `{"reason":"Duplicate"}`, valKey)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Contains(t, w.Body.String(), "out_of_scope")
+	assert.Equal(t, http.StatusOK, doAs(r, http.MethodPost, fmt.Sprintf("/api/admin/reports/%d/approve", bobReport), "", valKey).Code)
+	assert.Equal(t, http.StatusOK, doAs(r, http.MethodPost, fmt.Sprintf("/api/admin/reports/%d/approve", aliceReport), "", adminKey).Code)
+}
+
+func TestValidatorScopeAppliesToReceipts(t *testing.T) {
+	r, h := newReportRouter(t)
+	validator := createTestUser(t, h, "val@example.com")
+	_, err := h.db.Exec("INSERT INTO user_groups (user_id, group_id) VALUES (?, 2)", validator)
+	require.NoError(t, err)
+	bob := createTestUser(t, h, "bob@example.com")
+	alice := createTestUser(t, h, "alice@example.com")
+	sales := createTestGroup(t, h, "Sales", bob)
+	_, err = h.db.Exec("INSERT INTO validator_scopes (validator_id, group_id) VALUES (?, ?)", validator, sales)
+	require.NoError(t, err)
+
+	receiptURL := func(owner int64) string {
+		reportID := createSubmittedReport(t, h, owner, "Trip")
+		res, err := h.db.Exec(`INSERT INTO expense_items (report_id, description, expense_date, amount_ht, amount_ttc, vat_rate, receipt_path, created_at)
+			VALUES (?, 'Taxi', '2024-01-01', 10, 12, 20, 'r.pdf', ?)`, reportID, time.Now().UTC())
+		require.NoError(t, err)
+		itemID, err := res.LastInsertId()
+		require.NoError(t, err)
+		dir := filepath.Join(h.datadir, fmt.Sprint(owner), "receipts")
+		require.NoError(t, os.MkdirAll(dir, 0o755))
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "r.pdf"), []byte("pdf"), 0o644))
+		return fmt.Sprintf("/api/items/%d/receipt", itemID)
+	}
+	valKey := issueAPIToken(t, h.db, fmt.Sprint(validator))
+	assert.Equal(t, http.StatusOK, doAs(r, http.MethodGet, receiptURL(bob), "", valKey).Code)
+	assert.Equal(t, http.StatusForbidden, doAs(r, http.MethodGet, receiptURL(alice), "", valKey).Code)
+}
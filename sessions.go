@@ -0,0 +1,221 @@
+package main
+
+import (
+    "database/sql"
+    "errors"
+    "fmt"
+    "net/http"
+    "strconv"
+    "strings"
+    "time"
+
+    "github.com/gin-gonic/gin"
+)
+
+// ContextSessionIDKey holds the ID of the session an access token belongs to. It is not
+// set for requests authenticated with a static API token.
+const ContextSessionIDKey = "sessionID"
+
+// Errors returned when a refresh token cannot be exchanged.
+var (
+    ErrSessionInvalid  = errors.New("invalid refresh token")
+    ErrSessionExpired  = errors.New("session expired")
+    ErrSessionRevoked  = errors.New("session revoked")
+    ErrSessionReplayed = errors.New("refresh token reused, session revoked")
+)
+
+// createSession opens a new session for a user and returns its ID together with the
+// plaintext refresh token. Only the digest of the refresh token is stored. Deactivated
+// accounts get ErrAccountDisabled.
+func createSession(db *sql.DB, userID int64) (int64, string, error) {
+    disabled, err := accountDisabled(db, userID)
+    if err != nil {
+        return 0, "", err
+    }
+    if disabled {
+        return 0, "", ErrAccountDisabled
+    }
+    refreshToken, err := randomToken()
+    if err != nil {
+        return 0, "", fmt.Errorf("generate refresh token: %w", err)
+    }
+    now := time.Now().UTC()
+    res, err := db.Exec("INSERT INTO sessions (user_id, refresh_token_hash, created_at, expires_at) VALUES (?, ?, ?, ?)",
+        userID, hashAPIToken(refreshToken), now, now.Add(refreshTokenTTL))
+    if err != nil {
+        return 0, "", fmt.Errorf("insert session: %w", err)
+    }
+    sessionID, _ := res.LastInsertId()
+    return sessionID, refreshToken, nil
+}
+
+// rotateSession exchanges a refresh token for a new one. The presented token is
+// invalidated, so a refresh token can only be used once: presenting it again revokes the
+// session and returns ErrSessionReplayed.
+func rotateSession(db *sql.DB, refreshToken string) (*Session, string, error) {
+    var s Session
+    var revokedAt sql.NullTime
+    err := db.QueryRow("SELECT id, user_id, created_at, expires_at, revoked_at FROM sessions WHERE refresh_token_hash = ?", hashAPIToken(refreshToken)).
+        Scan(&s.ID, &s.UserID, &s.CreatedAt, &s.ExpiresAt, &revokedAt)
+    if errors.Is(err, sql.ErrNoRows) {
+        return nil, "", revokeReplayedSession(db, refreshToken)
+    } else if err != nil {
+        return nil, "", fmt.Errorf("lookup session: %w", err)
+    }
+    if revokedAt.Valid {
+        return nil, "", ErrSessionRevoked
+    }
+    now := time.Now().UTC()
+    if !now.Before(s.ExpiresAt) {
+        return nil, "", ErrSessionExpired
+    }
+    newToken, err := randomToken()
+    if err != nil {
+        return nil, "", fmt.Errorf("generate refresh token: %w", err)
+    }
+    tx, err := db.Begin()
+    if err != nil {
+        return nil, "", fmt.Errorf("rotate session: %w", err)
+    }
+    defer tx.Rollback()
+    // Guard on the old digest so that two concurrent refreshes cannot both succeed
+    res, err := tx.Exec("UPDATE sessions SET refresh_token_hash = ?, last_used_at = ? WHERE id = ? AND refresh_token_hash = ?",
+        hashAPIToken(newToken), now, s.ID, hashAPIToken(refreshToken))
+    if err != nil {
+        return nil, "", fmt.Errorf("rotate session: %w", err)
+    }
+    if count, _ := res.RowsAffected(); count == 0 {
+        tx.Rollback()
+        return nil, "", revokeReplayedSession(db, refreshToken)
+    }
+    if _, err := tx.Exec("INSERT INTO rotated_refresh_tokens (token_hash, session_id, rotated_at) VALUES (?, ?, ?)", hashAPIToken(refreshToken), s.ID, now); err != nil {
+        return nil, "", fmt.Errorf("rotate session: %w", err)
+    }
+    if err := tx.Commit(); err != nil {
+        return nil, "", fmt.Errorf("rotate session: %w", err)
+    }
+    s.LastUsedAt = &now
+    return &s, newToken, nil
+}
+
+// revokeReplayedSession handles a refresh token that matches no current session. When it
+// was already rotated, its session is revoked and ErrSessionReplayed returned; unknown
+// tokens get ErrSessionInvalid.
+func revokeReplayedSession(db *sql.DB, refreshToken string) error {
+    var sessionID int64
+    err := db.QueryRow("SELECT session_id FROM rotated_refresh_tokens WHERE token_hash = ?", hashAPIToken(refreshToken)).Scan(&sessionID)
+    if errors.Is(err, sql.ErrNoRows) {
+        return ErrSessionInvalid
+    } else if err != nil {
+        return fmt.Errorf("lookup rotated refresh token: %w", err)
+    }
+    if _, err := db.Exec("UPDATE sessions SET revoked_at = ? WHERE id = ? AND revoked_at IS NULL", time.Now().UTC(), sessionID); err != nil {
+        return fmt.Errorf("revoke session: %w", err)
+    }
+    return ErrSessionReplayed
+}
+
+// sessionActive reports whether a session exists for the user and is neither revoked
+// nor expired.
+func sessionActive(db *sql.DB, sessionID, userID int64) (bool, error) {
+    var expiresAt time.Time
+    var revokedAt sql.NullTime
+    err := db.QueryRow("SELECT expires_at, revoked_at FROM sessions WHERE id = ? AND user_id = ?", sessionID, userID).Scan(&expiresAt, &revokedAt)
+    if errors.Is(err, sql.ErrNoRows) {
+        return false, nil
+    } else if err != nil {
+        return false, fmt.Errorf("lookup session: %w", err)
+    }
+    return !revokedAt.Valid && time.Now().UTC().Before(expiresAt), nil
+}
+
+// revokeUserSessions revokes every active session of a user and returns how many were revoked.
+func revokeUserSessions(db *sql.DB, userID int64) (int64, error) {
+    res, err := db.Exec("UPDATE sessions SET revoked_at = ? WHERE user_id = ? AND revoked_at IS NULL", time.Now().UTC(), userID)
+    if err != nil {
+        return 0, fmt.Errorf("revoke sessions: %w", err)
+    }
+    return res.RowsAffected()
+}
+
+// startSession opens a session for the user and returns the token pair to send to the client.
+func (h *Handlers) startSession(userID int64) (gin.H, error) {
+    sessionID, refreshToken, err := createSession(h.db, userID)
+    if err != nil {
+        return nil, err
+    }
+    return sessionTokens(userID, sessionID, refreshToken)
+}
+
+// sessionTokens signs an access token for the session and bundles it with the refresh token.
+func sessionTokens(userID, sessionID int64, refreshToken string) (gin.H, error) {
+    token, err := generateJWT(userID, sessionID)
+    if err != nil {
+        return nil, err
+    }
+    return gin.H{
+        "token":         token,
+        "token_type":    "Bearer",
+        "expires_in":    int64(accessTokenTTL / time.Second),
+        "refresh_token": refreshToken,
+    }, nil
+}
+
+// RefreshRequest represents the payload for exchanging a refresh token.
+type RefreshRequest struct {
+    RefreshToken string `json:"refresh_token"`
+}
+
+// Refresh exchanges a refresh token for a new access token and a new refresh token.
+func (h *Handlers) Refresh(c *gin.Context) {
+    var req RefreshRequest
+    if err := c.ShouldBindJSON(&req); err != nil || strings.TrimSpace(req.RefreshToken) == "" {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "refresh_token is required"})
+        return
+    }
+    session, refreshToken, err := rotateSession(h.db, req.RefreshToken)
+    if err != nil {
+        if errors.Is(err, ErrSessionInvalid) || errors.Is(err, ErrSessionExpired) || errors.Is(err, ErrSessionRevoked) || errors.Is(err, ErrSessionReplayed) {
+            c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+        } else {
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to refresh session"})
+        }
+        return
+    }
+    tokens, err := sessionTokens(session.UserID, session.ID, refreshToken)
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to generate token"})
+        return
+    }
+    c.JSON(http.StatusOK, tokens)
+}
+
+// Logout revokes the session of the current access token.
+func (h *Handlers) Logout(c *gin.Context) {
+    sessionIDIfc, exists := c.Get(ContextSessionIDKey)
+    if !exists {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "request is not bound to a session"})
+        return
+    }
+    sessionID := sessionIDIfc.(int64)
+    if _, err := h.db.Exec("UPDATE sessions SET revoked_at = ? WHERE id = ? AND revoked_at IS NULL", time.Now().UTC(), sessionID); err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to revoke session"})
+        return
+    }
+    c.Status(http.StatusNoContent)
+}
+
+// RevokeUserSessions revokes all sessions of a user, forcing them to log in again.
+func (h *Handlers) RevokeUserSessions(c *gin.Context) {
+    userID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+    if err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "invalid user id"})
+        return
+    }
+    count, err := revokeUserSessions(h.db, userID)
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to revoke sessions"})
+        return
+    }
+    c.JSON(http.StatusOK, gin.H{"user_id": userID, "revoked_sessions": count})
+}
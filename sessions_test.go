@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type tokenPair struct {
+	Token        string `json:"token"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+func newSessionRouter(t *testing.T) *gin.Engine {
+	db := newTestDB(t)
+	h := NewHandlers(db, t.TempDir())
+	r := newTestRouter(db, PermUsersRead)
+	r.POST("/api/auth/login", h.Login)
+	r.POST("/api/auth/refresh", h.Refresh)
+	r.POST("/api/auth/logout", AuthMiddleware(db), h.Logout)
+	return r
+}
+
+func postJSON(r *gin.Engine, path, body, bearer string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	if bearer != "" {
+		req.Header.Set("Authorization", "Bearer "+bearer)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func getWithBearer(r *gin.Engine, path, bearer string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	req.Header.Set("Authorization", "Bearer "+bearer)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestRefreshTokenRotation(t *testing.T) {
+	r := newSessionRouter(t)
+	w := postJSON(r, "/api/auth/login", `{"email":"admin@example.com","password":"admin"}`, "")
+	require.Equal(t, http.StatusOK, w.Code)
+	var login tokenPair
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &login))
+	require.NotEmpty(t, login.RefreshToken)
+	assert.Equal(t, http.StatusOK, getWithBearer(r, "/api/protected", login.Token).Code)
+
+	w = postJSON(r, "/api/auth/refresh", `{"refresh_token":"`+login.RefreshToken+`"}`, "")
+	require.Equal(t, http.StatusOK, w.Code)
+	var refreshed tokenPair
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &refreshed))
+	assert.NotEqual(t, login.RefreshToken, refreshed.RefreshToken)
+	assert.Equal(t, http.StatusOK, getWithBearer(r, "/api/protected", refreshed.Token).Code)
+
+	// A refresh token can only be used once, and replaying it revokes the whole session
+	w = postJSON(r, "/api/auth/refresh", `{"refresh_token":"`+login.RefreshToken+`"}`, "")
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Equal(t, http.StatusUnauthorized, getWithBearer(r, "/api/protected", refreshed.Token).Code)
+	w = postJSON(r, "/api/auth/refresh", `{"refresh_token":"`+refreshed.RefreshToken+`"}`, "")
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
+
+func TestLogoutRevokesSession(t *testing.T) {
+	r := newSessionRouter(t)
+	w := postJSON(r, "/api/auth/login", `{"email":"admin@example.com","password":"admin"}`, "")
+	require.Equal(t, http.StatusOK, w.Code)
+	var login tokenPair
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &login))
+
+	assert.Equal(t, http.StatusNoContent, postJSON(r, "/api/auth/logout", "", login.Token).Code)
+	assert.Equal(t, http.StatusUnauthorized, getWithBearer(r, "/api/protected", login.Token).Code)
+	w = postJSON(r, "/api/auth/refresh", `{"refresh_token":"`+login.RefreshToken+`"}`, "")
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
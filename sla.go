@@ -0,0 +1,262 @@
+package main
+
+import (
+    "database/sql"
+    "errors"
+    "fmt"
+    "log"
+    "net/http"
+    "sort"
+    "strings"
+    "time"
+
+    "github.com/gin-gonic/gin"
+    sqlite3 "github.com/mattn/go-sqlite3"
+)
+
+// approvalSLA is how long an approval step may wait for a decision, read from
+// APPROVAL_SLA. Steps waiting longer are overdue and get escalated.
+var approvalSLA = durationFromEnv("APPROVAL_SLA", 72*time.Hour)
+
+// escalationGroup names the backup approver group overdue steps are escalated to, read
+// from ESCALATION_GROUP. An empty value disables escalation.
+var escalationGroup = envOrDefault("ESCALATION_GROUP", "Direction")
+
+// escalationInterval is how often the escalation scheduler looks for overdue steps, read
+// from ESCALATION_INTERVAL.
+var escalationInterval = durationFromEnv("ESCALATION_INTERVAL", 15*time.Minute)
+
+// stepWaitingSince is the time the approval step s of the submitted report er has been
+// waiting since: the decision of the previous step, or the submission for the first one.
+const stepWaitingSince = `COALESCE((SELECT MAX(p.decided_at) FROM report_approval_steps p
+        WHERE p.report_id = s.report_id AND p.position < s.position), er.submitted_at, er.created_at)`
+
+// currentStepsQuery selects the current step of every submitted report with the time it
+// has been waiting since. Reports submitted before approval chains have no step rows and
+// wait on an implicit manager step, with a zero ID, since their submission. It takes
+// StepPending twice, StatusSubmitted, ApproverManager twice and StatusSubmitted again.
+const currentStepsQuery = `SELECT s.id, s.report_id, er.user_id, er.title, s.name, s.approver, s.approver_id, s.approver_group_id, s.escalated_group_id, ` + stepWaitingSince + `
+    FROM expense_reports er
+    JOIN report_approval_steps s ON s.report_id = er.id AND s.status = ? AND s.position =
+        (SELECT MIN(p.position) FROM report_approval_steps p WHERE p.report_id = er.id AND p.status = ?)
+    WHERE er.status = ?
+    UNION ALL SELECT 0, er.id, er.user_id, er.title, ?, ?, er.approver_id, NULL, NULL, COALESCE(er.submitted_at, er.created_at)
+    FROM expense_reports er
+    WHERE er.status = ? AND NOT EXISTS (SELECT 1 FROM report_approval_steps p WHERE p.report_id = er.id)`
+
+// sqliteTime scans a timestamp computed by an SQL expression, which the driver returns as
+// text rather than as time.Time.
+type sqliteTime struct {
+    time.Time
+}
+
+// Scan implements sql.Scanner.
+func (t *sqliteTime) Scan(value interface{}) error {
+    var s string
+    switch v := value.(type) {
+    case time.Time:
+        t.Time = v
+        return nil
+    case string:
+        s = v
+    case []byte:
+        s = string(v)
+    default:
+        return fmt.Errorf("cannot scan %T into a timestamp", value)
+    }
+    s = strings.TrimSuffix(s, "Z")
+    for _, layout := range sqlite3.SQLiteTimestampFormats {
+        if parsed, err := time.ParseInLocation(layout, s, time.UTC); err == nil {
+            t.Time = parsed.UTC()
+            return nil
+        }
+    }
+    return fmt.Errorf("invalid timestamp %q", s)
+}
+
+// pendingStep is the current step of a submitted report.
+type pendingStep struct {
+    ApprovalStep
+    ReportID     int64
+    OwnerID      int64
+    Title        string
+    WaitingSince time.Time
+}
+
+// currentSteps returns the current step of every submitted report.
+func currentSteps(q queryer) ([]pendingStep, error) {
+    rows, err := q.Query(currentStepsQuery+" ORDER BY 2", StepPending, StepPending, StatusSubmitted,
+        ApproverManager, ApproverManager, StatusSubmitted)
+    if err != nil {
+        return nil, fmt.Errorf("select current steps: %w", err)
+    }
+    defer rows.Close()
+    var steps []pendingStep
+    for rows.Next() {
+        var p pendingStep
+        var since sqliteTime
+        if err := rows.Scan(&p.ID, &p.ReportID, &p.OwnerID, &p.Title, &p.Name, &p.Approver, &p.ApproverID, &p.ApproverGroupID, &p.EscalatedGroupID, &since); err != nil {
+            return nil, fmt.Errorf("select current steps: %w", err)
+        }
+        p.Status = StepPending
+        p.WaitingSince = since.Time
+        steps = append(steps, p)
+    }
+    return steps, rows.Err()
+}
+
+// escalateOverdueSteps escalates the current steps waiting for longer than the approval
+// SLA to the backup approver group, whose members are notified, and returns how many
+// steps were escalated. A step is escalated once.
+func escalateOverdueSteps(db *sql.DB, now time.Time) (int, error) {
+    if escalationGroup == "" {
+        return 0, nil
+    }
+    var groupID int64
+    err := db.QueryRow("SELECT id FROM groups WHERE name = ?", escalationGroup).Scan(&groupID)
+    if errors.Is(err, sql.ErrNoRows) {
+        log.Printf("[WARN] escalation group %q does not exist", escalationGroup)
+        return 0, nil
+    } else if err != nil {
+        return 0, fmt.Errorf("select escalation group: %w", err)
+    }
+    steps, err := currentSteps(db)
+    if err != nil {
+        return 0, err
+    }
+    deadline := now.Add(-approvalSLA)
+    escalated := 0
+    for _, p := range steps {
+        if p.EscalatedGroupID != nil || !p.WaitingSince.Before(deadline) {
+            continue
+        }
+        tx, err := db.Begin()
+        if err != nil {
+            return escalated, fmt.Errorf("begin escalation: %w", err)
+        }
+        res, err := escalateStep(tx, &p, groupID, now)
+        if err != nil {
+            tx.Rollback()
+            return escalated, fmt.Errorf("escalate step: %w", err)
+        }
+        if n, _ := res.RowsAffected(); n == 0 {
+            // Decided or escalated meanwhile
+            tx.Rollback()
+            continue
+        }
+        p.EscalatedGroupID = &groupID
+        approvers, err := stepApprovers(tx, p.OwnerID, &p.ApprovalStep)
+        if err == nil {
+            message := fmt.Sprintf("Report %q has waited for its %s approval since %s and was escalated to %s",
+                p.Title, p.Name, p.WaitingSince.Format("2006-01-02 15:04"), escalationGroup)
+            err = notifyUsers(tx, approvers, p.ReportID, NotifyReportEscalated, message)
+        }
+        if err != nil {
+            tx.Rollback()
+            return escalated, err
+        }
+        if err := tx.Commit(); err != nil {
+            return escalated, fmt.Errorf("commit escalation: %w", err)
+        }
+        log.Printf("[INFO] escalated %s step of report %d to %s", p.Name, p.ReportID, escalationGroup)
+        escalated++
+    }
+    return escalated, nil
+}
+
+// escalateStep hands a pending step over to the backup approver group. The implicit
+// manager step of a report submitted before approval chains is stored as its first step,
+// so that its decision goes through the approval chain from then on.
+func escalateStep(tx *sql.Tx, p *pendingStep, groupID int64, now time.Time) (sql.Result, error) {
+    if p.ID != 0 {
+        return tx.Exec("UPDATE report_approval_steps SET escalated_group_id = ?, escalated_at = ? WHERE id = ? AND status = ? AND escalated_group_id IS NULL",
+            groupID, now.UTC(), p.ID, StepPending)
+    }
+    return tx.Exec(`INSERT INTO report_approval_steps (report_id, position, name, approver, approver_id, status, escalated_group_id, escalated_at)
+        SELECT er.id, 1, ?, ?, er.approver_id, ?, ?, ? FROM expense_reports er
+        WHERE er.id = ? AND er.status = ? AND NOT EXISTS (SELECT 1 FROM report_approval_steps p WHERE p.report_id = er.id)`,
+        ApproverManager, ApproverManager, StepPending, groupID, now.UTC(), p.ReportID, StatusSubmitted)
+}
+
+// StartEscalationScheduler runs escalateOverdueSteps every escalationInterval in the
+// background.
+func StartEscalationScheduler(db *sql.DB) {
+    if escalationGroup == "" {
+        return
+    }
+    go func() {
+        ticker := time.NewTicker(escalationInterval)
+        defer ticker.Stop()
+        for now := range ticker.C {
+            if _, err := escalateOverdueSteps(db, now); err != nil {
+                log.Printf("[WARN] approval escalation failed: %v", err)
+            }
+        }
+    }()
+}
+
+// ValidatorLoad counts the approval steps waiting for a validator, and how many of them
+// are past the approval SLA.
+type ValidatorLoad struct {
+    UserID  int64  `json:"user_id"`
+    Email   string `json:"email"`
+    Pending int    `json:"pending"`
+    Overdue int    `json:"overdue"`
+}
+
+// ListOverdueApprovals returns, for each validator some current step waits for, the number
+// of pending and overdue steps, most overdue first. Validators without reports:read:all
+// only get their own counts.
+func (h *Handlers) ListOverdueApprovals(c *gin.Context) {
+    userIDIfc, _ := c.Get(ContextUserIDKey)
+    userID := userIDIfc.(int64)
+    perms, err := requestPermissions(c, h.db, userID)
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "permission check failed"})
+        return
+    }
+    readAll := perms[PermReportsReadAll] && tokenScopeAllows(c, PermReportsReadAll)
+    steps, err := currentSteps(h.db)
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
+        return
+    }
+    deadline := time.Now().UTC().Add(-approvalSLA)
+    loads := map[int64]*ValidatorLoad{}
+    for i := range steps {
+        approvers, err := stepApprovers(h.db, steps[i].OwnerID, &steps[i].ApprovalStep)
+        if err != nil {
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
+            return
+        }
+        for _, id := range approvers {
+            if !readAll && id != userID {
+                continue
+            }
+            load, ok := loads[id]
+            if !ok {
+                load = &ValidatorLoad{UserID: id}
+                loads[id] = load
+            }
+            load.Pending++
+            if steps[i].WaitingSince.Before(deadline) {
+                load.Overdue++
+            }
+        }
+    }
+    out := []ValidatorLoad{}
+    for id, load := range loads {
+        if err := h.db.QueryRow("SELECT email FROM users WHERE id = ?", id).Scan(&load.Email); err != nil {
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
+            return
+        }
+        out = append(out, *load)
+    }
+    sort.Slice(out, func(i, j int) bool {
+        if out[i].Overdue != out[j].Overdue {
+            return out[i].Overdue > out[j].Overdue
+        }
+        return out[i].UserID < out[j].UserID
+    })
+    c.JSON(http.StatusOK, gin.H{"sla": approvalSLA.String(), "validators": out})
+}
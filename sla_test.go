@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOverdueStepsAreEscalated(t *testing.T) {
+	r, h := newReportRouter(t)
+	chain := newApprovalChain(t, h)
+	adminKey := issueAPIToken(t, h.db, "1")
+	late := createDraftReport(t, r, chain.employee, 100)
+	submitReport(t, r, chain.employee, late)
+	recent := createDraftReport(t, r, chain.employee, 100)
+	submitReport(t, r, chain.employee, recent)
+	_, err := h.db.Exec("UPDATE expense_reports SET submitted_at = ? WHERE id = ?", time.Now().UTC().Add(-approvalSLA-time.Hour), late)
+	require.NoError(t, err)
+
+	w := doAs(r, http.MethodGet, "/api/approvals", "", chain.manager)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var awaiting []struct {
+		ID      int64 `json:"id"`
+		Overdue bool  `json:"overdue"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &awaiting))
+	require.Len(t, awaiting, 2)
+	assert.Equal(t, late, awaiting[0].ID)
+	assert.True(t, awaiting[0].Overdue)
+	assert.False(t, awaiting[1].Overdue)
+
+	n, err := escalateOverdueSteps(h.db, time.Now().UTC())
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+	n, err = escalateOverdueSteps(h.db, time.Now().UTC())
+	require.NoError(t, err)
+	assert.Equal(t, 0, n, "a step is escalated once")
+	steps := approvalSteps(t, r, chain.employee, late)
+	require.NotNil(t, steps[0].EscalatedGroupID)
+	require.NotNil(t, steps[0].EscalatedAt)
+	w = doAs(r, http.MethodGet, "/api/notifications", "", chain.director)
+	assert.Contains(t, w.Body.String(), NotifyReportEscalated)
+
+	w = doAs(r, http.MethodGet, "/api/admin/approvals/overdue", "", adminKey)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var stats struct {
+		Validators []ValidatorLoad `json:"validators"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &stats))
+	loads := map[string]string{}
+	for _, v := range stats.Validators {
+		loads[v.Email] = fmt.Sprintf("%d/%d", v.Overdue, v.Pending)
+	}
+	assert.Equal(t, map[string]string{"manager@example.com": "1/2", "director@example.com": "1/1"}, loads)
+
+	// Validators only see their own counts
+	w = doAs(r, http.MethodGet, "/api/admin/approvals/overdue", "", chain.manager)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	stats.Validators = nil
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &stats))
+	require.Len(t, stats.Validators, 1)
+	assert.Equal(t, "manager@example.com", stats.Validators[0].Email)
+	assert.Equal(t, http.StatusForbidden, doAs(r, http.MethodGet, "/api/admin/approvals/overdue", "", chain.employee).Code)
+
+	// The backup group decides the escalated step, not the others
+	code, _ := decide(r, chain.director, recent, "approve")
+	assert.Equal(t, http.StatusForbidden, code)
+	code, out := decide(r, chain.director, late, "approve")
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "approved", out["status"])
+}
+
+// overdueLoads returns the overdue/pending counts of /api/admin/approvals/overdue by email.
+func overdueLoads(t *testing.T, r *gin.Engine, key string) map[string]string {
+	w := doAs(r, http.MethodGet, "/api/admin/approvals/overdue", "", key)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var stats struct {
+		Validators []ValidatorLoad `json:"validators"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &stats))
+	loads := map[string]string{}
+	for _, v := range stats.Validators {
+		loads[v.Email] = fmt.Sprintf("%d/%d", v.Overdue, v.Pending)
+	}
+	return loads
+}
+
+func TestScopedManagerStepsAreTracked(t *testing.T) {
+	r, h := newReportRouter(t)
+	adminKey := issueAPIToken(t, h.db, "1")
+	employee := createTestUser(t, h, "emp@example.com")
+	validator := createValidator(t, h, "val@example.com")
+	director := createTestUser(t, h, "director@example.com")
+	_, err := h.db.Exec("INSERT INTO user_groups (user_id, group_id) SELECT ?, id FROM groups WHERE name = 'Direction'", director)
+	require.NoError(t, err)
+	sales := createTestGroup(t, h, "Sales", employee)
+	_, err = h.db.Exec("INSERT INTO validator_scopes (validator_id, group_id) VALUES (?, ?)", validator, sales)
+	require.NoError(t, err)
+
+	// Without a manager the step is left to the validators scoped to the employee's groups
+	employeeKey := issueAPIToken(t, h.db, fmt.Sprint(employee))
+	reportID := createDraftReport(t, r, employeeKey, 100)
+	submitReport(t, r, employeeKey, reportID)
+	_, err = h.db.Exec("UPDATE expense_reports SET submitted_at = ? WHERE id = ?", time.Now().UTC().Add(-approvalSLA-time.Hour), reportID)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"val@example.com": "1/1"}, overdueLoads(t, r, adminKey))
+
+	n, err := escalateOverdueSteps(h.db, time.Now().UTC())
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+	w := doAs(r, http.MethodGet, "/api/notifications", "", issueAPIToken(t, h.db, fmt.Sprint(validator)))
+	assert.Contains(t, w.Body.String(), NotifyReportEscalated)
+	assert.Equal(t, map[string]string{"val@example.com": "1/1", "director@example.com": "1/1"}, overdueLoads(t, r, adminKey))
+}
+
+func TestLegacySubmittedReportsAreEscalated(t *testing.T) {
+	r, h := newReportRouter(t)
+	chain := newApprovalChain(t, h)
+	adminKey := issueAPIToken(t, h.db, "1")
+	// Submitted before approval chains: no steps, only the expected approver
+	var employee int64
+	require.NoError(t, h.db.QueryRow("SELECT id FROM users WHERE email = 'emp@example.com'").Scan(&employee))
+	reportID := createSubmittedReport(t, h, employee, "Old trip")
+	_, err := h.db.Exec("UPDATE expense_reports SET approver_id = ?, submitted_at = ? WHERE id = ?",
+		chain.managerID, time.Now().UTC().Add(-approvalSLA-time.Hour), reportID)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"manager@example.com": "1/1"}, overdueLoads(t, r, adminKey))
+
+	n, err := escalateOverdueSteps(h.db, time.Now().UTC())
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+	n, err = escalateOverdueSteps(h.db, time.Now().UTC())
+	require.NoError(t, err)
+	assert.Equal(t, 0, n, "a step is escalated once")
+	steps := approvalSteps(t, r, chain.employee, reportID)
+	require.Len(t, steps, 1)
+	assert.Equal(t, chain.managerID, *steps[0].ApproverID)
+	require.NotNil(t, steps[0].EscalatedGroupID)
+	w := doAs(r, http.MethodGet, "/api/notifications", "", chain.director)
+	assert.Contains(t, w.Body.String(), NotifyReportEscalated)
+
+	code, out := decide(r, chain.director, reportID, "approve")
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "approved", out["status"])
+}
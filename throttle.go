@@ -0,0 +1,191 @@
+package main
+
+import (
+    "database/sql"
+    "errors"
+    "fmt"
+    "log"
+    "net/http"
+    "os"
+    "strconv"
+    "strings"
+    "time"
+
+    "github.com/gin-gonic/gin"
+)
+
+// Kinds of login throttle records.
+const (
+    throttleAccount = "account"
+    throttleIP      = "ip"
+)
+
+// loginFailureWindow is the time after which failed attempts are forgotten.
+const loginFailureWindow = time.Hour
+
+// throttlePolicy describes how failed logins slow down further attempts. After
+// backoffAfter failures each new failure blocks logins for an exponentially growing delay
+// (1s, 2s, 4s, ...). After lockAfter failures logins are locked for the lockout duration.
+type throttlePolicy struct {
+    backoffAfter int
+    lockAfter    int
+    lockout      time.Duration
+}
+
+// delay returns how long logins are blocked after the given number of failures.
+func (p throttlePolicy) delay(failures int) time.Duration {
+    if failures >= p.lockAfter {
+        return p.lockout
+    }
+    if failures < p.backoffAfter {
+        return 0
+    }
+    d := time.Second << uint(failures-p.backoffAfter)
+    if d > p.lockout {
+        d = p.lockout
+    }
+    return d
+}
+
+// accountThrottle applies to failed logins on an email, whether the account exists or not.
+var accountThrottle = throttlePolicy{
+    backoffAfter: 3,
+    lockAfter:    intFromEnv("LOGIN_MAX_FAILURES", 10),
+    lockout:      durationFromEnv("LOGIN_LOCKOUT_DURATION", 15*time.Minute),
+}
+
+// ipThrottle applies to failed logins from a client address. It is more lenient because
+// many users may share an address behind a NAT.
+var ipThrottle = throttlePolicy{
+    backoffAfter: 10,
+    lockAfter:    intFromEnv("LOGIN_IP_MAX_FAILURES", 50),
+    lockout:      durationFromEnv("LOGIN_LOCKOUT_DURATION", 15*time.Minute),
+}
+
+// trustedProxies returns the addresses listed in TRUSTED_PROXIES (comma separated IPs or
+// CIDRs). Without it, forwarding headers are ignored and the peer address is used.
+func trustedProxies() []string {
+    var proxies []string
+    for _, p := range strings.Split(os.Getenv("TRUSTED_PROXIES"), ",") {
+        if p = strings.TrimSpace(p); p != "" {
+            proxies = append(proxies, p)
+        }
+    }
+    return proxies
+}
+
+// normalizeLogin returns the account key of a login email.
+func normalizeLogin(email string) string {
+    return strings.ToLower(strings.TrimSpace(email))
+}
+
+// loginBlockedFor returns how long logins for the email from the IP remain blocked, or
+// zero when they are allowed.
+func loginBlockedFor(db *sql.DB, email, ip string, now time.Time) (time.Duration, error) {
+    rows, err := db.Query("SELECT locked_until FROM login_throttle WHERE locked_until IS NOT NULL AND ((kind = ? AND subject = ?) OR (kind = ? AND subject = ?))",
+        throttleAccount, normalizeLogin(email), throttleIP, ip)
+    if err != nil {
+        return 0, fmt.Errorf("query login throttle: %w", err)
+    }
+    defer rows.Close()
+    var wait time.Duration
+    for rows.Next() {
+        var lockedUntil time.Time
+        if err := rows.Scan(&lockedUntil); err != nil {
+            return 0, fmt.Errorf("scan login throttle: %w", err)
+        }
+        if d := lockedUntil.Sub(now); d > wait {
+            wait = d
+        }
+    }
+    return wait, rows.Err()
+}
+
+// allowLoginAttempt answers with 429 and returns false while logins for the email from the
+// client address are blocked.
+func (h *Handlers) allowLoginAttempt(c *gin.Context, email string) bool {
+    wait, err := loginBlockedFor(h.db, email, c.ClientIP(), time.Now())
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
+        return false
+    }
+    if wait > 0 {
+        c.Header("Retry-After", strconv.FormatInt(int64((wait+time.Second-1)/time.Second), 10))
+        c.JSON(http.StatusTooManyRequests, gin.H{"error": "too many failed login attempts, try again later", "code": "login_throttled"})
+        return false
+    }
+    return true
+}
+
+// recordLoginFailure counts a failed login against the email and the IP and blocks them
+// according to their throttle policy.
+func recordLoginFailure(db *sql.DB, email, ip string, now time.Time) error {
+    tx, err := db.Begin()
+    if err != nil {
+        return err
+    }
+    defer tx.Rollback()
+    for _, r := range []struct {
+        kind, subject string
+        policy        throttlePolicy
+    }{
+        {throttleAccount, normalizeLogin(email), accountThrottle},
+        {throttleIP, ip, ipThrottle},
+    } {
+        var failures int
+        var lastFailedAt time.Time
+        err := tx.QueryRow("SELECT failures, last_failed_at FROM login_throttle WHERE kind = ? AND subject = ?", r.kind, r.subject).Scan(&failures, &lastFailedAt)
+        if errors.Is(err, sql.ErrNoRows) || (err == nil && now.Sub(lastFailedAt) > loginFailureWindow) {
+            failures = 0
+        } else if err != nil {
+            return fmt.Errorf("select login throttle: %w", err)
+        }
+        failures++
+        var lockedUntil interface{}
+        if d := r.policy.delay(failures); d > 0 {
+            lockedUntil = now.Add(d).UTC()
+            if failures == r.policy.lockAfter {
+                log.Printf("[WARN] logins locked for %s %s after %d failed attempts", r.kind, r.subject, failures)
+            }
+        }
+        _, err = tx.Exec(`INSERT INTO login_throttle (kind, subject, failures, last_failed_at, locked_until) VALUES (?, ?, ?, ?, ?)
+            ON CONFLICT(kind, subject) DO UPDATE SET failures = excluded.failures, last_failed_at = excluded.last_failed_at, locked_until = excluded.locked_until`,
+            r.kind, r.subject, failures, now.UTC(), lockedUntil)
+        if err != nil {
+            return fmt.Errorf("record login failure: %w", err)
+        }
+    }
+    return tx.Commit()
+}
+
+// clearAccountThrottle forgets the failed logins of an email. Failures from the IP are
+// kept, so that a valid account cannot be used to reset an attacker's address.
+func clearAccountThrottle(db *sql.DB, email string) error {
+    if _, err := db.Exec("DELETE FROM login_throttle WHERE kind = ? AND subject = ?", throttleAccount, normalizeLogin(email)); err != nil {
+        return fmt.Errorf("clear login throttle: %w", err)
+    }
+    return nil
+}
+
+// UnlockUser clears the failed login attempts and lockout of a user account.
+func (h *Handlers) UnlockUser(c *gin.Context) {
+    userID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+    if err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "invalid user id"})
+        return
+    }
+    var email string
+    err = h.db.QueryRow("SELECT email FROM users WHERE id = ?", userID).Scan(&email)
+    if errors.Is(err, sql.ErrNoRows) {
+        c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+        return
+    } else if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
+        return
+    }
+    if err := clearAccountThrottle(h.db, email); err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to unlock user"})
+        return
+    }
+    c.JSON(http.StatusOK, gin.H{"user_id": userID, "unlocked": true})
+}
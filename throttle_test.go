@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestThrottlePolicyDelay(t *testing.T) {
+	p := throttlePolicy{backoffAfter: 3, lockAfter: 10, lockout: 15 * time.Minute}
+	assert.Equal(t, time.Duration(0), p.delay(2))
+	assert.Equal(t, time.Second, p.delay(3))
+	assert.Equal(t, 8*time.Second, p.delay(6))
+	assert.Equal(t, 15*time.Minute, p.delay(10))
+}
+
+func TestLoginBackoffAndUnlock(t *testing.T) {
+	db := newTestDB(t)
+	h := NewHandlers(db, t.TempDir())
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.POST("/api/auth/login", h.Login)
+	r.POST("/api/admin/users/:id/unlock", h.UnlockUser)
+
+	for i := 0; i < accountThrottle.backoffAfter; i++ {
+		w := postJSON(r, "/api/auth/login", `{"email":"admin@example.com","password":"wrong"}`, "")
+		require.Equal(t, http.StatusUnauthorized, w.Code)
+	}
+	// Blocked even with the right password while the backoff runs
+	w := postJSON(r, "/api/auth/login", `{"email":"admin@example.com","password":"admin"}`, "")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.NotEmpty(t, w.Header().Get("Retry-After"))
+
+	_, err := db.Exec("UPDATE login_throttle SET locked_until = ?", time.Now().Add(-time.Second).UTC())
+	require.NoError(t, err)
+	w = postJSON(r, "/api/auth/login", `{"email":"admin@example.com","password":"admin"}`, "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	var count int
+	require.NoError(t, db.QueryRow("SELECT COUNT(*) FROM login_throttle WHERE kind = ?", throttleAccount).Scan(&count))
+	assert.Zero(t, count)
+
+	// A locked account stays locked for the lockout duration until an admin unlocks it
+	for i := 0; i < accountThrottle.lockAfter; i++ {
+		require.NoError(t, recordLoginFailure(db, "Admin@Example.com", fmt.Sprintf("198.51.100.%d", i), time.Now()))
+	}
+	wait, err := loginBlockedFor(db, "admin@example.com", "203.0.113.1", time.Now())
+	require.NoError(t, err)
+	assert.Greater(t, wait, accountThrottle.lockout-time.Minute)
+	assert.Equal(t, http.StatusOK, postJSON(r, "/api/admin/users/1/unlock", "", "").Code)
+	w = postJSON(r, "/api/auth/login", `{"email":"admin@example.com","password":"admin"}`, "")
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestChangePasswordIsThrottled(t *testing.T) {
+	db := newTestDB(t)
+	h := NewHandlers(db, t.TempDir())
+	r := newTestRouter(db, PermReportsReadOwn)
+	r.POST("/api/auth/login", h.Login)
+	r.POST("/api/auth/password", AuthMiddleware(db), h.ChangePassword)
+	w := postJSON(r, "/api/auth/login", `{"email":"admin@example.com","password":"admin"}`, "")
+	require.Equal(t, http.StatusOK, w.Code)
+	var session tokenPair
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &session))
+	key := session.Token
+
+	for i := 0; i < accountThrottle.backoffAfter; i++ {
+		w := postJSON(r, "/api/auth/password", `{"current_password":"wrong","new_password":"a-better-password"}`, key)
+		require.Equal(t, http.StatusUnauthorized, w.Code)
+	}
+	// Blocked even with the right current password while the backoff runs
+	w = postJSON(r, "/api/auth/password", `{"current_password":"admin","new_password":"a-better-password"}`, key)
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.NotEmpty(t, w.Header().Get("Retry-After"))
+}
+
+// newMFALoginRouter enables TOTP for the seeded admin and returns a router with the two
+// login steps and the TOTP secret.
+func newMFALoginRouter(t *testing.T) (*gin.Engine, string) {
+	t.Helper()
+	db := newTestDB(t)
+	h := NewHandlers(db, t.TempDir())
+	const secret = "JBSWY3DPEHPK3PXP"
+	_, err := db.Exec("INSERT INTO user_mfa (user_id, secret, created_at, enabled_at) VALUES (1, ?, ?, ?)", secret, time.Now().UTC(), time.Now().UTC())
+	require.NoError(t, err)
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.POST("/api/auth/login", h.Login)
+	r.POST("/api/auth/mfa/verify", h.VerifyMFA)
+	return r, secret
+}
+
+// startMFALogin logs the admin in with the password and returns the MFA challenge token.
+func startMFALogin(t *testing.T, r *gin.Engine) string {
+	t.Helper()
+	w := postJSON(r, "/api/auth/login", `{"email":"admin@example.com","password":"admin"}`, "")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var challenge struct {
+		MFAToken string `json:"mfa_token"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &challenge))
+	require.NotEmpty(t, challenge.MFAToken)
+	return challenge.MFAToken
+}
+
+func TestWrongMFACodesAreThrottled(t *testing.T) {
+	r, secret := newMFALoginRouter(t)
+	mfaToken := startMFALogin(t, r)
+	for i := 0; i < accountThrottle.backoffAfter; i++ {
+		w := postJSON(r, "/api/auth/mfa/verify", `{"mfa_token":"`+mfaToken+`","code":"000000"}`, "")
+		require.Equal(t, http.StatusUnauthorized, w.Code)
+	}
+	// Blocked even with the right code while the backoff runs, and no new challenge is issued
+	w := postJSON(r, "/api/auth/mfa/verify", `{"mfa_token":"`+mfaToken+`","code":"`+currentTOTP(t, secret, 0)+`"}`, "")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.NotEmpty(t, w.Header().Get("Retry-After"))
+	w = postJSON(r, "/api/auth/login", `{"email":"admin@example.com","password":"admin"}`, "")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+}
+
+func TestWrongMFACodesAcrossChallengesAreThrottled(t *testing.T) {
+	r, _ := newMFALoginRouter(t)
+	// A correct password must not forgive the wrong codes sent to earlier challenges
+	for i := 0; i < accountThrottle.backoffAfter; i++ {
+		mfaToken := startMFALogin(t, r)
+		w := postJSON(r, "/api/auth/mfa/verify", `{"mfa_token":"`+mfaToken+`","code":"000000"}`, "")
+		require.Equal(t, http.StatusUnauthorized, w.Code)
+	}
+	w := postJSON(r, "/api/auth/login", `{"email":"admin@example.com","password":"admin"}`, "")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.NotEmpty(t, w.Header().Get("Retry-After"))
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+    "database/sql"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "net/http"
+    "strconv"
+    "strings"
+    "time"
+
+    "github.com/gin-gonic/gin"
+)
+
+// Errors returned when a static API token cannot be used for authentication.
+var (
+    ErrAPITokenInvalid = errors.New("invalid API key")
+    ErrAPITokenExpired = errors.New("API key expired")
+    ErrAPITokenRevoked = errors.New("API key revoked")
+)
+
+// authenticateAPIToken resolves a plaintext API token to its stored record. Expired or
+// revoked tokens are rejected. On success the token's last-used time is recorded.
+func authenticateAPIToken(db *sql.DB, token string) (*APIToken, error) {
+    var t APIToken
+    var lastUsedAt, expiresAt, revokedAt sql.NullTime
+    err := db.QueryRow(`SELECT id, user_id, name, prefix, restricted, created_at, last_used_at, expires_at, revoked_at
+        FROM api_tokens WHERE token_hash = ?`, hashAPIToken(token)).
+        Scan(&t.ID, &t.UserID, &t.Name, &t.Prefix, &t.Restricted, &t.CreatedAt, &lastUsedAt, &expiresAt, &revokedAt)
+    if errors.Is(err, sql.ErrNoRows) {
+        return nil, ErrAPITokenInvalid
+    } else if err != nil {
+        return nil, fmt.Errorf("lookup api token: %w", err)
+    }
+    now := time.Now().UTC()
+    if revokedAt.Valid {
+        return nil, ErrAPITokenRevoked
+    }
+    if expiresAt.Valid && !now.Before(expiresAt.Time) {
+        return nil, ErrAPITokenExpired
+    }
+    disabled, err := accountDisabled(db, t.UserID)
+    if err != nil {
+        return nil, err
+    }
+    if disabled {
+        return nil, ErrAccountDisabled
+    }
+    if lastUsedAt.Valid {
+        t.LastUsedAt = &lastUsedAt.Time
+    }
+    if expiresAt.Valid {
+        t.ExpiresAt = &expiresAt.Time
+    }
+    if t.Permissions, err = loadAPITokenPermissions(db, t.ID); err != nil {
+        return nil, err
+    }
+    if _, err := db.Exec("UPDATE api_tokens SET last_used_at = ? WHERE id = ?", now, t.ID); err != nil {
+        return nil, fmt.Errorf("record api token use: %w", err)
+    }
+    return &t, nil
+}
+
+// loadAPITokenPermissions returns the actions a restricted token is limited to.
+func loadAPITokenPermissions(db *sql.DB, tokenID int64) ([]string, error) {
+    rows, err := db.Query(`SELECT p.action FROM permissions p
+        JOIN api_token_permissions tp ON tp.permission_id = p.id
+        WHERE tp.token_id = ?
+        ORDER BY p.action`, tokenID)
+    if err != nil {
+        return nil, fmt.Errorf("query api token permissions: %w", err)
+    }
+    defer rows.Close()
+    perms := []string{}
+    for rows.Next() {
+        var action string
+        if err := rows.Scan(&action); err != nil {
+            return nil, fmt.Errorf("scan api token permission: %w", err)
+        }
+        perms = append(perms, action)
+    }
+    return perms, rows.Err()
+}
+
+// resolvePermissionIDs maps permission actions to their IDs. It fails on unknown actions.
+func resolvePermissionIDs(tx *sql.Tx, actions []string) ([]int64, error) {
+    ids := make([]int64, 0, len(actions))
+    for _, action := range actions {
+        var id int64
+        err := tx.QueryRow("SELECT id FROM permissions WHERE action = ?", action).Scan(&id)
+        if errors.Is(err, sql.ErrNoRows) {
+            return nil, fmt.Errorf("unknown permission %q", action)
+        } else if err != nil {
+            return nil, fmt.Errorf("select permission %s: %w", action, err)
+        }
+        ids = append(ids, id)
+    }
+    return ids, nil
+}
+
+// apiTokenOut is the representation of an API token in listings. The token itself is
+// never returned; only its masked prefix.
+type apiTokenOut struct {
+    APIToken
+    MaskedToken string `json:"masked_token"`
+    Active      bool   `json:"active"`
+}
+
+// ListAPITokens returns the API tokens of a user, including expired and revoked ones.
+func (h *Handlers) ListAPITokens(c *gin.Context) {
+    userID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+    if err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "invalid user id"})
+        return
+    }
+    rows, err := h.db.Query(`SELECT id, user_id, name, prefix, restricted, created_at, last_used_at, expires_at, revoked_at
+        FROM api_tokens WHERE user_id = ?
+        ORDER BY id ASC`, userID)
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
+        return
+    }
+    defer rows.Close()
+    now := time.Now().UTC()
+    tokens := []apiTokenOut{}
+    for rows.Next() {
+        var t apiTokenOut
+        var lastUsedAt, expiresAt, revokedAt sql.NullTime
+        if err := rows.Scan(&t.ID, &t.UserID, &t.Name, &t.Prefix, &t.Restricted, &t.CreatedAt, &lastUsedAt, &expiresAt, &revokedAt); err != nil {
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
+            return
+        }
+        if lastUsedAt.Valid {
+            t.LastUsedAt = &lastUsedAt.Time
+        }
+        if expiresAt.Valid {
+            t.ExpiresAt = &expiresAt.Time
+        }
+        if revokedAt.Valid {
+            t.RevokedAt = &revokedAt.Time
+        }
+        t.MaskedToken = t.Prefix + strings.Repeat("*", 8)
+        t.Active = !revokedAt.Valid && (!expiresAt.Valid || now.Before(expiresAt.Time))
+        tokens = append(tokens, t)
+    }
+    rows.Close()
+    for i := range tokens {
+        if tokens[i].Permissions, err = loadAPITokenPermissions(h.db, tokens[i].ID); err != nil {
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
+            return
+        }
+    }
+    c.JSON(http.StatusOK, tokens)
+}
+
+// optionalTime is a JSON timestamp that tells an omitted field (Set is false) apart from an
+// explicit null (Set is true, Time is nil).
+type optionalTime struct {
+    Set  bool
+    Time *time.Time
+}
+
+// UnmarshalJSON implements json.Unmarshaler. It is only called for fields present in the
+// payload, null included.
+func (o *optionalTime) UnmarshalJSON(data []byte) error {
+    o.Set = true
+    return json.Unmarshal(data, &o.Time)
+}
+
+// UpdateAPITokenRequest defines payload for renaming a token or changing its expiry.
+// Omitted fields are left unchanged and a null expires_at removes the expiry.
+type UpdateAPITokenRequest struct {
+    Name      *string      `json:"name"`
+    ExpiresAt optionalTime `json:"expires_at"`
+}
+
+// UpdateAPIToken changes the label and expiry of a token that has not been revoked.
+func (h *Handlers) UpdateAPIToken(c *gin.Context) {
+    tokenID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+    if err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "invalid token id"})
+        return
+    }
+    var req UpdateAPITokenRequest
+    if err := c.ShouldBindJSON(&req); err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "invalid JSON"})
+        return
+    }
+    if req.ExpiresAt.Time != nil && !req.ExpiresAt.Time.After(time.Now()) {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "expires_at must be in the future"})
+        return
+    }
+    var name string
+    var expiresAt, revokedAt sql.NullTime
+    err = h.db.QueryRow("SELECT name, expires_at, revoked_at FROM api_tokens WHERE id = ?", tokenID).Scan(&name, &expiresAt, &revokedAt)
+    if err != nil {
+        if errors.Is(err, sql.ErrNoRows) {
+            c.JSON(http.StatusNotFound, gin.H{"error": "token not found"})
+        } else {
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
+        }
+        return
+    }
+    if revokedAt.Valid {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "token is revoked"})
+        return
+    }
+    // Only the columns sent are updated
+    if req.Name != nil {
+        name = strings.TrimSpace(*req.Name)
+    }
+    if req.ExpiresAt.Set {
+        expiresAt = sql.NullTime{}
+        if req.ExpiresAt.Time != nil {
+            expiresAt = sql.NullTime{Time: req.ExpiresAt.Time.UTC(), Valid: true}
+        }
+    }
+    if _, err := h.db.Exec("UPDATE api_tokens SET name = ?, expires_at = ? WHERE id = ?", name, expiresAt, tokenID); err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update token"})
+        return
+    }
+    var expiry interface{}
+    if expiresAt.Valid {
+        expiry = expiresAt.Time
+    }
+    c.JSON(http.StatusOK, gin.H{"id": tokenID, "name": name, "expires_at": expiry})
+}
+
+// RevokeAPIToken revokes a token. The row is kept so that it still appears in listings.
+func (h *Handlers) RevokeAPIToken(c *gin.Context) {
+    tokenID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+    if err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "invalid token id"})
+        return
+    }
+    res, err := h.db.Exec("UPDATE api_tokens SET revoked_at = ? WHERE id = ? AND revoked_at IS NULL", time.Now().UTC(), tokenID)
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
+        return
+    }
+    count, _ := res.RowsAffected()
+    if count == 0 {
+        c.JSON(http.StatusNotFound, gin.H{"error": "token not found or already revoked"})
+        return
+    }
+    c.JSON(http.StatusOK, gin.H{"id": tokenID, "revoked": true})
+}
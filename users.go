@@ -0,0 +1,263 @@
+package main
+
+import (
+    "database/sql"
+    "errors"
+    "fmt"
+    "log"
+    "net/http"
+    "os"
+    "path/filepath"
+    "strconv"
+    "strings"
+    "time"
+
+    "github.com/gin-gonic/gin"
+)
+
+// ErrAccountDisabled is returned when a deactivated account tries to log in or to use an
+// API token.
+var ErrAccountDisabled = errors.New("account is deactivated")
+
+// accountDisabled reports whether the user account is deactivated.
+func accountDisabled(db *sql.DB, userID int64) (bool, error) {
+    var disabledAt sql.NullTime
+    if err := db.QueryRow("SELECT disabled_at FROM users WHERE id = ?", userID).Scan(&disabledAt); err != nil {
+        return false, fmt.Errorf("check account status: %w", err)
+    }
+    return disabledAt.Valid, nil
+}
+
+// targetUserID parses the :id parameter of user admin routes and checks that the user
+// exists. It writes the error response and returns false otherwise.
+func (h *Handlers) targetUserID(c *gin.Context) (int64, bool) {
+    userID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+    if err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "invalid user id"})
+        return 0, false
+    }
+    var exists bool
+    if err := h.db.QueryRow("SELECT EXISTS (SELECT 1 FROM users WHERE id = ?)", userID).Scan(&exists); err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
+        return 0, false
+    }
+    if !exists {
+        c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+        return 0, false
+    }
+    return userID, true
+}
+
+// refuseSelf rejects an action an administrator must not perform on their own account.
+func refuseSelf(c *gin.Context, userID int64, action string) bool {
+    currentIfc, _ := c.Get(ContextUserIDKey)
+    if current, ok := currentIfc.(int64); ok && current == userID {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "you cannot " + action + " your own account"})
+        return true
+    }
+    return false
+}
+
+// UpdateUserRequest is the payload to update a user. Omitted fields are left unchanged.
+type UpdateUserRequest struct {
+    Email *string `json:"email"`
+}
+
+// UpdateUser changes the email of a local account. The email of external accounts comes
+// from the identity provider and would be overwritten at their next login.
+func (h *Handlers) UpdateUser(c *gin.Context) {
+    userID, ok := h.targetUserID(c)
+    if !ok {
+        return
+    }
+    var req UpdateUserRequest
+    if err := c.ShouldBindJSON(&req); err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "invalid JSON"})
+        return
+    }
+    if req.Email == nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "nothing to update"})
+        return
+    }
+    email := strings.TrimSpace(*req.Email)
+    if !strings.Contains(email, "@") {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "invalid email"})
+        return
+    }
+    var source string
+    if err := h.db.QueryRow("SELECT auth_source FROM users WHERE id = ?", userID).Scan(&source); err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
+        return
+    }
+    if source != AuthSourceLocal {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "email is managed by the identity provider"})
+        return
+    }
+    if _, err := h.db.Exec("UPDATE users SET email = ? WHERE id = ?", email, userID); err != nil {
+        if strings.Contains(err.Error(), "UNIQUE") {
+            c.JSON(http.StatusConflict, gin.H{"error": "email already exists"})
+        } else {
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update user"})
+        }
+        return
+    }
+    c.JSON(http.StatusOK, gin.H{"id": userID, "email": email})
+}
+
+// DeactivateUser blocks a user from logging in and from using API tokens. Open sessions
+// are revoked. Reports, tokens and group memberships are kept for a later reactivation.
+func (h *Handlers) DeactivateUser(c *gin.Context) {
+    userID, ok := h.targetUserID(c)
+    if !ok || refuseSelf(c, userID, "deactivate") {
+        return
+    }
+    tx, err := h.db.Begin()
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
+        return
+    }
+    defer tx.Rollback()
+    now := time.Now().UTC()
+    if _, err := tx.Exec("UPDATE users SET disabled_at = ? WHERE id = ? AND disabled_at IS NULL", now, userID); err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to deactivate user"})
+        return
+    }
+    if _, err := tx.Exec("UPDATE sessions SET revoked_at = ? WHERE user_id = ? AND revoked_at IS NULL", now, userID); err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to revoke sessions"})
+        return
+    }
+    if _, err := tx.Exec("DELETE FROM mfa_challenges WHERE user_id = ?", userID); err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
+        return
+    }
+    if err := checkPermissionsAdminRemains(tx); err != nil {
+        abortLastPermissionsAdmin(c, err)
+        return
+    }
+    if err := tx.Commit(); err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
+        return
+    }
+    c.JSON(http.StatusOK, gin.H{"id": userID, "active": false})
+}
+
+// ReactivateUser lifts a deactivation. API tokens that were neither revoked nor expired
+// work again.
+func (h *Handlers) ReactivateUser(c *gin.Context) {
+    userID, ok := h.targetUserID(c)
+    if !ok {
+        return
+    }
+    if _, err := h.db.Exec("UPDATE users SET disabled_at = NULL WHERE id = ?", userID); err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to reactivate user"})
+        return
+    }
+    c.JSON(http.StatusOK, gin.H{"id": userID, "active": true})
+}
+
+// DeleteUser permanently deletes a user with their reports, tokens and sessions, then
+// removes their receipts from datadir/{user_id}. Deactivation should be preferred when
+// the reports must be kept.
+func (h *Handlers) DeleteUser(c *gin.Context) {
+    userID, ok := h.targetUserID(c)
+    if !ok || refuseSelf(c, userID, "delete") {
+        return
+    }
+    tx, err := h.db.Begin()
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
+        return
+    }
+    defer tx.Rollback()
+    // Dependent rows are removed by ON DELETE CASCADE, the connection enables foreign keys
+    if _, err := tx.Exec("DELETE FROM users WHERE id = ?", userID); err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to delete user"})
+        return
+    }
+    if err := checkPermissionsAdminRemains(tx); err != nil {
+        abortLastPermissionsAdmin(c, err)
+        return
+    }
+    if err := tx.Commit(); err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
+        return
+    }
+    invalidateUserPermissions(h.db, userID)
+    userDir := filepath.Join(h.datadir, strconv.FormatInt(userID, 10))
+    if err := os.RemoveAll(userDir); err != nil {
+        // The account is gone; leftover files are only reported
+        log.Printf("[WARN] failed to remove receipts of deleted user %d: %v", userID, err)
+    }
+    c.Status(http.StatusNoContent)
+}
+
+// UserGroupRequest is the payload to add a user to a group.
+type UserGroupRequest struct {
+    GroupID int64 `json:"group_id"`
+}
+
+// AddUserToGroup adds a user to a group. Adding an existing membership is a no-op.
+func (h *Handlers) AddUserToGroup(c *gin.Context) {
+    userID, ok := h.targetUserID(c)
+    if !ok {
+        return
+    }
+    var req UserGroupRequest
+    if err := c.ShouldBindJSON(&req); err != nil || req.GroupID == 0 {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "group_id is required"})
+        return
+    }
+    var exists bool
+    if err := h.db.QueryRow("SELECT EXISTS (SELECT 1 FROM groups WHERE id = ?)", req.GroupID).Scan(&exists); err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
+        return
+    }
+    if !exists {
+        c.JSON(http.StatusNotFound, gin.H{"error": "group not found"})
+        return
+    }
+    if _, err := h.db.Exec("INSERT OR IGNORE INTO user_groups (user_id, group_id) VALUES (?, ?)", userID, req.GroupID); err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to add group membership"})
+        return
+    }
+    invalidateUserPermissions(h.db, userID)
+    c.JSON(http.StatusOK, gin.H{"user_id": userID, "group_id": req.GroupID})
+}
+
+// RemoveUserFromGroup removes a user from a group.
+func (h *Handlers) RemoveUserFromGroup(c *gin.Context) {
+    userID, ok := h.targetUserID(c)
+    if !ok {
+        return
+    }
+    groupID, err := strconv.ParseInt(c.Param("group_id"), 10, 64)
+    if err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "invalid group id"})
+        return
+    }
+    tx, err := h.db.Begin()
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
+        return
+    }
+    defer tx.Rollback()
+    res, err := tx.Exec("DELETE FROM user_groups WHERE user_id = ? AND group_id = ?", userID, groupID)
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to remove group membership"})
+        return
+    }
+    if n, _ := res.RowsAffected(); n == 0 {
+        c.JSON(http.StatusNotFound, gin.H{"error": "user is not a member of this group"})
+        return
+    }
+    if err := checkPermissionsAdminRemains(tx); err != nil {
+        abortLastPermissionsAdmin(c, err)
+        return
+    }
+    if err := tx.Commit(); err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
+        return
+    }
+    invalidateUserPermissions(h.db, userID)
+    c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newUserAdminRouter(t *testing.T) (*gin.Engine, *Handlers) {
+	db := newTestDB(t)
+	h := NewHandlers(db, t.TempDir())
+	r := newTestRouter(db, PermReportsReadOwn)
+	r.POST("/api/auth/login", h.Login)
+	admin := r.Group("/api/admin")
+	admin.PUT("/users/:id", h.UpdateUser)
+	admin.DELETE("/users/:id", h.DeleteUser)
+	admin.POST("/users/:id/deactivate", h.DeactivateUser)
+	admin.POST("/users/:id/reactivate", h.ReactivateUser)
+	admin.POST("/users/:id/groups", h.AddUserToGroup)
+	admin.DELETE("/users/:id/groups/:group_id", h.RemoveUserFromGroup)
+	return r, h
+}
+
+func createTestUser(t *testing.T, h *Handlers, email string) int64 {
+	hash, err := hashPassword("user-password")
+	require.NoError(t, err)
+	res, err := h.db.Exec("INSERT INTO users (email, password_hash, created_at) VALUES (?, ?, ?)", email, hash, time.Now().UTC())
+	require.NoError(t, err)
+	id, err := res.LastInsertId()
+	require.NoError(t, err)
+	_, err = h.db.Exec("INSERT INTO user_groups (user_id, group_id) SELECT ?, id FROM groups WHERE name = 'Utilisateurs'", id)
+	require.NoError(t, err)
+	return id
+}
+
+func doRequest(r *gin.Engine, method, path string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(method, path, nil))
+	return w
+}
+
+func TestDeactivateBlocksLoginAndAPITokens(t *testing.T) {
+	r, h := newUserAdminRouter(t)
+	createTestUser(t, h, "jane@example.com")
+	token := issueAPIToken(t, h.db, "2")
+	require.Equal(t, http.StatusOK, doWithAPIKey(r, token).Code)
+
+	require.Equal(t, http.StatusOK, doRequest(r, http.MethodPost, "/api/admin/users/2/deactivate").Code)
+	assert.Equal(t, http.StatusUnauthorized, doWithAPIKey(r, token).Code)
+	w := postJSON(r, "/api/auth/login", `{"email":"jane@example.com","password":"user-password"}`, "")
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Contains(t, w.Body.String(), "account_disabled")
+
+	require.Equal(t, http.StatusOK, doRequest(r, http.MethodPost, "/api/admin/users/2/reactivate").Code)
+	assert.Equal(t, http.StatusOK, doWithAPIKey(r, token).Code)
+	w = postJSON(r, "/api/auth/login", `{"email":"jane@example.com","password":"user-password"}`, "")
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestDeleteUserRemovesReportsAndReceipts(t *testing.T) {
+	r, h := newUserAdminRouter(t)
+	userID := createTestUser(t, h, "jane@example.com")
+	_, err := h.db.Exec("INSERT INTO expense_reports (user_id, title, status, created_at) VALUES (?, 'Trip', 'draft', ?)", userID, time.Now().UTC())
+	require.NoError(t, err)
+	receipts := filepath.Join(h.datadir, "2", "receipts")
+	require.NoError(t, os.MkdirAll(receipts, 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(receipts, "r.pdf"), []byte("pdf"), 0o644))
+
+	assert.Equal(t, http.StatusNoContent, doRequest(r, http.MethodDelete, "/api/admin/users/2").Code)
+	var count int
+	require.NoError(t, h.db.QueryRow("SELECT COUNT(*) FROM expense_reports WHERE user_id = ?", userID).Scan(&count))
+	assert.Zero(t, count)
+	assert.NoDirExists(t, filepath.Join(h.datadir, "2"))
+	assert.Equal(t, http.StatusNotFound, doRequest(r, http.MethodDelete, "/api/admin/users/2").Code)
+}
+
+func TestEditUserEmailAndGroups(t *testing.T) {
+	r, h := newUserAdminRouter(t)
+	createTestUser(t, h, "jane@example.com")
+
+	w := postJSON(r, "/api/admin/users/2/groups", `{"group_id":2}`, "")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, []string{"Utilisateurs", "Validateurs"}, userGroupNames(t, h.db, "jane@example.com"))
+	assert.Equal(t, http.StatusNoContent, doRequest(r, http.MethodDelete, "/api/admin/users/2/groups/2").Code)
+	assert.Equal(t, http.StatusNotFound, doRequest(r, http.MethodDelete, "/api/admin/users/2/groups/2").Code)
+	assert.Equal(t, http.StatusNotFound, postJSON(r, "/api/admin/users/2/groups", `{"group_id":99}`, "").Code)
+
+	w = putJSON(r, "/api/admin/users/2", `{"email":"admin@example.com"}`)
+	assert.Equal(t, http.StatusConflict, w.Code)
+	w = putJSON(r, "/api/admin/users/2", `{"email":"jane.doe@example.com"}`)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, []string{"Utilisateurs"}, userGroupNames(t, h.db, "jane.doe@example.com"))
+}
+
+func putJSON(r *gin.Engine, path, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPut, path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}